@@ -0,0 +1,404 @@
+// admin implements an operational API for the plugin, served on a separate
+// unix socket from the docker plugin API. Requests follow the docker plugin
+// convention of a POSTed JSON body to an "/Admin.<Method>" path.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/multihttp"
+)
+
+const (
+	adminSetLinkStatePath  = "/Admin.SetLinkState"
+	adminSetImpairmentPath = "/Admin.SetImpairment"
+	adminRunScenarioPath   = "/Admin.RunScenario"
+	adminStopScenarioPath  = "/Admin.StopScenario"
+	adminListScenariosPath = "/Admin.ListScenarios"
+
+	adminListNetworksPath        = "/Admin.ListNetworks"
+	adminListPoolsPath           = "/Admin.ListPools"
+	adminInspectPoolPath         = "/Admin.InspectPool"
+	adminRestartSwitchPath       = "/Admin.RestartSwitch"
+	adminForceDeleteEndpointPath = "/Admin.ForceDeleteEndpoint"
+	adminGarbageCollectPath      = "/Admin.GarbageCollect"
+	adminListOptionsPath         = "/Admin.ListOptions"
+)
+
+// AdminErrorResponse is returned by the admin API when a request fails
+type AdminErrorResponse struct {
+	Err string
+}
+
+// AdminSetLinkStateRequest enables or disables the link of an endpoint. If
+// EndpointID is empty the state applies to the whole network.
+type AdminSetLinkStateRequest struct {
+	NetworkID  string
+	EndpointID string
+	State      string
+}
+
+// AdminSetImpairmentRequest applies netem impairments to an endpoint, or all
+// endpoints of the network if EndpointID is empty. A nil Impairment clears
+// impairments.
+type AdminSetImpairmentRequest struct {
+	NetworkID  string
+	EndpointID string
+	Impairment *Impairment
+}
+
+// AdminRunScenarioRequest starts a fault-injection scenario. The scenario is
+// either passed inline (YAML or JSON) or read from a path on the plugin host.
+type AdminRunScenarioRequest struct {
+	Scenario string
+	Path     string
+}
+
+type AdminRunScenarioResponse struct {
+	Name string
+}
+
+type AdminStopScenarioRequest struct {
+	Name string
+}
+
+type AdminListScenariosResponse struct {
+	Scenarios []ScenarioStatus
+}
+
+// AdminNetworkInfo describes a network managed by the plugin
+type AdminNetworkInfo struct {
+	NetworkID        string
+	SocketDir        string
+	ManagementSocket string
+	// True if the plugin started (and supervises) the vde_switch
+	Managed bool
+	Running bool
+	// 0 if the switch is not managed by the plugin
+	SwitchPID int
+	LinkState string
+	Pools     []AdminPoolInfo
+	Endpoints []AdminEndpointInfo
+}
+
+// AdminEndpointInfo describes an endpoint on a network
+type AdminEndpointInfo struct {
+	EndpointID string
+	TapDevice  string
+	SandboxKey string
+	// 0 if the endpoint has not joined a container
+	PlugPID     int
+	MacAddress  string
+	Address     string
+	AddressIPv6 string
+	Gateway     string
+	GatewayIPv6 string
+	LinkState   string
+	Impairment  *Impairment
+}
+
+// AdminPoolInfo describes an IPAM pool
+type AdminPoolInfo struct {
+	PoolID       string
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Gateway      string
+	// Network using the pool for its address data, if any
+	NetworkID string
+	// Address allocation strategy
+	Allocation string
+	// How long released addresses are held back
+	Quarantine string
+	// Number of assignable addresses
+	Size      float64
+	Allocated []string
+	// Number of allocated and free addresses, and the percentage in use
+	// (allocated or quarantined)
+	Used        int
+	Free        float64
+	Utilisation float64
+	// Who each allocated address is assigned to
+	Assignments []AdminAssignmentInfo
+	// Released addresses not yet available again
+	Quarantined []string
+	// Addresses and ranges never assigned
+	Excluded []string
+	// Addresses only assigned when requested explicitly, by name
+	Reservations map[string]string
+	// Addresses only assigned to the given MAC addresses
+	MACBindings map[string]string
+	// Whether MAC addresses get their last address again, and which it is
+	Sticky          bool
+	StickyAddresses map[string]string
+}
+
+// AdminAssignmentInfo describes an address allocated out of a pool
+type AdminAssignmentInfo struct {
+	Address string
+	// Requesting endpoint MAC address, if given
+	MacAddress string
+	// When the address was assigned. nil if unknown.
+	AssignedAt *time.Time `json:",omitempty"`
+	// Endpoint holding the address, if known
+	NetworkID  string
+	EndpointID string
+}
+
+// AdminListNetworksRequest optionally restricts the listing to one network
+type AdminListNetworksRequest struct {
+	NetworkID string
+}
+
+type AdminListNetworksResponse struct {
+	Networks []AdminNetworkInfo
+}
+
+type AdminListPoolsResponse struct {
+	Pools []AdminPoolInfo
+}
+
+type AdminInspectPoolRequest struct {
+	PoolID string
+}
+
+type AdminRestartSwitchRequest struct {
+	NetworkID string
+}
+
+type AdminForceDeleteEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+// AdminGarbageCollectRequest removes host resources no network or endpoint
+// owns anymore. With DryRun set nothing is removed.
+type AdminGarbageCollectRequest struct {
+	DryRun bool
+}
+
+type AdminGarbageCollectResponse struct {
+	// Stale socket directories and management sockets
+	Sockets []string
+	// Tap devices not belonging to any endpoint
+	TapDevices []string
+	// Endpoints whose vde_plug2tap process has exited
+	Endpoints []string
+}
+
+// AdminListOptionsResponse lists the driver options accepted by docker
+// network create (-o) and docker network connect (--driver-opt).
+type AdminListOptionsResponse struct {
+	NetworkOptions  []OptionSpec
+	EndpointOptions []OptionSpec
+	// Accepted by docker network create --ipam-opt
+	PoolOptions []OptionSpec
+}
+
+// NewAdminHandler returns an http.Handler serving the admin API for the
+// given driver. Network and endpoint IDs in requests may also be docker names
+// if resolver is not nil.
+func NewAdminHandler(driver *VDENetworkDriver, resolver *DockerResolver, scenarios *ScenarioRunner) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(adminSetLinkStatePath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminSetLinkStateRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		req.NetworkID = resolver.ResolveNetwork(req.NetworkID)
+		req.EndpointID = resolver.ResolveEndpoint(req.NetworkID, req.EndpointID)
+		err := func() error {
+			switch req.State {
+			case LinkStateUp:
+				return driver.SetLinkState(req.NetworkID, req.EndpointID, true)
+			case LinkStateDown:
+				return driver.SetLinkState(req.NetworkID, req.EndpointID, false)
+			default:
+				return errors.New("Link state must be \"up\" or \"down\"")
+			}
+		}()
+		encodeAdminResponse(w, make(map[string]string), err)
+	})
+
+	mux.HandleFunc(adminListNetworksPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminListNetworksRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		networks := driver.ListNetworks()
+		if req.NetworkID != "" {
+			networkId, err := driver.resolveNetworkId(resolver.ResolveNetwork(req.NetworkID))
+			if err != nil {
+				encodeAdminResponse(w, nil, err)
+				return
+			}
+			for _, network := range networks {
+				if network.NetworkID == networkId {
+					networks = []AdminNetworkInfo{network}
+					break
+				}
+			}
+		}
+		encodeAdminResponse(w, &AdminListNetworksResponse{Networks: networks}, nil)
+	})
+
+	mux.HandleFunc(adminListPoolsPath, func(w http.ResponseWriter, r *http.Request) {
+		encodeAdminResponse(w, &AdminListPoolsResponse{Pools: driver.ListPools()}, nil)
+	})
+
+	mux.HandleFunc(adminInspectPoolPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminInspectPoolRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		pool, err := driver.InspectPool(req.PoolID)
+		encodeAdminResponse(w, pool, err)
+	})
+
+	mux.HandleFunc(adminRestartSwitchPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminRestartSwitchRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		err := driver.RestartSwitch(resolver.ResolveNetwork(req.NetworkID))
+		encodeAdminResponse(w, make(map[string]string), err)
+	})
+
+	mux.HandleFunc(adminForceDeleteEndpointPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminForceDeleteEndpointRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		req.NetworkID = resolver.ResolveNetwork(req.NetworkID)
+		req.EndpointID = resolver.ResolveEndpoint(req.NetworkID, req.EndpointID)
+		err := driver.ForceDeleteEndpoint(req.NetworkID, req.EndpointID)
+		encodeAdminResponse(w, make(map[string]string), err)
+	})
+
+	mux.HandleFunc(adminGarbageCollectPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminGarbageCollectRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		encodeAdminResponse(w, driver.GarbageCollect(req.DryRun), nil)
+	})
+
+	mux.HandleFunc(adminListOptionsPath, func(w http.ResponseWriter, r *http.Request) {
+		encodeAdminResponse(w, &AdminListOptionsResponse{
+			NetworkOptions:  networkOptionSpecs,
+			EndpointOptions: endpointOptionSpecs,
+			PoolOptions:     poolOptionSpecs,
+		}, nil)
+	})
+
+	mux.HandleFunc(adminSetImpairmentPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminSetImpairmentRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		req.NetworkID = resolver.ResolveNetwork(req.NetworkID)
+		req.EndpointID = resolver.ResolveEndpoint(req.NetworkID, req.EndpointID)
+		err := driver.SetImpairment(req.NetworkID, req.EndpointID, req.Impairment)
+		encodeAdminResponse(w, make(map[string]string), err)
+	})
+
+	mux.HandleFunc(adminRunScenarioPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminRunScenarioRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		var scenario *Scenario
+		var err error
+		if req.Path != "" {
+			scenario, err = ParseScenarioFile(req.Path)
+		} else {
+			scenario, err = ParseScenario([]byte(req.Scenario))
+		}
+		if err == nil {
+			err = scenarios.Start(scenario)
+		}
+		if err != nil {
+			encodeAdminResponse(w, nil, err)
+			return
+		}
+		encodeAdminResponse(w, &AdminRunScenarioResponse{Name: scenario.Name}, nil)
+	})
+
+	mux.HandleFunc(adminStopScenarioPath, func(w http.ResponseWriter, r *http.Request) {
+		req := &AdminStopScenarioRequest{}
+		if err := decodeAdminRequest(w, r, req); err != nil {
+			return
+		}
+		encodeAdminResponse(w, make(map[string]string), scenarios.Stop(req.Name))
+	})
+
+	mux.HandleFunc(adminListScenariosPath, func(w http.ResponseWriter, r *http.Request) {
+		encodeAdminResponse(w, &AdminListScenariosResponse{Scenarios: scenarios.List()}, nil)
+	})
+
+	return mux
+}
+
+// ListenAdmin starts serving the admin API on a unix socket. The socket is
+// only accessible to root, and optionally the given group.
+func ListenAdmin(path string, group string, handler http.Handler) ([]net.Listener, error) {
+	mode := os.FileMode(0600)
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Could not find admin socket group:", group, err))
+		}
+		mode = os.FileMode(0660)
+		gid = g.Gid
+	}
+
+	// Remove a stale socket left behind by an unclean exit.
+	if fsutil.PathIsSocket(path) {
+		os.Remove(path)
+	}
+
+	listeners, err := multihttp.Listen([]string{"unix://" + path}, handler)
+	if err != nil {
+		return listeners, err
+	}
+	if err := os.Chown(path, -1, gid); err != nil {
+		return listeners, err
+	}
+	return listeners, os.Chmod(path, mode)
+}
+
+// decodeAdminRequest decodes a JSON request body. Requests without parameters
+// may leave out the body.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, req interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	return nil
+}
+
+// encodeAdminResponse writes the response, or an AdminErrorResponse if err
+// is not nil.
+func encodeAdminResponse(w http.ResponseWriter, res interface{}, err error) {
+	if err != nil {
+		log.Errorln("Admin request failed:", err)
+		metricErrors.Inc(errorAdminRequest)
+		sdk.EncodeResponse(w, &AdminErrorResponse{Err: err.Error()}, err.Error())
+		return
+	}
+	sdk.EncodeResponse(w, res, "")
+}
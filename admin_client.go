@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/wrouesnel/multihttp"
+)
+
+// AdminClient talks to the admin API of a running plugin daemon.
+type AdminClient struct {
+	client *http.Client
+}
+
+// NewAdminClient returns a client for the admin API on the given unix socket
+// path.
+func NewAdminClient(path string) (*AdminClient, error) {
+	client, err := multihttp.NewClient("unix://" + path)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminClient{client: client}, nil
+}
+
+// Call an admin API method. req may be nil for methods without parameters.
+func (this *AdminClient) call(path string, req interface{}, resp interface{}) error {
+	body := new(bytes.Buffer)
+	if req != nil {
+		if err := json.NewEncoder(body).Encode(req); err != nil {
+			return err
+		}
+	}
+
+	httpResp, err := this.client.Post("http://plugin"+path, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		errResp := &AdminErrorResponse{}
+		if err := json.NewDecoder(httpResp.Body).Decode(errResp); err != nil || errResp.Err == "" {
+			return errors.New(httpResp.Status)
+		}
+		return errors.New(errResp.Err)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (this *AdminClient) ListNetworks(networkId string) ([]AdminNetworkInfo, error) {
+	resp := &AdminListNetworksResponse{}
+	err := this.call(adminListNetworksPath, &AdminListNetworksRequest{NetworkID: networkId}, resp)
+	return resp.Networks, err
+}
+
+func (this *AdminClient) ListPools() ([]AdminPoolInfo, error) {
+	resp := &AdminListPoolsResponse{}
+	err := this.call(adminListPoolsPath, nil, resp)
+	return resp.Pools, err
+}
+
+func (this *AdminClient) InspectPool(poolId string) (*AdminPoolInfo, error) {
+	resp := &AdminPoolInfo{}
+	err := this.call(adminInspectPoolPath, &AdminInspectPoolRequest{PoolID: poolId}, resp)
+	return resp, err
+}
+
+func (this *AdminClient) RestartSwitch(networkId string) error {
+	return this.call(adminRestartSwitchPath, &AdminRestartSwitchRequest{NetworkID: networkId}, nil)
+}
+
+func (this *AdminClient) ForceDeleteEndpoint(networkId string, endpointId string) error {
+	return this.call(adminForceDeleteEndpointPath,
+		&AdminForceDeleteEndpointRequest{NetworkID: networkId, EndpointID: endpointId}, nil)
+}
+
+func (this *AdminClient) GarbageCollect(dryRun bool) (*AdminGarbageCollectResponse, error) {
+	resp := &AdminGarbageCollectResponse{}
+	err := this.call(adminGarbageCollectPath, &AdminGarbageCollectRequest{DryRun: dryRun}, resp)
+	return resp, err
+}
+
+func (this *AdminClient) ListOptions() (*AdminListOptionsResponse, error) {
+	resp := &AdminListOptionsResponse{}
+	err := this.call(adminListOptionsPath, nil, resp)
+	return resp, err
+}
+
+func (this *AdminClient) SetLinkState(networkId string, endpointId string, state string) error {
+	return this.call(adminSetLinkStatePath,
+		&AdminSetLinkStateRequest{NetworkID: networkId, EndpointID: endpointId, State: state}, nil)
+}
+
+func (this *AdminClient) RunScenario(scenario string) (string, error) {
+	resp := &AdminRunScenarioResponse{}
+	err := this.call(adminRunScenarioPath, &AdminRunScenarioRequest{Scenario: scenario}, resp)
+	return resp.Name, err
+}
+
+func (this *AdminClient) StopScenario(name string) error {
+	return this.call(adminStopScenarioPath, &AdminStopScenarioRequest{Name: name}, nil)
+}
+
+func (this *AdminClient) ListScenarios() ([]ScenarioStatus, error) {
+	resp := &AdminListScenariosResponse{}
+	err := this.call(adminListScenariosPath, nil, resp)
+	return resp.Scenarios, err
+}
@@ -0,0 +1,280 @@
+// allocator tracks which offsets of an IPAM subpool are assigned. Subpools of
+// up to 2^24 addresses use a hierarchical bitmap, larger (IPv6) ones a sorted
+// list of the runs of assigned offsets.
+
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Largest number of host bits a subpool can have to be tracked with a bitmap.
+// A bitmap of 2^24 addresses takes 2MB.
+const maxBitmapHostBits = 24
+
+// addressSet is the set of assigned offsets of a subpool. Offsets range from
+// 0 to a maximum given on creation.
+type addressSet interface {
+	Has(offset uint64) bool
+	Add(offset uint64)
+	Remove(offset uint64)
+	// NextClear returns the first offset at or after from which is not in
+	// the set, wrapping around to 0. Returns false if every offset is set.
+	NextClear(from uint64) (uint64, bool)
+	Len() int
+	// Each calls fn for every offset in the set, in ascending order.
+	Each(fn func(offset uint64))
+}
+
+// Returns the set suited to a subpool with the given number of host bits.
+// Subpools with more than 64 host bits are limited to their first 2^64
+// addresses.
+func newAddressSet(hostBits int) addressSet {
+	if hostBits <= maxBitmapHostBits {
+		return newBitmapSet(uint64(1) << uint(hostBits))
+	}
+	if hostBits >= 64 {
+		return newSparseSet(^uint64(0))
+	}
+	return newSparseSet(uint64(1)<<uint(hostBits) - 1)
+}
+
+// bitmapSet stores one bit per offset. Each level above the bottom has a bit
+// per word of the level below, set when that word is full, and the top level
+// is a single word. Finding a clear bit walks at most one word per level, so
+// every operation is O(log64 size).
+type bitmapSet struct {
+	size   uint64
+	count  int
+	levels [][]uint64
+}
+
+func newBitmapSet(size uint64) *bitmapSet {
+	this := &bitmapSet{size: size}
+	for n := size; ; {
+		words := (n + 63) / 64
+		this.levels = append(this.levels, make([]uint64, words))
+		if words == 1 {
+			break
+		}
+		n = words
+	}
+
+	// The bits past the end of each level are set, so they are never found
+	// clear.
+	used := size
+	for k, level := range this.levels {
+		for i := used; i < uint64(len(level))*64; i++ {
+			this.setBit(k, i)
+		}
+		used = uint64(len(level))
+	}
+	return this
+}
+
+// Set a bit, marking the word full in the level above if it now is.
+func (this *bitmapSet) setBit(k int, i uint64) {
+	word := &this.levels[k][i/64]
+	*word |= 1 << (i % 64)
+	if *word == ^uint64(0) && k+1 < len(this.levels) {
+		this.setBit(k+1, i/64)
+	}
+}
+
+// Clear a bit, marking the word not full in the level above if it was.
+func (this *bitmapSet) clearBit(k int, i uint64) {
+	word := &this.levels[k][i/64]
+	wasFull := *word == ^uint64(0)
+	*word &^= 1 << (i % 64)
+	if wasFull && k+1 < len(this.levels) {
+		this.clearBit(k+1, i/64)
+	}
+}
+
+// Find the first clear bit of a level at or after from.
+func (this *bitmapSet) findClear(k int, from uint64) (uint64, bool) {
+	level := this.levels[k]
+	w := from / 64
+	if w >= uint64(len(level)) {
+		return 0, false
+	}
+	if free := ^level[w] & (^uint64(0) << (from % 64)); free != 0 {
+		return w*64 + uint64(bits.TrailingZeros64(free)), true
+	}
+	// The top level is a single word, so nothing follows it.
+	if k+1 == len(this.levels) {
+		return 0, false
+	}
+	// The level above knows the next word which is not full.
+	next, found := this.findClear(k+1, w+1)
+	if !found {
+		return 0, false
+	}
+	return next*64 + uint64(bits.TrailingZeros64(^level[next])), true
+}
+
+func (this *bitmapSet) Has(offset uint64) bool {
+	if offset >= this.size {
+		return false
+	}
+	return this.levels[0][offset/64]&(1<<(offset%64)) != 0
+}
+
+func (this *bitmapSet) Add(offset uint64) {
+	if offset >= this.size || this.Has(offset) {
+		return
+	}
+	this.setBit(0, offset)
+	this.count++
+}
+
+func (this *bitmapSet) Remove(offset uint64) {
+	if !this.Has(offset) {
+		return
+	}
+	this.clearBit(0, offset)
+	this.count--
+}
+
+func (this *bitmapSet) NextClear(from uint64) (uint64, bool) {
+	if offset, found := this.findClear(0, from); found {
+		return offset, true
+	}
+	return this.findClear(0, 0)
+}
+
+func (this *bitmapSet) Len() int {
+	return this.count
+}
+
+func (this *bitmapSet) Each(fn func(offset uint64)) {
+	for w, word := range this.levels[0] {
+		for word != 0 {
+			offset := uint64(w)*64 + uint64(bits.TrailingZeros64(word))
+			word &= word - 1
+			if offset < this.size {
+				fn(offset)
+			}
+		}
+	}
+}
+
+// sparseSet stores the assigned offsets of subpools too large for a bitmap,
+// as a sorted list of the runs of consecutive assigned offsets. Lookups and
+// finding a clear offset are binary searches, O(log runs). Adding or removing
+// an offset moves the runs after it, which stays cheap for the few thousand
+// endpoints a network has.
+type sparseSet struct {
+	maxOffset uint64
+	count     int
+	runs      []offsetRun
+}
+
+// Offsets from first to last inclusive, all assigned. Runs never touch, or
+// they would be one run.
+type offsetRun struct {
+	first uint64
+	last  uint64
+}
+
+func newSparseSet(maxOffset uint64) *sparseSet {
+	return &sparseSet{maxOffset: maxOffset}
+}
+
+// Index of the first run ending at or after the offset, or len(runs).
+func (this *sparseSet) search(offset uint64) int {
+	return sort.Search(len(this.runs), func(i int) bool {
+		return this.runs[i].last >= offset
+	})
+}
+
+func (this *sparseSet) Has(offset uint64) bool {
+	i := this.search(offset)
+	return i < len(this.runs) && this.runs[i].first <= offset
+}
+
+func (this *sparseSet) Add(offset uint64) {
+	if offset > this.maxOffset || this.Has(offset) {
+		return
+	}
+	this.count++
+	i := this.search(offset)
+	// Joins the run before, the run after, or both
+	joinsBefore := i > 0 && this.runs[i-1].last+1 == offset
+	joinsAfter := i < len(this.runs) && this.runs[i].first-1 == offset
+	switch {
+	case joinsBefore && joinsAfter:
+		this.runs[i-1].last = this.runs[i].last
+		this.runs = append(this.runs[:i], this.runs[i+1:]...)
+	case joinsBefore:
+		this.runs[i-1].last = offset
+	case joinsAfter:
+		this.runs[i].first = offset
+	default:
+		this.runs = append(this.runs, offsetRun{})
+		copy(this.runs[i+1:], this.runs[i:])
+		this.runs[i] = offsetRun{offset, offset}
+	}
+}
+
+func (this *sparseSet) Remove(offset uint64) {
+	if !this.Has(offset) {
+		return
+	}
+	this.count--
+	i := this.search(offset)
+	run := this.runs[i]
+	switch {
+	case run.first == offset && run.last == offset:
+		this.runs = append(this.runs[:i], this.runs[i+1:]...)
+	case run.first == offset:
+		this.runs[i].first++
+	case run.last == offset:
+		this.runs[i].last--
+	default:
+		// Split the run around the offset
+		this.runs = append(this.runs, offsetRun{})
+		copy(this.runs[i+1:], this.runs[i:])
+		this.runs[i].last = offset - 1
+		this.runs[i+1].first = offset + 1
+	}
+}
+
+func (this *sparseSet) NextClear(from uint64) (uint64, bool) {
+	if from > this.maxOffset {
+		from = 0
+	}
+	i := this.search(from)
+	if i == len(this.runs) || this.runs[i].first > from {
+		return from, true
+	}
+	// Runs never touch, so the offset after one is clear unless it is the
+	// end of the set.
+	if last := this.runs[i].last; last < this.maxOffset {
+		return last + 1, true
+	}
+	// Wrap around
+	if this.runs[0].first > 0 {
+		return 0, true
+	}
+	if last := this.runs[0].last; last < this.maxOffset {
+		return last + 1, true
+	}
+	return 0, false
+}
+
+func (this *sparseSet) Len() int {
+	return this.count
+}
+
+func (this *sparseSet) Each(fn func(offset uint64)) {
+	for _, run := range this.runs {
+		for offset := run.first; ; offset++ {
+			fn(offset)
+			if offset == run.last {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+)
+
+// Checks a set against the offsets it should hold, of size offsets.
+func checkAddressSet(t *testing.T, set addressSet, expected map[uint64]bool, size uint64) {
+	if set.Len() != len(expected) {
+		t.Fatalf("Set has %d offsets, expected %d", set.Len(), len(expected))
+	}
+	offsets := []uint64{}
+	set.Each(func(offset uint64) {
+		offsets = append(offsets, offset)
+	})
+	wanted := []uint64{}
+	for offset := uint64(0); offset < size; offset++ {
+		if set.Has(offset) != expected[offset] {
+			t.Fatalf("Has(%d) is %v", offset, !expected[offset])
+		}
+		if expected[offset] {
+			wanted = append(wanted, offset)
+		}
+
+		// The first clear offset at or after this one, wrapping around
+		clear, found := uint64(0), false
+		for i := uint64(0); i < size; i++ {
+			if probe := (offset + i) % size; !expected[probe] {
+				clear, found = probe, true
+				break
+			}
+		}
+		if next, ok := set.NextClear(offset); next != clear || ok != found {
+			t.Fatalf("NextClear(%d) is %d, %v, expected %d, %v", offset, next, ok, clear, found)
+		}
+	}
+	if !reflect.DeepEqual(offsets, wanted) {
+		t.Fatalf("Each gave %v, expected %v", offsets, wanted)
+	}
+}
+
+func TestAddressSets(t *testing.T) {
+	const size = 200
+	sets := map[string]func() addressSet{
+		"bitmap": func() addressSet { return newBitmapSet(size) },
+		"sparse": func() addressSet { return newSparseSet(size - 1) },
+	}
+	for name, newSet := range sets {
+		t.Run(name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(1))
+			set := newSet()
+			expected := map[uint64]bool{}
+			for round := 0; round < 20; round++ {
+				// Fill the set up, then mostly empty it again
+				add := round%4 != 3
+				for i := 0; i < 60; i++ {
+					offset := uint64(random.Intn(size))
+					if add {
+						set.Add(offset)
+						expected[offset] = true
+					} else {
+						set.Remove(offset)
+						delete(expected, offset)
+					}
+				}
+				checkAddressSet(t, set, expected, size)
+			}
+
+			for offset := uint64(0); offset < size; offset++ {
+				set.Add(offset)
+				expected[offset] = true
+			}
+			checkAddressSet(t, set, expected, size)
+			set.Remove(size / 2)
+			delete(expected, size/2)
+			checkAddressSet(t, set, expected, size)
+		})
+	}
+}
+
+// The previous allocator: assigned IPs in a map, with sequential allocation
+// probing each address of the subpool in turn.
+type mapAllocator struct {
+	subpool  net.IPNet
+	assigned map[string]net.IP
+}
+
+func (this *mapAllocator) assign() net.IP {
+	ip := make(net.IP, len(this.subpool.IP))
+	copy(ip, this.subpool.IP)
+	for ; this.subpool.Contains(ip); ip = nextIP(ip) {
+		if _, found := this.assigned[ip.String()]; !found {
+			this.assigned[ip.String()] = ip
+			return ip
+		}
+	}
+	return nil
+}
+
+func (this *mapAllocator) free(ip net.IP) {
+	delete(this.assigned, ip.String())
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Numbers of addresses assigned before allocating another
+var benchmarkFill = []int{256, 4096, 65000}
+
+func BenchmarkSequentialMap(b *testing.B) {
+	for _, fill := range benchmarkFill {
+		b.Run(fmt.Sprint(fill), func(b *testing.B) {
+			_, subpool, _ := net.ParseCIDR("10.0.0.0/16")
+			allocator := &mapAllocator{*subpool, make(map[string]net.IP)}
+			ip := subpool.IP
+			for i := 0; i < fill; i++ {
+				allocator.assigned[ip.String()] = ip
+				ip = nextIP(ip)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				allocator.free(allocator.assign())
+			}
+		})
+	}
+}
+
+func BenchmarkSequentialBitmap(b *testing.B) {
+	for _, fill := range benchmarkFill {
+		b.Run(fmt.Sprint(fill), func(b *testing.B) {
+			pool, err := NewIPAMPool(&ipam.RequestPoolRequest{Pool: "10.0.0.0/16"})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < fill; i++ {
+				pool.AssignIP(nil, nil)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.FreeIP(pool.AssignIP(nil, nil))
+			}
+		})
+	}
+}
+
+// Sequential allocation in a /64, which tracks the assigned ranges.
+func BenchmarkSequentialSparse(b *testing.B) {
+	for _, fill := range benchmarkFill {
+		b.Run(fmt.Sprint(fill), func(b *testing.B) {
+			pool, err := NewIPAMPool(&ipam.RequestPoolRequest{
+				Pool:    "fd00::/64",
+				Options: map[string]string{PoolOptionAddressAllocation: AllocationSequential},
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < fill; i++ {
+				pool.AssignIP(nil, nil)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.FreeIP(pool.AssignIP(nil, nil))
+			}
+		})
+	}
+}
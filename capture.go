@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+)
+
+// pcap file format constants
+const (
+	pcapMagic        uint32 = 0xa1b2c3d4
+	pcapVersionMajor uint16 = 2
+	pcapVersionMinor uint16 = 4
+	pcapSnapLen      uint32 = 65535
+	pcapLinkTypeEth  uint32 = 1
+)
+
+// Writes ethernet frames in libpcap format
+type pcapWriter struct {
+	w io.Writer
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	header := []interface{}{
+		pcapMagic,
+		pcapVersionMajor,
+		pcapVersionMinor,
+		int32(0),  // GMT offset
+		uint32(0), // timestamp accuracy
+		pcapSnapLen,
+		pcapLinkTypeEth,
+	}
+	for _, field := range header {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+func (this *pcapWriter) WritePacket(t time.Time, frame []byte) error {
+	record := []uint32{
+		uint32(t.Unix()),
+		uint32(t.Nanosecond() / 1000),
+		uint32(len(frame)),
+		uint32(len(frame)),
+	}
+	if err := binary.Write(this.w, binary.LittleEndian, record); err != nil {
+		return err
+	}
+	_, err := this.w.Write(frame)
+	return err
+}
+
+// captureNetwork connects a vde_plug to the switch at sockDir and writes all
+// frames it receives to output in pcap format until interrupted. A switch only
+// floods broadcast and unknown traffic to a new port, so if hub is set the
+// switch is put in hub mode via its management socket for the duration of the
+// capture.
+func captureNetwork(sockDir string, mgmtSock string, output io.Writer, hub bool) error {
+	if hub {
+		mgmt, err := DialVDEManagement(mgmtSock)
+		if err != nil {
+			return errors.New(fmt.Sprintln("Could not connect to switch management socket:", err))
+		}
+		defer mgmt.Close()
+		if _, err := mgmt.Command("port/sethub 1"); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := mgmt.Command("port/sethub 0"); err != nil {
+				log.Errorln("Could not switch vde_switch back from hub mode:", err)
+			}
+		}()
+	}
+
+	// vde_plug writes received frames to stdout, each prefixed with its
+	// length as a 16-bit big-endian integer. It exits when stdin is closed.
+	cmd := fsutil.LoggedCommand("vde_plug", sockDir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.New(fmt.Sprintln("Error starting vde_plug:", err))
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		<-sigCh
+		stdin.Close()
+		cmd.Process.Kill()
+	}()
+
+	writer, err := newPcapWriter(output)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	reader := bufio.NewReader(stdout)
+	lenBuf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(reader, lenBuf); err != nil {
+			break
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			break
+		}
+		if err := writer.WritePacket(time.Now(), frame); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	cmd.Wait()
+	return nil
+}
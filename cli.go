@@ -0,0 +1,374 @@
+// cli implements client subcommands which inspect and manage a running plugin
+// daemon through its admin socket.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Length IDs are shortened to in tables, matching the docker CLI
+const shortIdLength = 12
+
+// clientCommands holds the parsed arguments of the client subcommands
+type clientCommands struct {
+	jsonOutput *bool
+
+	networks *kingpin.CmdClause
+
+	endpoints        *kingpin.CmdClause
+	endpointsNetwork *string
+
+	ipamPools       *kingpin.CmdClause
+	ipamInspect     *kingpin.CmdClause
+	ipamInspectPool *string
+
+	options *kingpin.CmdClause
+
+	switchConsole        *kingpin.CmdClause
+	switchConsoleNetwork *string
+	switchRestart        *kingpin.CmdClause
+	switchRestartNetwork *string
+
+	capture        *kingpin.CmdClause
+	captureNetwork *string
+	captureOutput  *string
+	captureHub     *bool
+
+	gc       *kingpin.CmdClause
+	gcDryRun *bool
+
+	cleanup         *kingpin.CmdClause
+	cleanupNetwork  *string
+	cleanupEndpoint *string
+
+	link         *kingpin.CmdClause
+	linkState    *string
+	linkNetwork  *string
+	linkEndpoint *string
+
+	scenarioRun      *kingpin.CmdClause
+	scenarioRunFile  *string
+	scenarioStop     *kingpin.CmdClause
+	scenarioStopName *string
+	scenarioList     *kingpin.CmdClause
+}
+
+// registerClientCommands adds the client subcommands to the kingpin
+// application.
+func registerClientCommands() *clientCommands {
+	this := &clientCommands{}
+
+	this.jsonOutput = kingpin.Flag("json", "Print client command output as JSON instead of tables.").Bool()
+
+	this.networks = kingpin.Command("networks", "List networks managed by the plugin.")
+
+	this.endpoints = kingpin.Command("endpoints", "List the endpoints of a network.")
+	this.endpointsNetwork = this.endpoints.Arg("network", "Network name or ID.").Required().String()
+
+	ipam := kingpin.Command("ipam", "Inspect the IPAM driver.")
+	this.ipamPools = ipam.Command("pools", "List IPAM pools and their allocations.")
+	this.ipamInspect = ipam.Command("inspect", "List the addresses assigned out of an IPAM pool and who holds them.")
+	this.ipamInspectPool = this.ipamInspect.Arg("pool", "Pool ID or unique prefix of it.").Required().String()
+
+	this.options = kingpin.Command("options", "List the driver options accepted for networks and endpoints.")
+
+	switchCmd := kingpin.Command("switch", "Manage the vde_switch of a network.")
+	this.switchConsole = switchCmd.Command("console", "Attach to the management console of a network's vde_switch.")
+	this.switchConsoleNetwork = this.switchConsole.Arg("network", "Network name or ID.").Required().String()
+	this.switchRestart = switchCmd.Command("restart", "Restart a network's vde_switch and re-plug its endpoints.")
+	this.switchRestartNetwork = this.switchRestart.Arg("network", "Network name or ID.").Required().String()
+
+	this.capture = kingpin.Command("capture", "Capture the traffic of a network in pcap format.")
+	this.captureNetwork = this.capture.Arg("network", "Network name or ID.").Required().String()
+	this.captureOutput = this.capture.Flag("output", "File to write the capture to. - for stdout.").Short('w').Default("-").String()
+	this.captureHub = this.capture.Flag("hub", "Put the switch in hub mode while capturing to see unicast traffic between endpoints.").Bool()
+
+	this.gc = kingpin.Command("gc", "Remove sockets, tap devices and endpoints which are no longer in use.")
+	this.gcDryRun = this.gc.Flag("dry-run", "Only report what would be removed.").Bool()
+
+	this.cleanup = kingpin.Command("cleanup", "Forcibly remove an endpoint and its host resources.")
+	this.cleanupNetwork = this.cleanup.Arg("network", "Network name or ID.").Required().String()
+	this.cleanupEndpoint = this.cleanup.Arg("endpoint", "Container name or endpoint ID.").Required().String()
+
+	this.link = kingpin.Command("link", "Bring the link of a network or endpoint up or down.")
+	this.linkState = this.link.Arg("state", "up or down").Required().Enum(LinkStateUp, LinkStateDown)
+	this.linkNetwork = this.link.Arg("network", "Network name or ID.").Required().String()
+	this.linkEndpoint = this.link.Arg("endpoint", "Container name or endpoint ID. The whole network if omitted.").String()
+
+	scenario := kingpin.Command("scenario", "Manage fault-injection scenarios.")
+	this.scenarioRun = scenario.Command("run", "Start a scenario.")
+	this.scenarioRunFile = this.scenarioRun.Arg("file", "Scenario file. - for stdin.").Required().String()
+	this.scenarioStop = scenario.Command("stop", "Stop a running scenario.")
+	this.scenarioStopName = this.scenarioStop.Arg("name", "Scenario name.").Required().String()
+	this.scenarioList = scenario.Command("list", "List scenarios.")
+
+	return this
+}
+
+// Run executes the selected client command against the admin socket.
+func (this *clientCommands) Run(command string, adminSocket string) error {
+	if adminSocket == "" {
+		return errors.New("An admin socket path is required for client commands")
+	}
+	client, err := NewAdminClient(adminSocket)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case this.networks.FullCommand():
+		networks, err := client.ListNetworks("")
+		if err != nil {
+			return err
+		}
+		return this.output(networks, func(w io.Writer) {
+			fmt.Fprintln(w, "NETWORK ID\tSWITCH\tPID\tLINK\tENDPOINTS\tPOOLS\tSOCKET DIR")
+			for _, n := range networks {
+				pools := []string{}
+				for _, p := range n.Pools {
+					pools = append(pools, p.Pool)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", shortId(n.NetworkID), switchState(n),
+					pidString(n.SwitchPID), n.LinkState, len(n.Endpoints), strings.Join(pools, ","), n.SocketDir)
+			}
+		})
+
+	case this.endpoints.FullCommand():
+		network, err := this.inspectNetwork(client, *this.endpointsNetwork)
+		if err != nil {
+			return err
+		}
+		return this.output(network.Endpoints, func(w io.Writer) {
+			fmt.Fprintln(w, "ENDPOINT ID\tTAP\tPID\tMAC ADDRESS\tIPV4\tIPV6\tLINK\tIMPAIRMENT")
+			for _, e := range network.Endpoints {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", shortId(e.EndpointID), e.TapDevice,
+					pidString(e.PlugPID), e.MacAddress, e.Address, e.AddressIPv6, e.LinkState, e.Impairment.String())
+			}
+		})
+
+	case this.ipamPools.FullCommand():
+		pools, err := client.ListPools()
+		if err != nil {
+			return err
+		}
+		return this.output(pools, func(w io.Writer) {
+			fmt.Fprintln(w, "POOL ID\tADDRESS SPACE\tPOOL\tSUB POOL\tGATEWAY\tNETWORK ID\tALLOCATED\tFREE\tUTILISATION")
+			for _, p := range pools {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%.0f\t%.1f%%\n", p.PoolID, p.AddressSpace, p.Pool, p.SubPool,
+					p.Gateway, shortId(p.NetworkID), p.Used, p.Free, p.Utilisation)
+			}
+		})
+
+	case this.ipamInspect.FullCommand():
+		pool, err := client.InspectPool(*this.ipamInspectPool)
+		if err != nil {
+			return err
+		}
+		return this.output(pool, func(w io.Writer) {
+			fmt.Fprintln(w, "ADDRESS\tMAC ADDRESS\tASSIGNED\tNETWORK ID\tENDPOINT ID")
+			for _, a := range pool.Assignments {
+				assigned := ""
+				if a.AssignedAt != nil {
+					assigned = a.AssignedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.Address, a.MacAddress, assigned,
+					shortId(a.NetworkID), shortId(a.EndpointID))
+			}
+		})
+
+	case this.options.FullCommand():
+		options, err := client.ListOptions()
+		if err != nil {
+			return err
+		}
+		return this.output(options, func(w io.Writer) {
+			fmt.Fprintln(w, "SCOPE\tOPTION\tTYPE\tDESCRIPTION")
+			for _, o := range options.NetworkOptions {
+				fmt.Fprintf(w, "network\t%s\t%s\t%s\n", o.Name, optionTypeString(o), o.Description)
+			}
+			for _, o := range options.EndpointOptions {
+				fmt.Fprintf(w, "endpoint\t%s\t%s\t%s\n", o.Name, optionTypeString(o), o.Description)
+			}
+			for _, o := range options.PoolOptions {
+				fmt.Fprintf(w, "ipam\t%s\t%s\t%s\n", o.Name, optionTypeString(o), o.Description)
+			}
+		})
+
+	case this.switchConsole.FullCommand():
+		network, err := this.inspectNetwork(client, *this.switchConsoleNetwork)
+		if err != nil {
+			return err
+		}
+		return switchConsole(network.ManagementSocket)
+
+	case this.switchRestart.FullCommand():
+		return client.RestartSwitch(*this.switchRestartNetwork)
+
+	case this.capture.FullCommand():
+		network, err := this.inspectNetwork(client, *this.captureNetwork)
+		if err != nil {
+			return err
+		}
+		output := os.Stdout
+		if *this.captureOutput != "-" {
+			output, err = os.Create(*this.captureOutput)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+		}
+		return captureNetwork(network.SocketDir, network.ManagementSocket, output, *this.captureHub)
+
+	case this.gc.FullCommand():
+		result, err := client.GarbageCollect(*this.gcDryRun)
+		if err != nil {
+			return err
+		}
+		return this.output(result, func(w io.Writer) {
+			fmt.Fprintln(w, "TYPE\tRESOURCE")
+			for _, s := range result.Sockets {
+				fmt.Fprintf(w, "socket\t%s\n", s)
+			}
+			for _, t := range result.TapDevices {
+				fmt.Fprintf(w, "tap\t%s\n", t)
+			}
+			for _, e := range result.Endpoints {
+				fmt.Fprintf(w, "endpoint\t%s\n", e)
+			}
+		})
+
+	case this.cleanup.FullCommand():
+		return client.ForceDeleteEndpoint(*this.cleanupNetwork, *this.cleanupEndpoint)
+
+	case this.link.FullCommand():
+		return client.SetLinkState(*this.linkNetwork, *this.linkEndpoint, *this.linkState)
+
+	case this.scenarioRun.FullCommand():
+		var data []byte
+		if *this.scenarioRunFile == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(*this.scenarioRunFile)
+		}
+		if err != nil {
+			return err
+		}
+		name, err := client.RunScenario(string(data))
+		if err != nil {
+			return err
+		}
+		fmt.Println(name)
+		return nil
+
+	case this.scenarioStop.FullCommand():
+		return client.StopScenario(*this.scenarioStopName)
+
+	case this.scenarioList.FullCommand():
+		scenarios, err := client.ListScenarios()
+		if err != nil {
+			return err
+		}
+		return this.output(scenarios, func(w io.Writer) {
+			fmt.Fprintln(w, "NAME\tRUNNING\tSTARTED\tSTEPS RUN")
+			for _, s := range scenarios {
+				fmt.Fprintf(w, "%s\t%t\t%s\t%d\n", s.Name, s.Running, s.Started.Format("2006-01-02 15:04:05"), len(s.Log))
+			}
+		})
+	}
+
+	return errors.New(fmt.Sprintln("Unknown command:", command))
+}
+
+// Look up a single network by name or ID
+func (this *clientCommands) inspectNetwork(client *AdminClient, network string) (*AdminNetworkInfo, error) {
+	networks, err := client.ListNetworks(network)
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) != 1 {
+		return nil, errors.New(fmt.Sprintln("Network not found:", network))
+	}
+	return &networks[0], nil
+}
+
+// Print v as JSON if requested, otherwise render a table.
+func (this *clientCommands) output(v interface{}, table func(w io.Writer)) error {
+	if *this.jsonOutput {
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(b))
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// switchConsole connects stdin and stdout to a vde_switch management socket
+// until either side closes.
+func switchConsole(mgmtSock string) error {
+	conn, err := net.Dial("unix", mgmtSock)
+	if err != nil {
+		return errors.New(fmt.Sprintln("Could not connect to switch management socket:", err))
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+func shortId(id string) string {
+	if len(id) > shortIdLength {
+		return id[:shortIdLength]
+	}
+	return id
+}
+
+func pidString(pid int) string {
+	if pid == 0 {
+		return "-"
+	}
+	return strconv.Itoa(pid)
+}
+
+func switchState(network AdminNetworkInfo) string {
+	switch {
+	case !network.Managed:
+		return "external"
+	case network.Running:
+		return "running"
+	default:
+		return "exited"
+	}
+}
+
+// Option type with its range or accepted values
+func optionTypeString(option OptionSpec) string {
+	switch option.Type {
+	case OptionTypeInt:
+		return fmt.Sprintf("int %d-%d", option.Min, option.Max)
+	case OptionTypeEnum:
+		return strings.Join(option.Values, "|")
+	default:
+		return option.Type
+	}
+}
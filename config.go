@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Longest interface name the kernel accepts
+const maxInterfaceNameLength = 15
+
+// Config is the plugin configuration file. It declares switches the plugin
+// runs independently of docker, e.g. for VMs to attach to. Docker networks
+// can use them by passing the switch name as socket_dir.
+type Config struct {
+	Switches map[string]*SwitchConfig `yaml:"switches"`
+}
+
+// SwitchConfig describes a predefined vde_switch
+type SwitchConfig struct {
+	// Defaults to the switch name under the socket root
+	SocketDir string `yaml:"socket_dir"`
+	// Defaults to the socket dir with the management socket suffix
+	ManagementSocket string `yaml:"management_socket"`
+	Group            string `yaml:"group"`
+	// Octal permissions of the sockets, e.g. "0660"
+	Mode  string       `yaml:"mode"`
+	Ports int          `yaml:"ports"`
+	Hub   bool         `yaml:"hub"`
+	VLANs []VLANConfig `yaml:"vlans"`
+	// Connections to other switches
+	Cables []CableConfig `yaml:"cables"`
+	// Tap devices on the host connected to the switch
+	Uplinks []UplinkConfig `yaml:"uplinks"`
+}
+
+// VLANConfig assigns switch ports to a VLAN
+type VLANConfig struct {
+	ID       int   `yaml:"id"`
+	Untagged []int `yaml:"untagged"`
+	Tagged   []int `yaml:"tagged"`
+}
+
+// All ports assigned to the VLAN
+func (this VLANConfig) ports() []int {
+	ports := make([]int, 0, len(this.Untagged)+len(this.Tagged))
+	ports = append(ports, this.Untagged...)
+	return append(ports, this.Tagged...)
+}
+
+// CableConfig connects the switch to another switch
+type CableConfig struct {
+	// Name of a configured switch or path of a switch socket directory
+	To string `yaml:"to"`
+	// Ports to use on either end. 0 for any.
+	Port   int `yaml:"port"`
+	ToPort int `yaml:"to_port"`
+}
+
+// UplinkConfig creates a tap device on the host connected to the switch
+type UplinkConfig struct {
+	Tap string `yaml:"tap"`
+	// CIDR addresses to assign to the tap device
+	Addresses []string `yaml:"addresses"`
+}
+
+// LoadConfig reads, validates and fills in defaults of a configuration file.
+func LoadConfig(path string, socketRoot string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, errors.New(fmt.Sprintln("Could not parse config file:", err))
+	}
+	if config.Switches == nil {
+		config.Switches = make(map[string]*SwitchConfig)
+	}
+
+	for name, sw := range config.Switches {
+		if err := sw.validate(name, socketRoot); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid switch %s: %v", name, err))
+		}
+	}
+	// Cables can only be checked once every switch has its socket dir
+	for name, sw := range config.Switches {
+		for i := range sw.Cables {
+			cable := &sw.Cables[i]
+			if target, found := config.Switches[cable.To]; found {
+				cable.To = target.SocketDir
+			} else if !filepath.IsAbs(cable.To) {
+				return nil, errors.New(fmt.Sprintf("Invalid switch %s: cable to unknown switch %s", name, cable.To))
+			}
+		}
+	}
+	return config, nil
+}
+
+func (this *SwitchConfig) validate(name string, socketRoot string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("switch names must be non-empty and not contain /")
+	}
+	if this == nil {
+		return errors.New("switch has no configuration")
+	}
+
+	if this.SocketDir == "" {
+		this.SocketDir = filepath.Join(socketRoot, name)
+	}
+	if this.ManagementSocket == "" {
+		this.ManagementSocket = this.SocketDir + managementSocketSuffix
+	}
+	if this.Ports == 0 {
+		this.Ports = int(NetworkDefaultNumSwitchports)
+	}
+	if this.Ports < 0 {
+		return errors.New("ports must be positive")
+	}
+
+	for _, vlan := range this.VLANs {
+		if vlan.ID < 1 || vlan.ID > 4094 {
+			return errors.New(fmt.Sprintf("VLAN ID %d out of range", vlan.ID))
+		}
+		for _, port := range vlan.ports() {
+			if port < 1 || port > this.Ports {
+				return errors.New(fmt.Sprintf("VLAN %d port %d out of range", vlan.ID, port))
+			}
+		}
+	}
+	for _, cable := range this.Cables {
+		if cable.To == "" {
+			return errors.New("cables must have a destination")
+		}
+	}
+	for _, uplink := range this.Uplinks {
+		if uplink.Tap == "" || len(uplink.Tap) > maxInterfaceNameLength {
+			return errors.New(fmt.Sprintf("uplink tap name must be 1 to %d characters", maxInterfaceNameLength))
+		}
+		for _, address := range uplink.Addresses {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				return errors.New(fmt.Sprintf("uplink %s: %v", uplink.Tap, err))
+			}
+		}
+	}
+	return nil
+}
+
+// Command line arguments for vde_switch
+func (this *SwitchConfig) switchArgs() []string {
+	args := []string{
+		"--sock", this.SocketDir,
+		"--mgmt", this.ManagementSocket,
+		"--numports", fmt.Sprintf("%v", this.Ports),
+	}
+	if this.Group != "" {
+		args = append(args, "--group", this.Group)
+	}
+	if this.Mode != "" {
+		args = append(args, "--mode", this.Mode)
+	}
+	if this.Hub {
+		args = append(args, "--hub")
+	}
+	return args
+}
+
+// Management commands which apply the VLAN configuration
+func (this *SwitchConfig) vlanCommands() []string {
+	commands := []string{}
+	for _, vlan := range this.VLANs {
+		commands = append(commands, fmt.Sprintf("vlan/create %d", vlan.ID))
+		for _, port := range vlan.Untagged {
+			commands = append(commands, fmt.Sprintf("port/setvlan %d %d", port, vlan.ID))
+		}
+		for _, port := range vlan.Tagged {
+			commands = append(commands, fmt.Sprintf("vlan/addport %d %d", vlan.ID, port))
+		}
+	}
+	return commands
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/multihttp"
+)
+
+// DockerResolver looks up docker network and container names through the
+// docker API, so users can refer to networks and endpoints the same way they
+// do with the docker CLI. The driver itself only ever sees IDs.
+type DockerResolver struct {
+	client *http.Client
+}
+
+// Subset of the docker network inspect response we need
+type dockerNetworkResource struct {
+	Name       string
+	Id         string
+	Driver     string
+	Containers map[string]dockerEndpointResource
+}
+
+type dockerEndpointResource struct {
+	Name       string
+	EndpointID string
+}
+
+// NewDockerResolver returns a resolver querying the docker daemon at the given
+// address (e.g. unix:///var/run/docker.sock).
+func NewDockerResolver(dockerHost string) (*DockerResolver, error) {
+	client, err := multihttp.NewClient(dockerHost)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerResolver{client: client}, nil
+}
+
+func (this *DockerResolver) inspectNetwork(network string) (*dockerNetworkResource, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/networks/" + network}
+	resp, err := this.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("docker could not inspect network %s: %s", network, resp.Status))
+	}
+
+	result := &dockerNetworkResource{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ResolveNetwork returns the network ID of a docker network name or ID. If
+// docker can't resolve it, the input is returned unchanged so the driver can
+// try to match it as an ID prefix.
+func (this *DockerResolver) ResolveNetwork(network string) string {
+	if this == nil || network == "" {
+		return network
+	}
+
+	result, err := this.inspectNetwork(network)
+	if err != nil {
+		log.With("Network", network).Debugln("Could not resolve network with docker:", err)
+		return network
+	}
+	return result.Id
+}
+
+// ResolveEndpoint returns the endpoint ID of a container (by name or ID) on
+// a docker network. If docker can't resolve it, the input is returned
+// unchanged so the driver can try to match it as an endpoint ID prefix.
+func (this *DockerResolver) ResolveEndpoint(networkId string, container string) string {
+	if this == nil || container == "" {
+		return container
+	}
+
+	result, err := this.inspectNetwork(networkId)
+	if err != nil {
+		log.With("Network", networkId).Debugln("Could not resolve network with docker:", err)
+		return container
+	}
+
+	for containerId, endpoint := range result.Containers {
+		if endpoint.Name == container || strings.TrimPrefix(endpoint.Name, "/") == container ||
+			strings.HasPrefix(containerId, container) {
+			return endpoint.EndpointID
+		}
+	}
+	return container
+}
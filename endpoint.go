@@ -1,23 +1,39 @@
 package main
 
 import (
+	"context"
 	"os/exec"
 
 	"github.com/wrouesnel/go.log"
 
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/wrouesnel/docker-vde-plugin/fsutil"
 )
 
+// Administrative link states of an endpoint or network
+const (
+	LinkStateUp   string = "up"
+	LinkStateDown string = "down"
+)
+
 type VDENetworkEndpoints map[string]*VDENetworkEndpoint
 
 type VDENetworkEndpoint struct {
 	// vde_plug2tap cmd. nil if no container has actually attached yet.
 	tapPlugCmd *exec.Cmd
 	tapCmdPipe io.WriteCloser
+	// Channel for vde_plug2tap Wait() call
+	tapPlugCh <-chan error
+	// Set while the plugin is stopping vde_plug2tap. Accessed atomically.
+	tapStopping int32
 	// IPv4 address if assigned
 	address    net.IP
 	addressNet net.IPNet
@@ -31,6 +47,17 @@ type VDENetworkEndpoint struct {
 	gateway6 net.IP
 	// Current tap device. Empty means no tap currently instantiated.
 	tapDevName string
+	// Network namespace path of the container the endpoint joined.
+	sandboxKey string
+	// Administratively disabled link ("unplugged cable")
+	linkDown bool
+	// Currently applied netem impairment. nil if none.
+	impairment *Impairment
+	// Fingerprint of the CreateEndpoint request, to recognize retries
+	createRequest string
+	// Protects the endpoint for operations holding only the network read
+	// lock. Not needed while holding the network write lock.
+	mtx sync.Mutex
 }
 
 // Hard terminate the tap command feeding data to the tap interface, if it's
@@ -46,23 +73,190 @@ func (this *VDENetworkEndpoint) KillTapCmd() {
 	}
 
 	// Kill and collect status
+	atomic.StoreInt32(&this.tapStopping, 1)
 	this.tapPlugCmd.Process.Kill()
-	this.tapPlugCmd.Wait()
+	<- this.tapPlugCh
 	this.tapPlugCmd = nil
+	this.tapPlugCh = nil
 }
 
-func (this *VDENetworkEndpoint) DeleteTapDevice() {
+// Start vde_plug2tap with the given command line and supervise it.
+func (this *VDENetworkEndpoint) startTapCmd(cmdLine ...string) error {
+	atomic.StoreInt32(&this.tapStopping, 0)
+	cmd, cmdPipe, _, err := startChildProcess(cmdLine[0], cmdLine[1:]...)
+	if err != nil {
+		log.Errorln("Error starting vde_plug2tap:", err)
+		metricErrors.Inc(errorPlugStart)
+		return errors.New(fmt.Sprint("Error starting vde_plug2tap for endpoint tap adaptor: ", err))
+	}
+	metricProcessStarts.Inc(processPlug)
+
+	// Collect the exit status as soon as the plug exits so it doesn't linger
+	// as a zombie.
+	cmdErrCh := make(chan error, 1)
+	tapDevName := this.tapDevName
+	go func() {
+		err := cmd.Wait()
+		log.With("TapDevice", tapDevName).Debugln("vde_plug2tap process has exited:", err)
+		expected := atomic.LoadInt32(&this.tapStopping) == 1
+		metricProcessExits.Inc(processPlug, strconv.FormatBool(expected))
+		cmdErrCh <- err
+		close(cmdErrCh)
+	}()
+
+	this.tapPlugCmd = cmd
+	this.tapCmdPipe = cmdPipe
+	this.tapPlugCh = cmdErrCh
+	return nil
+}
+
+// Supervise an already running vde_plug2tap left behind by a previous
+// instance of the plugin.
+func (this *VDENetworkEndpoint) adoptTapCmd(pid int) {
+	atomic.StoreInt32(&this.tapStopping, 0)
+	tapDevName := this.tapDevName
+	this.tapPlugCmd, this.tapPlugCh = adoptProcess(pid, func() {
+		log.With("TapDevice", tapDevName).Debugln("vde_plug2tap process has exited")
+		expected := atomic.LoadInt32(&this.tapStopping) == 1
+		metricProcessExits.Inc(processPlug, strconv.FormatBool(expected))
+	})
+}
+
+func (this *VDENetworkEndpoint) DeleteTapDevice(ctx context.Context) {
 	if this.tapDevName == "" {
 		return
 	}
-	err := fsutil.CheckExec("ip", "link", "delete", "dev", this.tapDevName)
+	err := fsutil.CheckExec(ctx, "ip", "link", "delete", "dev", this.tapDevName)
 	// Remove the interface
 	if err != nil {
-		log.Errorln("Error removing tap device:", this.tapDevName)
+		log.Errorln("Error removing tap device:", err)
 	}
 	this.tapDevName = ""
 }
 
+// Apply a link state to a running endpoint. A downed link pauses the
+// vde_plug2tap process so no frames pass, and drops the carrier on the tap
+// device so the container sees the cable as unplugged.
+func (this *VDENetworkEndpoint) applyLinkState(ctx context.Context, down bool) error {
+	if this.tapPlugCmd == nil {
+		// Not joined yet - the state is applied on Join.
+		return nil
+	}
+
+	if down {
+		if err := this.tapPlugCmd.Process.Signal(syscall.SIGSTOP); err != nil {
+			return errors.New(fmt.Sprintln("Error pausing vde_plug2tap:", err))
+		}
+		return this.setCarrier(ctx, false)
+	}
+
+	if err := this.setCarrier(ctx, true); err != nil {
+		return err
+	}
+	if err := this.tapPlugCmd.Process.Signal(syscall.SIGCONT); err != nil {
+		return errors.New(fmt.Sprintln("Error resuming vde_plug2tap:", err))
+	}
+	return nil
+}
+
+// Find the endpoint's link. After Join docker moves the tap into the
+// container namespace and renames it, so it is looked up by MAC address in
+// the sandbox. Returns the command prefix needed to run commands in the
+// namespace of the link, and the name of the link. Falls back to the tap device
+// in the host namespace if the device has not been moved yet. Looking in the
+// sandbox needs nsenter, which is only required once a feature uses it.
+func (this *VDENetworkEndpoint) findLink(ctx context.Context) ([]string, string, error) {
+	if this.sandboxKey != "" {
+		if err := requireCommand("nsenter", "Reaching links in container namespaces"); err != nil {
+			return nil, "", err
+		}
+		nsenter := []string{"nsenter", "--net=" + this.sandboxKey}
+		stdout, _, err := fsutil.CheckExecWithOutput(ctx, nsenter[0], append(nsenter[1:], "ip", "-o", "link", "show")...)
+		if err == nil {
+			if ifName := findLinkByMAC(stdout, this.macAddress); ifName != "" {
+				return nsenter, ifName, nil
+			}
+		}
+	}
+	return []string{}, this.tapDevName, nil
+}
+
+// Set the carrier state of the tap device.
+func (this *VDENetworkEndpoint) setCarrier(ctx context.Context, up bool) error {
+	carrier := "off"
+	if up {
+		carrier = "on"
+	}
+
+	cmdLine, ifName, err := this.findLink(ctx)
+	if err != nil {
+		return err
+	}
+	cmdLine = append(cmdLine, "ip", "link", "set", "dev", ifName, "carrier", carrier)
+	if err := fsutil.CheckExec(ctx, cmdLine[0], cmdLine[1:]...); err != nil {
+		return errors.New(fmt.Sprint("Error setting carrier state of tap device: ", err))
+	}
+	return nil
+}
+
+// Apply network impairments to the endpoint link with netem. A nil impairment
+// removes any existing impairment.
+func (this *VDENetworkEndpoint) setImpairment(ctx context.Context, impairment *Impairment) error {
+	if impairment == nil && this.impairment == nil {
+		return nil
+	}
+	if this.tapDevName == "" {
+		return errors.New("Endpoint has not joined a container")
+	}
+	if err := requireCommand("tc", "Impairing endpoints"); err != nil {
+		return err
+	}
+
+	cmdLine, ifName, err := this.findLink(ctx)
+	if err != nil {
+		return err
+	}
+	if impairment == nil {
+		cmdLine = append(cmdLine, "tc", "qdisc", "del", "dev", ifName, "root")
+	} else {
+		cmdLine = append(cmdLine, "tc", "qdisc", "replace", "dev", ifName, "root", "netem")
+		cmdLine = append(cmdLine, impairment.netemArgs()...)
+	}
+
+	if err := fsutil.CheckExec(ctx, cmdLine[0], cmdLine[1:]...); err != nil {
+		return errors.New(fmt.Sprint("Error setting netem impairment on endpoint: ", err))
+	}
+	this.impairment = impairment
+	return nil
+}
+
+// Restart the vde_plug2tap process connecting the tap device to the switch.
+// Used when the switch has been restarted. Since the tap device may already
+// have been moved into the container, the plug is started in the namespace of
+// the link.
+func (this *VDENetworkEndpoint) replug(ctx context.Context, sockDir string) error {
+	this.KillTapCmd()
+
+	cmdLine, ifName, err := this.findLink(ctx)
+	if err != nil {
+		return err
+	}
+	cmdLine = append(cmdLine, "vde_plug2tap", "--sock", sockDir, ifName)
+	if err := this.startTapCmd(cmdLine...); err != nil {
+		return err
+	}
+	metricProcessRestarts.Inc(processPlug)
+	return nil
+}
+
+// Returns the link state string for the endpoint
+func (this *VDENetworkEndpoint) GetLinkState() string {
+	if this.linkDown {
+		return LinkStateDown
+	}
+	return LinkStateUp
+}
+
 func (this *VDENetworkEndpoint) GetIPv4Gateway() string {
 	if this.gateway == nil {
 		return ""
@@ -111,3 +305,50 @@ func (this *VDENetworkEndpoint) GetIPv6CIDRAddress() string {
 func (this *VDENetworkEndpoint) GetMACAddress() string {
 	return this.macAddress.String()
 }
+
+// Kill the plug and delete the tap device wherever it currently is. Used to
+// forcibly clean up endpoints docker has lost track of.
+func (this *VDENetworkEndpoint) forceCleanup(ctx context.Context) error {
+	this.KillTapCmd()
+	if this.tapDevName == "" {
+		return nil
+	}
+
+	cmdLine, ifName, err := this.findLink(ctx)
+	if err != nil {
+		return err
+	}
+	cmdLine = append(cmdLine, "ip", "link", "delete", "dev", ifName)
+	if err := fsutil.CheckExec(ctx, cmdLine[0], cmdLine[1:]...); err != nil {
+		return errors.New(fmt.Sprint("Error removing tap device: ", err))
+	}
+	this.tapDevName = ""
+	return nil
+}
+
+// Returns a snapshot of the endpoint state for the admin API. Caller must
+// hold the network lock.
+func (this *VDENetworkEndpoint) info(endpointId string, networkLinkDown bool) AdminEndpointInfo {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	info := AdminEndpointInfo{
+		EndpointID:  endpointId,
+		TapDevice:   this.tapDevName,
+		SandboxKey:  this.sandboxKey,
+		MacAddress:  this.GetMACAddress(),
+		Address:     this.GetIPv4CIDRAddress(),
+		AddressIPv6: this.GetIPv6CIDRAddress(),
+		Gateway:     this.GetIPv4Gateway(),
+		GatewayIPv6: this.GetIPv6Gateway(),
+		LinkState:   this.GetLinkState(),
+		Impairment:  this.impairment,
+	}
+	if networkLinkDown {
+		info.LinkState = LinkStateDown
+	}
+	if this.tapPlugCmd != nil {
+		info.PlugPID = this.tapPlugCmd.Process.Pid
+	}
+	return info
+}
@@ -2,30 +2,20 @@ package fsutil
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	. "github.com/wrouesnel/docker-vde-plugin/logutil"
 	"github.com/kardianos/osext"
 	"github.com/wrouesnel/go.log"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 )
 
-// If the program dies, we need to shutdown gracefully. This channel is
-// closed by the signal handler when we need to do a panic and die in the
-// main go-routine (which triggers our deferred handlers).
-// Every function here should react to this sensibly.
-var interruptCh = make(chan interface{})
-
-// Calling this closes the interrupt channel, causes all executing processes to
-// die (with a panic). This let's deferred clean up handlers run in the owning
-// goroutine.
-func Interrupt() {
-	if interruptCh != nil {
-		close(interruptCh)
-		interruptCh = nil
-	}
-}
-
 // Exit Panicly if paths do not exist as command executables
 func MustLookupPaths(paths ...string) {
 	for _, path := range paths {
@@ -73,6 +63,22 @@ func PathNotExist(path string) bool {
 	return false
 }
 
+// Like os.MkdirAll, but also returns the topmost directory which had to be
+// created, or "" if path already existed.
+func MkdirAllCreated(path string, perm os.FileMode) (string, error) {
+	created := ""
+	for dir := filepath.Clean(path); !PathExists(dir); dir = filepath.Dir(dir) {
+		created = dir
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if err := os.MkdirAll(path, perm); err != nil {
+		return "", err
+	}
+	return created, nil
+}
+
 func PathIsDir(path string) bool {
 	st, err := os.Stat(path)
 	if os.IsNotExist(err) {
@@ -90,10 +96,54 @@ func PathIsSocket(path string) bool {
 	return st.Mode()&os.ModeSocket != 0
 }
 
-// Check for successful execution and return stdout and stderr as strings
-func CheckExecWithOutput(command string, commandLine ...string) (string, string, error) {
+// ExecError describes a command which could not be run or did not exit
+// successfully.
+type ExecError struct {
+	// Command line which was run
+	CommandLine []string
+	// Exit code of the command. -1 if it never ran or was killed by a signal.
+	ExitCode int
+	// What the command wrote to stderr. Empty for processes started detached
+	// from the plugin, whose output is not captured.
+	Stderr string
+	// Why the command failed. The context error if it was killed because its
+	// context was done.
+	Err error
+}
+
+func (this *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %v", strings.Join(this.CommandLine, " "), this.Err)
+	if stderr := strings.TrimSpace(this.Stderr); stderr != "" {
+		msg = fmt.Sprintf("%s: %s", msg, stderr)
+	}
+	return msg
+}
+
+// NewExecError describes the failure err of the command line, filling in the
+// exit code if err is an *exec.ExitError.
+func NewExecError(commandLine []string, err error, stderr string) *ExecError {
+	exitCode := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		}
+	}
+	return &ExecError{
+		CommandLine: commandLine,
+		ExitCode:    exitCode,
+		Stderr:      stderr,
+		Err:         err,
+	}
+}
+
+// Exec runs a command to completion and returns its stdout and stderr. env
+// replaces the environment of the command if it is not nil. Output is logged
+// at debug level. The command is killed if ctx is done before it exits.
+// Failures are returned as *ExecError.
+func Exec(ctx context.Context, env []string, command string, commandLine ...string) (string, string, error) {
 	log.Debugln("Executing Command:", command, commandLine)
-	cmd := exec.Command(command, commandLine...)
+	cmd := exec.CommandContext(ctx, command, commandLine...)
+	cmd.Env = env
 
 	stdoutBuffer := new(bytes.Buffer)
 	stderrBuffer := new(bytes.Buffer)
@@ -103,60 +153,38 @@ func CheckExecWithOutput(command string, commandLine ...string) (string, string,
 	cmd.Stderr = io.MultiWriter(stderrBuffer,
 		NewLogWriter(log.With("pipe", "stderr").With("cmd", command).Debugln))
 
-	if err := cmd.Start(); err != nil {
-		return "", "", err
-	}
-
-	// Wait on a go-routine for the process to exit
-	doneCh := make(chan error)
-	go func() {
-		doneCh <- cmd.Wait()
-	}()
-
-	// Wait for process exit or global interrupt
-	select {
-	case err := <-doneCh:
-		if err != nil {
-			return "", "", err
+	if err := cmd.Run(); err != nil {
+		// Report a command killed because ctx is done as timed out or
+		// cancelled rather than by the signal which killed it.
+		if ctx.Err() != nil {
+			err = ctx.Err()
 		}
-	case <-interruptCh:
-		cmd.Process.Kill()
-		log.Panicln("Interrupted by external request.")
+		return stdoutBuffer.String(), stderrBuffer.String(),
+			NewExecError(append([]string{command}, commandLine...), err, stderrBuffer.String())
 	}
 
 	return stdoutBuffer.String(), stderrBuffer.String(), nil
 }
 
-func CheckExecWithEnv(env []string, command string, commandLine ...string) error {
-	log.Debugln("Executing Command:", command, commandLine)
-	cmd := exec.Command(command, commandLine...)
-
-	cmd.Env = env
-	cmd.Stdout = NewLogWriter(log.With("pipe", "stdout").With("cmd", command).Debugln)
-	cmd.Stderr = NewLogWriter(log.With("pipe", "stderr").With("cmd", command).Debugln)
-
-	if err := cmd.Start(); err != nil {
-		return err
+// Check for successful execution and return stdout and stderr as strings.
+func CheckExecWithOutput(ctx context.Context, command string, commandLine ...string) (string, string, error) {
+	stdout, stderr, err := Exec(ctx, nil, command, commandLine...)
+	if err != nil {
+		return "", "", err
 	}
+	return stdout, stderr, nil
+}
 
-	// Wait on a go-routine for the process to exit
-	doneCh := make(chan error)
-	go func() {
-		doneCh <- cmd.Wait()
-	}()
-
-	// Wait for process exit or global interrupt
-	select {
-	case err := <-doneCh:
-		if err != nil {
-			return err
-		}
-	case <-interruptCh:
-		cmd.Process.Kill()
-		log.Panicln("Interrupted by external request.")
-	}
+// Checks for successful execution with the given environment.
+func CheckExecWithEnv(ctx context.Context, env []string, command string, commandLine ...string) error {
+	_, _, err := Exec(ctx, env, command, commandLine...)
+	return err
+}
 
-	return nil
+// Checks for successful execution.
+func CheckExec(ctx context.Context, command string, commandLine ...string) error {
+	_, _, err := Exec(ctx, nil, command, commandLine...)
+	return err
 }
 
 // Returns a command object which logs its stdout/stderr
@@ -170,40 +198,43 @@ func LoggedCommand(command string, commandLine ...string) *exec.Cmd {
 	return cmd
 }
 
-// Checks for successful execution. Logs all output at default level.
-func CheckExec(command string, commandLine ...string) error {
-	log.Debugln("Executing Command:", command, commandLine)
-	cmd := exec.Command(command, commandLine...)
-
-	cmd.Stdout = NewLogWriter(log.With("pipe", "stdout").With("cmd", command).Debugln)
-	cmd.Stderr = NewLogWriter(log.With("pipe", "stderr").With("cmd", command).Debugln)
+// Returns a command object which logs its stdout/stderr, and a function
+// returning the last of what it wrote to stderr, for reporting why a long
+// running command failed.
+func LoggedCommandWithStderr(command string, commandLine ...string) (*exec.Cmd, func() string) {
+	cmd := LoggedCommand(command, commandLine...)
+	tail := &tailBuffer{}
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, tail)
+	return cmd, tail.String
+}
 
-	if err := cmd.Start(); err != nil {
-		return err
-	}
+// Longest stderr output kept by LoggedCommandWithStderr
+const stderrTailLength = 4096
 
-	// Wait on a go-routine for the process to exit
-	doneCh := make(chan error)
-	go func() {
-		doneCh <- cmd.Wait()
-	}()
+// tailBuffer keeps the last stderrTailLength bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	mtx sync.Mutex
+}
 
-	// Wait for process exit or global interrupt
-	select {
-	case err := <-doneCh:
-		if err != nil {
-			return err
-		}
-	case <-interruptCh:
-		cmd.Process.Kill()
-		log.Panicln("Interrupted by external request.")
+func (this *tailBuffer) Write(p []byte) (int, error) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.buf = append(this.buf, p...)
+	if len(this.buf) > stderrTailLength {
+		this.buf = this.buf[len(this.buf)-stderrTailLength:]
 	}
+	return len(p), nil
+}
 
-	return nil
+func (this *tailBuffer) String() string {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return string(this.buf)
 }
 
 func MustExecWithOutput(command string, commandLine ...string) (string, string) {
-	stdout, stderr, err := CheckExecWithOutput(command, commandLine...)
+	stdout, stderr, err := CheckExecWithOutput(context.Background(), command, commandLine...)
 	if err != nil {
 		log.Panicln("Cannot continue - command failed:", command, commandLine, err)
 	}
@@ -211,7 +242,7 @@ func MustExecWithOutput(command string, commandLine ...string) (string, string)
 }
 
 func MustExecWithEnv(env []string, command string, commandLine ...string) {
-	err := CheckExecWithEnv(env, command, commandLine...)
+	err := CheckExecWithEnv(context.Background(), env, command, commandLine...)
 	if err != nil {
 		log.Panicln("Cannot continue - command failed:", command, commandLine, err)
 	}
@@ -219,7 +250,7 @@ func MustExecWithEnv(env []string, command string, commandLine ...string) {
 
 // Exit program if execution is not successful
 func MustExec(command string, commandLine ...string) {
-	err := CheckExec(command, commandLine...)
+	err := CheckExec(context.Background(), command, commandLine...)
 	if err != nil {
 		log.Panicln("Cannot continue - command failed:", command, commandLine, err)
 	}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+)
+
+// Suffix of management sockets created alongside socket directories
+const managementSocketSuffix string = ".mgmt.sock"
+
+// Tap device names given by versions of the plugin without a name index
+var legacyTapName = regexp.MustCompile("^" + InterfacePrefix + "[0-9a-f]{11}$")
+
+// GarbageCollect removes host resources no network or endpoint owns anymore:
+// socket directories and management sockets of dead switches under the
+// socket root, and plugin tap devices left in the host namespace. Endpoints
+// whose vde_plug2tap process died are reconnected. With dryRun set, nothing
+// is changed and only the findings are returned.
+func (this *VDENetworkDriver) GarbageCollect(dryRun bool) *AdminGarbageCollectResponse {
+	log := log.With("DryRun", dryRun)
+	log.Infoln("GarbageCollect request received")
+
+	resp := &AdminGarbageCollectResponse{
+		Sockets:    []string{},
+		TapDevices: []string{},
+		Endpoints:  []string{},
+	}
+
+	// Host resources are listed before the networks are looked at, so
+	// anything networks create meanwhile is known and left alone.
+	entries, err := ioutil.ReadDir(this.socketRoot)
+	if err != nil {
+		log.Errorln("Could not read socket root:", err)
+	}
+	ctx, cancel := this.requestContext()
+	stdout, _, err := fsutil.CheckExecWithOutput(ctx, "ip", "tuntap", "show")
+	cancel()
+	if err != nil {
+		log.Errorln("Could not list tap devices:", err)
+	}
+
+	knownSockets := make(map[string]bool)
+	knownTaps := make(map[string]bool)
+	for _, vdeNetwork := range this.listNetworks() {
+		vdeNetwork.mtx.Lock()
+		if vdeNetwork.removed {
+			vdeNetwork.mtx.Unlock()
+			continue
+		}
+		knownSockets[vdeNetwork.sockDir] = true
+		knownSockets[vdeNetwork.mgmtSock] = true
+		for endpointId, endpoint := range vdeNetwork.networkEndpoints {
+			if endpoint.tapDevName != "" {
+				knownTaps[endpoint.tapDevName] = true
+			}
+			if endpoint.tapPlugCmd == nil || processAlive(endpoint.tapPlugCmd.Process.Pid) {
+				continue
+			}
+			resp.Endpoints = append(resp.Endpoints, endpointId)
+			if dryRun {
+				continue
+			}
+			log.With("EndpointID", endpointId).Warnln("vde_plug2tap has exited, reconnecting endpoint")
+			ctx, cancel := this.requestContext()
+			if err := endpoint.replug(ctx, vdeNetwork.sockDir); err != nil {
+				log.With("EndpointID", endpointId).Errorln("Error reconnecting endpoint:", err)
+			}
+			cancel()
+		}
+		vdeNetwork.mtx.Unlock()
+	}
+
+	// Sockets of switches which no longer exist. Only sockets nothing is
+	// listening on are considered, so externally managed switches sharing the
+	// socket root are left alone.
+	for _, entry := range entries {
+		path := filepath.Join(this.socketRoot, entry.Name())
+		if knownSockets[path] {
+			continue
+		}
+
+		var probe string
+		if entry.IsDir() && fsutil.PathIsSocket(filepath.Join(path, "ctl")) {
+			probe = filepath.Join(path, "ctl")
+		} else if strings.HasSuffix(entry.Name(), managementSocketSuffix) && fsutil.PathIsSocket(path) {
+			probe = path
+		} else {
+			continue
+		}
+
+		if conn, err := net.Dial("unix", probe); err == nil {
+			conn.Close()
+			continue
+		}
+
+		resp.Sockets = append(resp.Sockets, path)
+		if dryRun {
+			continue
+		}
+		log.With("Path", path).Infoln("Removing stale socket")
+		if err := os.RemoveAll(path); err != nil {
+			log.With("Path", path).Errorln("Error removing stale socket:", err)
+		}
+	}
+
+	// Tap devices named by the plugin which no endpoint owns. Besides names in
+	// the index, the names older versions of the plugin gave are recognized.
+	for _, line := range strings.Split(stdout, "\n") {
+		tapDevName := strings.SplitN(line, ":", 2)[0]
+		if !this.names.IsInterface(tapDevName) && !legacyTapName.MatchString(tapDevName) {
+			continue
+		}
+		if knownTaps[tapDevName] {
+			continue
+		}
+
+		resp.TapDevices = append(resp.TapDevices, tapDevName)
+		if dryRun {
+			continue
+		}
+		log.With("TapDevice", tapDevName).Infoln("Removing stale tap device")
+		ctx, cancel := this.requestContext()
+		err := fsutil.CheckExec(ctx, "ip", "link", "delete", "dev", tapDevName)
+		cancel()
+		if err != nil {
+			log.With("TapDevice", tapDevName).Errorln("Error removing stale tap device:", err)
+			continue
+		}
+		this.names.ReleaseInterfaceName(tapDevName)
+	}
+
+	return resp
+}
+
+// Check if a process is running. Exited but unreaped child processes count as
+// not running.
+func processAlive(pid int) bool {
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name, which may itself
+	// contain spaces or parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+// Returns the pid of a running process with exactly the given command line, or
+// 0 if there is none.
+func findProcess(command string, args ...string) int {
+	want := strings.Join(append([]string{command}, args...), "\x00") + "\x00"
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", dir.Name(), "cmdline"))
+		if err == nil && string(cmdline) == want && processAlive(pid) {
+			return pid
+		}
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Impairment describes network impairments applied to an endpoint link with
+// the netem queueing discipline. Percentages are 0-100.
+type Impairment struct {
+	// Percentage of packets dropped
+	Loss float64 `yaml:"loss"`
+	// Added latency and its random variation
+	Delay  time.Duration `yaml:"delay"`
+	Jitter time.Duration `yaml:"jitter"`
+	// Percentage of packets duplicated
+	Duplicate float64 `yaml:"duplicate"`
+	// Percentage of packets with a corrupted bit
+	Corrupt float64 `yaml:"corrupt"`
+}
+
+// Returns the netem arguments for the impairment
+func (this *Impairment) netemArgs() []string {
+	args := []string{}
+	if this.Loss > 0 {
+		args = append(args, "loss", fmt.Sprintf("%g%%", this.Loss))
+	}
+	if this.Delay > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", this.Delay/time.Microsecond))
+		if this.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", this.Jitter/time.Microsecond))
+		}
+	}
+	if this.Duplicate > 0 {
+		args = append(args, "duplicate", fmt.Sprintf("%g%%", this.Duplicate))
+	}
+	if this.Corrupt > 0 {
+		args = append(args, "corrupt", fmt.Sprintf("%g%%", this.Corrupt))
+	}
+	return args
+}
+
+// Check the impairment parameters are within range.
+func (this *Impairment) Validate() error {
+	for name, pct := range map[string]float64{
+		"loss":      this.Loss,
+		"duplicate": this.Duplicate,
+		"corrupt":   this.Corrupt,
+	} {
+		if pct < 0 || pct > 100 {
+			return errors.New(fmt.Sprintf("Impairment %s must be between 0 and 100 percent: %g", name, pct))
+		}
+	}
+	if this.Delay < 0 || this.Jitter < 0 {
+		return errors.New("Impairment delay and jitter must not be negative")
+	}
+	if this.Jitter > 0 && this.Delay == 0 {
+		return errors.New("Impairment jitter requires a delay")
+	}
+	return nil
+}
+
+// Returns a human readable description of the impairment
+func (this *Impairment) String() string {
+	if this == nil {
+		return ""
+	}
+	return strings.Join(this.netemArgs(), " ")
+}
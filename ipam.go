@@ -2,28 +2,70 @@ package main
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/wrouesnel/go.log"
 
 	"net"
 	"sync"
-	"github.com/ziutek/utils/netaddr"
 	"github.com/docker/go-plugins-helpers/ipam"
 
-	"encoding/binary"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"sort"
+	"math"
+	"time"
 )
 
-// Find the lastAddr in an IPv4 address
-func lastAddr(n *net.IPNet) (net.IP, error) { // works when the n is a prefix, otherwise...
-	if n.IP.To4() == nil {
-		return net.IP{}, errors.New("does not support IPv6 addresses.")
+// Strategies for picking addresses out of a pool
+const (
+	// Lowest free address. Default for IPv4 pools.
+	AllocationSequential string = "sequential"
+	// Lowest free address after the last one assigned, wrapping around
+	AllocationRoundRobin string = "round-robin"
+	// Modified EUI-64 interface identifier derived from the endpoint MAC
+	// address. Default for IPv6 pools.
+	AllocationEUI64 string = "eui64"
+	// Address derived from a hash of the endpoint MAC address
+	AllocationHash string = "hash"
+	// Random address
+	AllocationRandom string = "random"
+)
+
+// Free but unusable addresses (e.g. reserved anycast addresses) skipped while
+// looking for one to assign, before giving up.
+const maxAllocationProbes = 4096
+
+// Largest offset into a subpool, for converting offsets out of big.Int
+var maxUint64 = new(big.Int).SetUint64(^uint64(0))
+
+// Number of subnet anycast addresses reserved at the top of IPv6 subnets with
+// 64 bit interface identifiers (RFC 2526).
+const ipv6ReservedAnycastAddresses = 128
+
+// Find the last address of a network (the IPv4 broadcast address).
+func lastAddr(n *net.IPNet) (net.IP, error) {
+	if len(n.IP) != len(n.Mask) {
+		return net.IP{}, errors.New("network address and mask lengths differ.")
+	}
+	ip := make(net.IP, len(n.IP))
+	for i := range ip {
+		ip[i] = n.IP[i] | ^n.Mask[i]
 	}
-	ip := make(net.IP, len(n.IP.To4()))
-	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(n.IP.To4())|^binary.BigEndian.Uint32(net.IP(n.Mask).To4()))
 	return ip, nil
 }
 
+// Default allocation strategy for a network.
+func defaultAllocation(n *net.IPNet) string {
+	if n.IP.To4() != nil {
+		return AllocationSequential
+	}
+	return AllocationEUI64
+}
+
 // Represents a golang formatted IPAM network pool
 type IPAMNetworkPool struct {
 	addressSpace string
@@ -33,12 +75,49 @@ type IPAMNetworkPool struct {
 	subpool		 net.IPNet
 	gateway      net.IP
 
-	// Mapping of IPs which have been assigned out of this pool.
-	assignedIPs	 map[string]net.IP
-	// Holds IP addresses like .0 which *technically* can be used but are
-	// not by convention. This is only set when this is used as an IPAM
-	// construct.
-	unusableIPs map[string]net.IP
+	// Offsets of the IPs which have been assigned out of the subpool.
+	assigned addressSet
+	// IPs assigned from outside the subpool, i.e. a gateway in the rest of
+	// the pool.
+	assignedOutside map[string]net.IP
+	// Block addresses like .0 which *technically* can be used but are not by
+	// convention. This is only set when this is used as an IPAM construct.
+	reserveEnds bool
+	// Sorted ranges of addresses never assigned
+	excluded []addressRange
+	// Named addresses only assigned when requested explicitly
+	reservations map[string]net.IP
+	// IPs only assigned to the MAC address they are bound to, by MAC
+	// address, and the MAC address each bound IP is for
+	macBindings map[string]net.IP
+	boundIPs    map[string]string
+	// Reassign the last IP of each MAC address to it when free
+	sticky    bool
+	stickyIPs map[string]net.IP
+	// Who requested each assigned IP and when, by IP
+	assignments map[string]poolAssignment
+	// Network using the pool for its address data, if any
+	network string
+	// Fingerprint of the RequestPool request the pool was made for
+	request string
+	// Set for pools restored on start-up until docker replays the request
+	// for them
+	awaitingReplay bool
+	// Addresses assigned when the pool was restored, until docker replays
+	// the request for them
+	replayableIPs map[string]bool
+	// How addresses are picked out of the subpool
+	allocation string
+	// Offset following the last address assigned out of the subpool
+	nextOffset uint64
+
+	// How long released addresses stay assigned before being freed
+	quarantine time.Duration
+	// When each quarantined IP is freed
+	quarantinedUntil map[string]time.Time
+	// Quarantined IPs in the order they are freed. Entries of IPs since
+	// claimed, or released again, are stale and skipped.
+	quarantineQueue []quarantinedIP
 
 	mtx sync.Mutex
 }
@@ -72,26 +151,44 @@ func NewIPAMPool(inp *ipam.RequestPoolRequest) (*IPAMNetworkPool, error) {
 		subpoolNetwork = poolNetwork
 	}
 
-	// Build the list of valid but disallowed IPs in the pool network.
-	unusableIPs := make(map[string]net.IP)
-
-	// Block 0 from the range.
-	disallowed := (*subpoolNetwork).IP.Mask((*subpoolNetwork).Mask)
-	unusableIPs[disallowed.String()] = disallowed
-
-	// And broadcast if IPv4
-	if broadcast, err := lastAddr(subpoolNetwork) ; err == nil {
-		unusableIPs[broadcast.String()] = broadcast
+	options, err := ParsePoolOptions(inp.Options)
+	if err != nil {
+		return nil, err
+	}
+	allocation := options.Allocation
+	if allocation == "" {
+		allocation = defaultAllocation(subpoolNetwork)
+	} else if allocation == AllocationEUI64 && subpoolNetwork.IP.To4() != nil {
+		return nil, errors.New(fmt.Sprintf("Address allocation %s needs an IPv6 pool", AllocationEUI64))
 	}
 
-	return &IPAMNetworkPool{
-		addressSpace: inp.AddressSpace,
-		pool:         *poolNetwork,
-		gateway:      nil,
-		assignedIPs:  make(map[string]net.IP),
-		subpool:	  *subpoolNetwork,
-		unusableIPs:  unusableIPs,
-	}, nil
+	pool := newPool(inp.AddressSpace, poolNetwork, subpoolNetwork, nil, allocation, true)
+	pool.quarantine = options.Quarantine
+	if pool.excluded, err = parseAddressRanges(options.ExcludedRanges, subpoolNetwork); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", PoolOptionExcludedRanges, err))
+	}
+	if pool.reservations, err = parseReservations(options.Reservations, poolNetwork); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", PoolOptionReservations, err))
+	}
+	for name, ip := range pool.reservations {
+		if pool.excludedRange(ip) != nil {
+			return nil, errors.New(fmt.Sprintf("Reservation %s address %s is excluded", name, ip))
+		}
+	}
+	if pool.macBindings, pool.boundIPs, err = parseMACBindings(options.MACBindings, subpoolNetwork); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", PoolOptionMACBindings, err))
+	}
+	for mac, ip := range pool.macBindings {
+		// Checked before the binding is in place, which makes it unusable
+		delete(pool.boundIPs, ip.String())
+		usable := pool.isUsable(ip)
+		pool.boundIPs[ip.String()] = mac
+		if !usable {
+			return nil, errors.New(fmt.Sprintf("Binding %s address %s is excluded, reserved or unusable", mac, ip))
+		}
+	}
+	pool.sticky = options.Sticky
+	return pool, nil
 }
 
 // Returns a driver IPAMNetworkPool
@@ -113,21 +210,68 @@ func NewIPAMNetworkPool(inp *network.IPAMData) (*IPAMNetworkPool, error) {
 		return nil, errors.New("Could not parse IPAM gateway")
 	}
 
+	return newPool(inp.AddressSpace, poolNetwork, poolNetwork, ip, defaultAllocation(poolNetwork), false), nil
+}
+
+// Returns an empty pool. reserveEnds blocks the network address, and the
+// broadcast address of IPv4 subpools, from being allocated.
+func newPool(addressSpace string, pool *net.IPNet, subpool *net.IPNet, gateway net.IP, allocation string, reserveEnds bool) *IPAMNetworkPool {
+	ones, bits := subpool.Mask.Size()
 	return &IPAMNetworkPool{
-		addressSpace: inp.AddressSpace,
-		pool:         *poolNetwork,
-		gateway:      ip,
-		assignedIPs:  make(map[string]net.IP),
-		subpool:      *poolNetwork,
-		unusableIPs:  make(map[string]net.IP),
-	}, nil
+		addressSpace:    addressSpace,
+		pool:            *pool,
+		subpool:         *subpool,
+		gateway:         gateway,
+		assigned:         newAddressSet(bits - ones),
+		assignedOutside:  make(map[string]net.IP),
+		reserveEnds:      reserveEnds,
+		allocation:       allocation,
+		quarantinedUntil: make(map[string]time.Time),
+		reservations:     make(map[string]net.IP),
+		macBindings:      make(map[string]net.IP),
+		boundIPs:         make(map[string]string),
+		stickyIPs:        make(map[string]net.IP),
+		assignments:      make(map[string]poolAssignment),
+	}
+}
+
+// Record of an IP assigned by request
+type poolAssignment struct {
+	// Empty if the request had no MAC address
+	mac string
+	at  time.Time
+}
+
+// A released IP held back from being reassigned
+type quarantinedIP struct {
+	ip    net.IP
+	until time.Time
+}
+
+// Returns the addresses blocked by reserveEnds.
+func (this *IPAMNetworkPool) reservedEnds() []net.IP {
+	if !this.reserveEnds {
+		return nil
+	}
+	// Block 0 from the range. For IPv6 this is the subnet-router anycast
+	// address.
+	reserved := []net.IP{this.subpool.IP.Mask(this.subpool.Mask)}
+	// And broadcast if IPv4
+	if this.subpool.IP.To4() != nil {
+		if broadcast, err := lastAddr(&this.subpool); err == nil {
+			reserved = append(reserved, broadcast)
+		}
+	}
+	return reserved
 }
 
 // isUsable checks the IP is on the allowed list. This is used to rule out
 // "strange" IP address like .0 from being allocated.
 func (this *IPAMNetworkPool) isUsable(probe net.IP) bool {
-	if _, found := this.unusableIPs[probe.String()]; found {
-		return false
+	for _, reserved := range this.reservedEnds() {
+		if probe.Equal(reserved) {
+			return false
+		}
 	}
 
 	// Regular IP usability checks should reject gateway IPs
@@ -135,16 +279,228 @@ func (this *IPAMNetworkPool) isUsable(probe net.IP) bool {
 		return false
 	}
 
-	return true
+	if this.excludedRange(probe) != nil || this.reservationOf(probe) != "" {
+		return false
+	}
+
+	if _, bound := this.boundIPs[probe.String()]; bound {
+		return false
+	}
+
+	return !this.isReservedAnycast(probe)
+}
+
+// Returns the excluded range holding the IP, or nil.
+func (this *IPAMNetworkPool) excludedRange(probe net.IP) *addressRange {
+	for i := range this.excluded {
+		if this.excluded[i].Contains(probe) {
+			return &this.excluded[i]
+		}
+	}
+	return nil
+}
+
+// IsExcluded checks if the IP is in an excluded range of the pool.
+func (this *IPAMNetworkPool) IsExcluded(probe net.IP) bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	return this.excludedRange(probe) != nil
+}
+
+// Returns the name of the reservation of the IP, or "".
+func (this *IPAMNetworkPool) reservationOf(probe net.IP) string {
+	for name, ip := range this.reservations {
+		if ip.Equal(probe) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Check if the IP is one of the subnet anycast addresses reserved at the top
+// of IPv6 subnets with 64 bit interface identifiers.
+func (this *IPAMNetworkPool) isReservedAnycast(probe net.IP) bool {
+	ones, bits := this.subpool.Mask.Size()
+	if bits != 8*net.IPv6len || bits-ones < 64 {
+		return false
+	}
+	offset := this.offsetOf(probe)
+	threshold := new(big.Int).Sub(this.hostCount(), big.NewInt(ipv6ReservedAnycastAddresses))
+	return offset.Cmp(threshold) >= 0
+}
+
+// Number of addresses in the subpool.
+func (this *IPAMNetworkPool) hostCount() *big.Int {
+	ones, bits := this.subpool.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// Offset of an IP from the start of the subpool.
+func (this *IPAMNetworkPool) offsetOf(ip net.IP) *big.Int {
+	base := this.subpool.IP.Mask(this.subpool.Mask)
+	if len(base) == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	return new(big.Int).Sub(new(big.Int).SetBytes(ip), new(big.Int).SetBytes(base))
+}
+
+// Offset of an IP in the assigned set. Returns false for IPs outside the
+// subpool, or beyond the first 2^64 addresses of it.
+func (this *IPAMNetworkPool) setOffsetOf(ip net.IP) (uint64, bool) {
+	if !this.subpool.Contains(ip) {
+		return 0, false
+	}
+	offset := this.offsetOf(ip)
+	if !offset.IsUint64() {
+		return 0, false
+	}
+	return offset.Uint64(), true
+}
+
+// Wraps an offset to the subpool size, and the first 2^64 addresses of it.
+func (this *IPAMNetworkPool) wrapOffset(offset *big.Int) uint64 {
+	offset = new(big.Int).Mod(offset, this.hostCount())
+	return new(big.Int).And(offset, maxUint64).Uint64()
+}
+
+// IP at an offset from the start of the subpool.
+func (this *IPAMNetworkPool) addressAt(offset uint64) net.IP {
+	base := this.subpool.IP.Mask(this.subpool.Mask)
+	value := new(big.Int).Add(new(big.Int).SetBytes(base), new(big.Int).SetUint64(offset)).Bytes()
+	// Left-pad to the address length
+	ip := make(net.IP, len(base))
+	copy(ip[len(ip)-len(value):], value)
+	return ip
+}
+
+// Assign the first free and usable IP at or after the offset, wrapping around
+// the subpool. Caller must hold the lock.
+func (this *IPAMNetworkPool) assignFrom(offset uint64) net.IP {
+	for i := 0; i < maxAllocationProbes; i++ {
+		free, found := this.assigned.NextClear(offset)
+		if !found {
+			return nil
+		}
+		ip := this.addressAt(free)
+		// Skip excluded ranges as a whole
+		if r := this.excludedRange(ip); r != nil {
+			offset = 0
+			if next, ok := this.setOffsetOf(r.last); ok && next != ^uint64(0) &&
+				new(big.Int).SetUint64(next+1).Cmp(this.hostCount()) < 0 {
+				offset = next + 1
+			}
+			continue
+		}
+		if this.isUsable(ip) {
+			this.assigned.Add(free)
+			this.nextOffset = free + 1
+			return ip
+		}
+		offset = free + 1
+	}
+	return nil
+}
+
+// Modified EUI-64 interface identifier of a 48 bit MAC address.
+func eui64InterfaceID(mac net.HardwareAddr) *big.Int {
+	id := []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+	return new(big.Int).SetBytes(id)
 }
 
 // isAssigned internal implementation - does not lock and so is used from
 // within this struct only.
 func (this *IPAMNetworkPool) isAssigned(probe net.IP) bool {
-	_, found := this.assignedIPs[probe.String()]
+	if offset, ok := this.setOffsetOf(probe); ok {
+		return this.assigned.Has(offset)
+	}
+	_, found := this.assignedOutside[probe.String()]
 	return found
 }
 
+// Marks an IP assigned. Returns false if it already was, unless it is only
+// quarantined. Caller must hold the lock.
+func (this *IPAMNetworkPool) markAssigned(ip net.IP) bool {
+	if _, found := this.quarantinedUntil[ip.String()]; found {
+		delete(this.quarantinedUntil, ip.String())
+		return true
+	}
+	if this.isAssigned(ip) {
+		return false
+	}
+	if offset, ok := this.setOffsetOf(ip); ok {
+		this.assigned.Add(offset)
+		this.nextOffset = offset + 1
+	} else {
+		this.assignedOutside[ip.String()] = ip
+	}
+	return true
+}
+
+// Marks an IP free. Caller must hold the lock.
+func (this *IPAMNetworkPool) markFree(ip net.IP) {
+	delete(this.assignments, ip.String())
+	delete(this.replayableIPs, ip.String())
+	if offset, ok := this.setOffsetOf(ip); ok {
+		this.assigned.Remove(offset)
+	} else {
+		delete(this.assignedOutside, ip.String())
+	}
+}
+
+// Returns every assigned IP which is not quarantined, in ascending order.
+// Caller must hold the lock.
+func (this *IPAMNetworkPool) assignedIPs() []net.IP {
+	ips := make(ipList, 0, this.assigned.Len()+len(this.assignedOutside))
+	this.assigned.Each(func(offset uint64) {
+		ips = append(ips, this.addressAt(offset))
+	})
+	for _, ip := range this.assignedOutside {
+		ips = append(ips, ip)
+	}
+	sort.Sort(ips)
+
+	result := ips[:0]
+	for _, ip := range ips {
+		if _, found := this.quarantinedUntil[ip.String()]; !found {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// Keeps an IP assigned until the given time. Caller must hold the lock.
+func (this *IPAMNetworkPool) quarantineIP(ip net.IP, until time.Time) {
+	this.markAssigned(ip)
+	this.quarantinedUntil[ip.String()] = until
+	this.quarantineQueue = append(this.quarantineQueue, quarantinedIP{ip, until})
+}
+
+// Frees the quarantined IPs due by now. Caller must hold the lock.
+func (this *IPAMNetworkPool) expireQuarantine(now time.Time) {
+	for len(this.quarantineQueue) > 0 && !this.quarantineQueue[0].until.After(now) {
+		entry := this.quarantineQueue[0]
+		this.quarantineQueue = this.quarantineQueue[1:]
+		if until, found := this.quarantinedUntil[entry.ip.String()]; found && until.Equal(entry.until) {
+			delete(this.quarantinedUntil, entry.ip.String())
+			this.markFree(entry.ip)
+		}
+	}
+}
+
+// Returns the quarantined IPs, in the order they are freed. Caller must hold
+// the lock.
+func (this *IPAMNetworkPool) quarantinedIPs() []quarantinedIP {
+	result := []quarantinedIP{}
+	for _, entry := range this.quarantineQueue {
+		if until, found := this.quarantinedUntil[entry.ip.String()]; found && until.Equal(entry.until) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
 func (this *IPAMNetworkPool) IsAssigned(probe net.IP) bool {
 	this.mtx.Lock()
 	defer this.mtx.Unlock()
@@ -170,13 +526,99 @@ func (this *IPAMNetworkPool) SetGateway(ip net.IP) error {
 	return nil
 }
 
+// Link the pool to the network using it.
+func (this *IPAMNetworkPool) linkNetwork(networkId string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.network = networkId
+}
+
+// Unlink the pool from a network, unless another network has linked it since.
+func (this *IPAMNetworkPool) unlinkNetwork(networkId string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.network == networkId {
+		this.network = ""
+	}
+}
+
 // Assigns an IP from the pool. If IP is not nil, then only attempts to assign
-// the given IP. IPs will only be assigned out of the subpool.
-func (this *IPAMNetworkPool) AssignIP(ip net.IP) net.IP {
+// the given IP. IPs will only be assigned out of the subpool. Otherwise the
+// IP bound to the endpoint MAC address, or the IP it last had in sticky pools,
+// is assigned, and failing that the pool's allocation strategy picks one,
+// using the MAC address if it is not nil.
+func (this *IPAMNetworkPool) AssignIP(ip net.IP, mac net.HardwareAddr) net.IP {
+	assigned, _ := this.AssignRecordedIP(ip, mac, func(net.IP, time.Time) error { return nil })
+	return assigned
+}
+
+// AssignRecordedIP assigns an IP as AssignIP does, and passes it and the time
+// it was assigned to record before unlocking the pool, so changes to the pool
+// are recorded in the order they are made. If record fails the IP is freed
+// again and the error returned.
+func (this *IPAMNetworkPool) AssignRecordedIP(ip net.IP, mac net.HardwareAddr, record func(ip net.IP, at time.Time) error) (net.IP, error) {
 	// Lock until we have made a decision
 	this.mtx.Lock()
 	defer this.mtx.Unlock()
 
+	now := time.Now()
+	this.expireQuarantine(now)
+
+	assigned := this.assign(ip, mac)
+	if assigned == nil {
+		return nil, nil
+	}
+	if err := record(assigned, now); err != nil {
+		delete(this.quarantinedUntil, assigned.String())
+		this.markFree(assigned)
+		return nil, err
+	}
+	this.rememberMAC(mac.String(), assigned)
+	this.recordAssignment(assigned, mac.String(), now)
+	return assigned, nil
+}
+
+// Records who requested an IP and when. Caller must hold the lock.
+func (this *IPAMNetworkPool) recordAssignment(ip net.IP, mac string, at time.Time) {
+	this.assignments[ip.String()] = poolAssignment{mac, at}
+}
+
+// Records the IP last assigned to a MAC address in sticky pools. Caller must
+// hold the lock.
+func (this *IPAMNetworkPool) rememberMAC(mac string, ip net.IP) {
+	if this.sticky && mac != "" {
+		this.stickyIPs[mac] = ip
+	}
+}
+
+// Marks the pool and the addresses assigned out of it as restored, until
+// docker replays the requests for them.
+func (this *IPAMNetworkPool) awaitReplay() {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	this.awaitingReplay = true
+	this.replayableIPs = make(map[string]bool)
+	for _, ip := range this.assignedIPs() {
+		this.replayableIPs[ip.String()] = true
+	}
+}
+
+// Check an explicit request for an assigned IP is docker replaying the
+// request which assigned it: either the IP was restored and not requested
+// since, or it was assigned to the same MAC address. Caller must hold the
+// lock.
+func (this *IPAMNetworkPool) replayedAssignment(ip net.IP, mac net.HardwareAddr) bool {
+	if this.replayableIPs[ip.String()] {
+		delete(this.replayableIPs, ip.String())
+		return true
+	}
+	assignment, found := this.assignments[ip.String()]
+	return found && len(mac) != 0 && assignment.mac == mac.String()
+}
+
+// AssignIP implementation. Caller must hold the lock.
+func (this *IPAMNetworkPool) assign(ip net.IP, mac net.HardwareAddr) net.IP {
 	if ip != nil {
 		// Is the IP the gateway? (i.e. container wanting to become the gateway)
 		if this.gateway.Equal(ip) {
@@ -184,41 +626,185 @@ func (this *IPAMNetworkPool) AssignIP(ip net.IP) net.IP {
 			// someone else hasn't claimed it already.
 			// Note: the usability list is not checked here, since that list
 			// always marks gateway IPs as unusable.
-			if this.isAssigned(ip) == false {
-				this.assignedIPs[ip.String()] = ip
+			if this.markAssigned(ip) || this.replayedAssignment(ip, mac) {
 				return ip
 			}
 			return nil
 		}
 
 		// Not containable in this pool
-		if this.subpool.Contains(ip) == false {
+		if this.subpool.Contains(ip) == false || this.excludedRange(ip) != nil {
 			return nil
 		}
 
-		if this.isAssigned(ip) {
+		// Bound to another MAC address
+		if boundMAC, found := this.boundIPs[ip.String()]; found && boundMAC != mac.String() {
 			return nil
-		} else {
-			this.assignedIPs[ip.String()] = ip
+		}
+
+		if this.markAssigned(ip) || this.replayedAssignment(ip, mac) {
 			return ip
 		}
+		return nil
 	}
 
-	// Nil IP - probe the map with incrementing IPs still we find one we can use
-	for ip := this.subpool.IP.Mask(this.subpool.Mask); this.subpool.Contains(ip); ip = netaddr.IPAdd(ip, 1) {
-		if (this.isAssigned(ip) == false) && this.isUsable(ip) {
-			this.assignedIPs[ip.String()] = ip
-			return ip
+	if len(mac) == 6 {
+		// Bound IPs are kept for their MAC address even when taken
+		if bound, found := this.macBindings[mac.String()]; found {
+			if this.markAssigned(bound) {
+				return bound
+			}
+			return nil
+		}
+		// Including while quarantined, which only keeps it from others
+		if last, found := this.stickyIPs[mac.String()]; found && this.isUsable(last) {
+			if _, quarantined := this.quarantinedUntil[last.String()]; quarantined || !this.isAssigned(last) {
+				this.markAssigned(last)
+				return last
+			}
 		}
 	}
 
-	// Couldn't find anything to assign.
-	return nil
+	allocation := this.allocation
+	// Without a MAC address there is nothing to derive an address from.
+	if len(mac) != 6 && (allocation == AllocationEUI64 || allocation == AllocationHash) {
+		allocation = AllocationRandom
+	}
+
+	switch allocation {
+	case AllocationEUI64:
+		// The interface identifier fills the host part of /64 subnets. Smaller
+		// subnets use as much of it as fits, and colliding addresses fall
+		// back to the following ones.
+		return this.assignFrom(this.wrapOffset(eui64InterfaceID(mac)))
+	case AllocationHash:
+		sum := sha256.Sum256([]byte(mac.String()))
+		return this.assignFrom(this.wrapOffset(new(big.Int).SetBytes(sum[:])))
+	case AllocationRandom:
+		offset, err := rand.Int(rand.Reader, this.hostCount())
+		if err != nil {
+			log.Errorln("Could not pick a random address:", err)
+			return nil
+		}
+		return this.assignFrom(this.wrapOffset(offset))
+	case AllocationRoundRobin:
+		return this.assignFrom(this.nextOffset)
+	}
+
+	// Sequential - the lowest free address we can use
+	return this.assignFrom(0)
 }
 
+// FreeIP makes an IP available straight away, e.g. to undo assigning it.
 func (this *IPAMNetworkPool) FreeIP(ip net.IP) {
 	this.mtx.Lock()
 	defer this.mtx.Unlock()
 
-	delete(this.assignedIPs, ip.String())
-}
\ No newline at end of file
+	delete(this.quarantinedUntil, ip.String())
+	this.markFree(ip)
+}
+
+// ReleaseIP makes an IP released at the given time available once the
+// pool's quarantine has passed.
+func (this *IPAMNetworkPool) ReleaseIP(ip net.IP, at time.Time) {
+	this.ReleaseRecordedIP(ip, at, func() error { return nil })
+}
+
+// ReleaseRecordedIP releases an IP as ReleaseIP does, and calls record before
+// unlocking the pool, so changes to the pool are recorded in the order they
+// are made. The IP stays released if record fails.
+func (this *IPAMNetworkPool) ReleaseRecordedIP(ip net.IP, at time.Time, record func() error) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if this.quarantine == 0 || !this.isAssigned(ip) {
+		this.markFree(ip)
+	} else if _, found := this.quarantinedUntil[ip.String()]; !found {
+		this.quarantineIP(ip, at.Add(this.quarantine))
+	}
+	return record()
+}
+
+// Returns a snapshot of the pool state for the admin API.
+func (this *IPAMNetworkPool) info(poolId string) AdminPoolInfo {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	this.expireQuarantine(time.Now())
+
+	info := AdminPoolInfo{
+		PoolID:       poolId,
+		AddressSpace: this.addressSpace,
+		Pool:         this.pool.String(),
+		SubPool:      this.subpool.String(),
+		Allocation:   this.allocation,
+		Quarantine:   this.quarantine.String(),
+		Size:         this.size(),
+		Allocated:    []string{},
+		Assignments:  []AdminAssignmentInfo{},
+		Quarantined:  []string{},
+		Excluded:     []string{},
+		Reservations: make(map[string]string),
+	}
+	for _, r := range this.excluded {
+		info.Excluded = append(info.Excluded, r.String())
+	}
+	for name, ip := range this.reservations {
+		info.Reservations[name] = ip.String()
+	}
+	info.Sticky = this.sticky
+	info.MACBindings = make(map[string]string)
+	for mac, ip := range this.macBindings {
+		info.MACBindings[mac] = ip.String()
+	}
+	info.StickyAddresses = make(map[string]string)
+	for mac, ip := range this.stickyIPs {
+		info.StickyAddresses[mac] = ip.String()
+	}
+	info.NetworkID = this.network
+	if this.gateway != nil {
+		info.Gateway = this.gateway.String()
+	}
+	for _, ip := range this.assignedIPs() {
+		info.Allocated = append(info.Allocated, ip.String())
+		assignment := AdminAssignmentInfo{Address: ip.String()}
+		if record, found := this.assignments[ip.String()]; found {
+			assignment.MacAddress = record.mac
+			at := record.at
+			assignment.AssignedAt = &at
+		}
+		info.Assignments = append(info.Assignments, assignment)
+	}
+	for _, entry := range this.quarantinedIPs() {
+		info.Quarantined = append(info.Quarantined, entry.ip.String())
+	}
+
+	info.Used = len(info.Allocated)
+	info.Free = math.Max(info.Size-float64(info.Used+len(info.Quarantined)), 0)
+	if info.Size > 0 {
+		info.Utilisation = 100 * (info.Size - info.Free) / info.Size
+	}
+	return info
+}
+
+// Returns the number of addresses which can be assigned out of the subpool.
+// Caller must hold the lock.
+func (this *IPAMNetworkPool) size() float64 {
+	ones, bits := this.subpool.Mask.Size()
+	size := math.Pow(2, float64(bits-ones)) - float64(len(this.reservedEnds()))
+	if bits == 8*net.IPv6len && bits-ones >= 64 {
+		size -= ipv6ReservedAnycastAddresses
+	}
+	for _, r := range this.excluded {
+		count, _ := new(big.Float).SetInt(r.countIn(&this.subpool)).Float64()
+		size -= count
+	}
+	return size
+}
+
+// Sortable list of IP addresses
+type ipList []net.IP
+
+func (s ipList) Len() int           { return len(s) }
+func (s ipList) Less(i, j int) bool { return bytes.Compare(s[i].To16(), s[j].To16()) < 0 }
+func (s ipList) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
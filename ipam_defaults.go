@@ -0,0 +1,111 @@
+// ipam_defaults picks subnets for IPAM pools requested without one, out of
+// the default address ranges given on the command line.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// DefaultAddressPools are the ranges subnets are carved from for pools
+// requested without one.
+type DefaultAddressPools struct {
+	Ranges []*net.IPNet
+	// Prefix length of the carved subnets, per address family
+	SizeV4 int
+	SizeV6 int
+}
+
+// ParseDefaultAddressPools parses a comma separated list of CIDR ranges.
+func ParseDefaultAddressPools(ranges string, sizeV4 int, sizeV6 int) (*DefaultAddressPools, error) {
+	if sizeV4 < 1 || sizeV4 > 8*net.IPv4len {
+		return nil, errors.New(fmt.Sprintf("IPv4 default pool size /%d is not between /1 and /32", sizeV4))
+	}
+	if sizeV6 < 1 || sizeV6 > 8*net.IPv6len {
+		return nil, errors.New(fmt.Sprintf("IPv6 default pool size /%d is not between /1 and /128", sizeV6))
+	}
+
+	this := &DefaultAddressPools{SizeV4: sizeV4, SizeV6: sizeV6}
+	for _, entry := range strings.Split(ranges, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Default address pool %q is not a CIDR network", entry))
+		}
+		ones, _ := n.Mask.Size()
+		if ones > this.size(n) {
+			return nil, errors.New(fmt.Sprintf("Default address pool %s is smaller than a /%d pool", n, this.size(n)))
+		}
+		this.Ranges = append(this.Ranges, n)
+	}
+	return this, nil
+}
+
+// Prefix length of the subnets carved out of a range.
+func (this *DefaultAddressPools) size(n *net.IPNet) int {
+	if n.IP.To4() != nil {
+		return this.SizeV4
+	}
+	return this.SizeV6
+}
+
+// Pick the first subnet of the address family which overlaps none of the
+// used networks.
+func (this *DefaultAddressPools) pick(v6 bool, used []*net.IPNet) (*net.IPNet, error) {
+	tried := []string{}
+	for _, r := range this.Ranges {
+		if (r.IP.To4() == nil) != v6 {
+			continue
+		}
+		tried = append(tried, r.String())
+
+		ones, bits := r.Mask.Size()
+		size := this.size(r)
+		mask := net.CIDRMask(size, bits)
+		base := new(big.Int).SetBytes(r.IP)
+		step := new(big.Int).Lsh(big.NewInt(1), uint(bits-size))
+		count := new(big.Int).Lsh(big.NewInt(1), uint(size-ones))
+
+		for i := big.NewInt(0); i.Cmp(count) < 0; {
+			value := new(big.Int).Add(base, new(big.Int).Mul(i, step)).Bytes()
+			ip := make(net.IP, len(r.IP))
+			copy(ip[len(ip)-len(value):], value)
+			candidate := &net.IPNet{IP: ip, Mask: mask}
+
+			other := overlapping(candidate, used)
+			if other == nil {
+				return candidate, nil
+			}
+			// Skip every subnet inside a larger network at once
+			next := new(big.Int).Add(i, big.NewInt(1))
+			if last, err := lastAddr(other); err == nil && other.Contains(ip) {
+				next.Sub(new(big.Int).SetBytes(last), base)
+				next.Div(next, step).Add(next, big.NewInt(1))
+			}
+			i = next
+		}
+	}
+
+	if len(tried) == 0 {
+		return nil, errors.New("No default address pools are configured for the address family. A subnet must be specified.")
+	}
+	return nil, errors.New(fmt.Sprintf("No free subnets are left in the default address pools %s. A subnet must be specified.",
+		strings.Join(tried, ", ")))
+}
+
+// Returns a network of others which overlaps n, or nil.
+func overlapping(n *net.IPNet, others []*net.IPNet) *net.IPNet {
+	for _, other := range others {
+		if n.Contains(other.IP) || other.Contains(n.IP) {
+			return other
+		}
+	}
+	return nil
+}
@@ -9,9 +9,14 @@ import (
 	"github.com/wrouesnel/go.log"
 
 	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/go-plugins-helpers/sdk"
 	"net"
+	"net/http"
 	"fmt"
 	"encoding/hex"
+	"strings"
+	"time"
 
 	"github.com/satori/go.uuid"
 	"github.com/docker/libnetwork/netlabel"
@@ -26,21 +31,55 @@ type IPAMDriver struct {
 	*VDENetworkDriver
 }
 
+// Path of IPAM capability requests
+const ipamCapabilitiesPath = "/IpamDriver.GetCapabilities"
+
+// Capabilities of the IPAM driver. The vendored plugin helpers predate
+// RequiresRequestReplay, so ipamMux answers capability requests with this.
+type ipamCapabilitiesResponse struct {
+	RequiresMACAddress    bool
+	RequiresRequestReplay bool
+}
+
 // GetCapabilities implements IPAMDriver.GetCapabilities by wrapping the
-// response from the VDE Driver.
+// response from the VDE Driver. It is only used for the fields the plugin
+// helpers know about, see ipamMux.
 func (this *IPAMDriver) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	capabilities := this.capabilities()
+	return &ipam.CapabilitiesResponse{RequiresMACAddress: capabilities.RequiresMACAddress}, nil
+}
+
+func (this *IPAMDriver) capabilities() *ipamCapabilitiesResponse {
 	// Technically, VDE can be global, but we have no way to know that.
-	return &ipam.CapabilitiesResponse{RequiresMACAddress: true}, nil
+	// Docker replaying its allocations after a restart lets it rebuild any
+	// state the journal is missing.
+	return &ipamCapabilitiesResponse{RequiresMACAddress: true, RequiresRequestReplay: true}
+}
+
+// ipamMux registers the routes of the IPAM driver on a mux, answering
+// capability requests itself.
+type ipamMux struct {
+	sdk.Mux
+	driver *IPAMDriver
+}
+
+func (this ipamMux) HandleFunc(path string, fn func(http.ResponseWriter, *http.Request)) {
+	if path == ipamCapabilitiesPath {
+		fn = func(w http.ResponseWriter, r *http.Request) {
+			sdk.EncodeResponse(w, this.driver.capabilities(), "")
+		}
+	}
+	this.Mux.HandleFunc(path, fn)
 }
 
-// GetDefaultAddressSpaces returns some constant entries, since at the moment
-// this concept doesn't really matter to VDE (since we explicitely want to allow
-// overlaps.
+// GetDefaultAddressSpaces returns the configured default address spaces. These
+// allow overlapping pools unless configured otherwise, since VDE networks are
+// separate layer 2 networks.
 func (this *VDENetworkDriver) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
 	log.Infoln("Got GetDefaultAddressSpaces request")
 	return &ipam.AddressSpacesResponse{
-		LocalDefaultAddressSpace: IPAMDefaultAddressSpaceLocal,
-		GlobalDefaultAddressSpace: IPAMDefaultAddressSpaceGlobal,
+		LocalDefaultAddressSpace: this.addressSpaces.Local,
+		GlobalDefaultAddressSpace: this.addressSpaces.Global,
 	}, nil
 }
 
@@ -58,19 +97,60 @@ func (this *VDENetworkDriver) RequestPool(req *ipam.RequestPoolRequest) (*ipam.R
 		With("Options", req.Options).
 		Infoln("RequestPool request received.")
 
+	this.ipamMtx.Lock()
+	defer this.ipamMtx.Unlock()
+
+	// Docker replays its requests after restarting, which get the pools
+	// restored for them back. Each restored pool is only handed out once.
+	request := requestFingerprint(req.AddressSpace, req.Pool, req.SubPool, req.Options, req.V6)
+	if poolId := this.replayedPool(request); poolId != "" {
+		pool := this.ipam[poolId]
+		pool.awaitingReplay = false
+		log.With("PoolID", poolId).Infoln("Returning restored pool for replayed request")
+		return &ipam.RequestPoolResponse{
+			PoolID: poolId,
+			Pool: pool.pool.String(),
+			Data: make(map[string]string),
+		}, nil
+	}
+
 	if req.Pool == "" {
-		return nil, errors.New("A valid subnet must be specified for vde IPAM")
+		if req.SubPool != "" {
+			return nil, errors.New("A subnet must be specified along with a subpool")
+		}
+		// Default subnets never overlap other pools. Overlapping subnets
+		// have to be asked for explicitly.
+		used := make([]*net.IPNet, 0, len(this.ipam))
+		for _, pool := range this.ipam {
+			used = append(used, &pool.pool)
+		}
+		subnet, err := this.defaultPools.pick(req.V6, used)
+		if err != nil {
+			return nil, err
+		}
+		log.With("Pool", subnet.String()).Infoln("Picked subnet from the default address pools")
+		defaultReq := *req
+		defaultReq.Pool = subnet.String()
+		req = &defaultReq
 	}
 
 	newPool, err := NewIPAMPool(req)
 	if err != nil {
 		return nil, err
 	}
+	if newPool.addressSpace == "" {
+		newPool.addressSpace = this.addressSpaces.Local
+	}
+	newPool.request = request
 
-	this.ipamMtx.Lock()
-	defer this.ipamMtx.Unlock()
+	if err := this.addressSpaces.check(newPool, this.ipam); err != nil {
+		return nil, err
+	}
 
 	poolId := this.newPoolID()
+	if err := this.ipamJournal.Append(ipamOpPool, poolId, newPool.state(), ""); err != nil {
+		return nil, err
+	}
 	this.ipam[poolId] = newPool
 
 	return &ipam.RequestPoolResponse{
@@ -80,17 +160,30 @@ func (this *VDENetworkDriver) RequestPool(req *ipam.RequestPoolRequest) (*ipam.R
 	}, nil
 }
 
+// Returns the ID of a restored pool awaiting the replay of the given
+// request, or an empty string. Caller must hold ipamMtx.
+func (this *VDENetworkDriver) replayedPool(request string) string {
+	// The lowest ID is picked so identical requests get pools in a stable
+	// order.
+	replayedId := ""
+	for poolId, pool := range this.ipam {
+		if pool.awaitingReplay && pool.request == request && (replayedId == "" || poolId < replayedId) {
+			replayedId = poolId
+		}
+	}
+	return replayedId
+}
+
 func (this *VDENetworkDriver) ReleasePool(req *ipam.ReleasePoolRequest) error {
 	log := log.With("PoolID", req.PoolID)
 	log.Infoln("ReleasePool request received")
 
-	this.mtx.Lock()
-	defer this.mtx.Unlock()
+	this.ipamMtx.Lock()
+	defer this.ipamMtx.Unlock()
 
 	_, found := this.ipam[req.PoolID]
 	if found {
-		log.Infoln("Removed pool from driver IPAM")
-		delete(this.ipam, req.PoolID)
+		this.releasePool(log, req.PoolID)
 	} else {
 		log.Warnln("PoolID does not exist in IPAM")
 	}
@@ -98,6 +191,48 @@ func (this *VDENetworkDriver) ReleasePool(req *ipam.ReleasePoolRequest) error {
 	return nil
 }
 
+// Removes a pool. Caller must hold ipamMtx.
+func (this *VDENetworkDriver) releasePool(log log.Logger, poolId string) {
+	log.Infoln("Removed pool from driver IPAM")
+	delete(this.ipam, poolId)
+	if err := this.ipamJournal.Append(ipamOpReleasePool, poolId, nil, ""); err != nil {
+		log.Errorln("Error journalling pool release:", err)
+	}
+	for key, gatewayPoolId := range this.gatewayPools {
+		if gatewayPoolId == poolId {
+			delete(this.gatewayPools, key)
+		}
+	}
+}
+
+// ExpireReplays ends the replay of requests docker made before a restart.
+// Restored pools docker has not requested again are released, unless a
+// network uses them, and restored addresses are no longer handed out to
+// requests without the MAC address they were assigned to.
+func (this *VDENetworkDriver) ExpireReplays() {
+	this.ipamMtx.Lock()
+	defer this.ipamMtx.Unlock()
+
+	for poolId, pool := range this.ipam {
+		pool.mtx.Lock()
+		pool.replayableIPs = nil
+		networkId := pool.network
+		pool.mtx.Unlock()
+
+		if !pool.awaitingReplay {
+			continue
+		}
+		pool.awaitingReplay = false
+		log := log.With("PoolID", poolId)
+		if networkId != "" {
+			log.With("NetworkID", networkId).Infoln("Keeping restored pool used by a network")
+			continue
+		}
+		log.Infoln("Restored pool was not requested again")
+		this.releasePool(log, poolId)
+	}
+}
+
 func (this *VDENetworkDriver) RequestAddress(req *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
 	// TODO adapt to follow the logging in the network driver
 	log := log.With("PoolID", req.PoolID).
@@ -105,9 +240,16 @@ func (this *VDENetworkDriver) RequestAddress(req *ipam.RequestAddressRequest) (*
 		With("Options", req.Options)
 	log.Infoln("RequestAddress request received")
 
-	// Scan the IPAM pool for an address.
-	this.ipamMtx.RLock()
-	defer this.ipamMtx.RUnlock()
+	// Gateway requests record the pool in gatewayPools. Others only change
+	// their pool, which keeps its changes in order under its own lock.
+	gatewayRequest := req.Options["RequestAddressType"] == netlabel.Gateway
+	if gatewayRequest {
+		this.ipamMtx.Lock()
+		defer this.ipamMtx.Unlock()
+	} else {
+		this.ipamMtx.RLock()
+		defer this.ipamMtx.RUnlock()
+	}
 	pool, found := this.ipam[req.PoolID]
 	if !found {
 		return nil, errors.New(fmt.Sprintf("PoolID %s does not exist.", req.PoolID))
@@ -126,23 +268,38 @@ func (this *VDENetworkDriver) RequestAddress(req *ipam.RequestAddressRequest) (*
 	// default gateway, but we also want to let users assign a container to
 	// act as the default gateway. VDE has no concept of bridge networks, so
 	// the contract enforced is requiring an explicit IP request.
-	if val, found := req.Options["RequestAddressType"]; found {
-		if val == netlabel.Gateway {
-			log.Infoln("Gateway Network Request")
-			if err := pool.SetGateway(ip); err != nil {
-				return nil, errors.New(fmt.Sprintf("Could not set default gateway for PoolID %s", req.PoolID))
-			}
-			log.Infoln("Gateway IP Successfully Set")
-			return &ipam.RequestAddressResponse{
-				Address: (&net.IPNet{ IP: ip, Mask: pool.pool.Mask }).String(),
-				Data: make(map[string]string),
-			}, nil
+	if gatewayRequest {
+		log.Infoln("Gateway Network Request")
+		if err := pool.SetGateway(ip); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not set default gateway for PoolID %s", req.PoolID))
+		}
+		if err := this.ipamJournal.Append(ipamOpGateway, req.PoolID, nil, ip.String()); err != nil {
+			return nil, err
 		}
+		// The network created with this gateway next uses this pool
+		this.gatewayPools[gatewayKey(pool.addressSpace, &pool.pool, ip)] = req.PoolID
+		log.Infoln("Gateway IP Successfully Set")
+		return &ipam.RequestAddressResponse{
+			Address: (&net.IPNet{ IP: ip, Mask: pool.pool.Mask }).String(),
+			Data: make(map[string]string),
+		}, nil
 	}
 
-	rip := pool.AssignIP(ip)
+	if ip != nil && pool.IsExcluded(ip) {
+		return nil, errors.New(fmt.Sprintf("Address %s is excluded from PoolID %s", ip, req.PoolID))
+	}
 
+	// Docker passes the endpoint MAC address, which some allocation
+	// strategies derive the address from.
+	mac, _ := net.ParseMAC(req.Options[netlabel.MacAddress])
+	rip, err := pool.AssignRecordedIP(ip, mac, func(ip net.IP, at time.Time) error {
+		return this.ipamJournal.AppendAssign(req.PoolID, ip.String(), mac.String(), at)
+	})
+	if err != nil {
+		return nil, err
+	}
 	if rip == nil {
+		metricErrors.Inc(errorAddressExhausted)
 		return nil, errors.New(fmt.Sprintf("Could not assign address to PoolID %s", req.PoolID))
 	}
 
@@ -173,7 +330,118 @@ func (this *VDENetworkDriver) ReleaseAddress(req *ipam.ReleaseAddressRequest) er
 		return errors.New(fmt.Sprintf("PoolID %s not found.", req.PoolID))
 	}
 
-	pool.FreeIP(ip)
+	// Pools with a quarantine hold the address back for a while
+	now := time.Now()
+	if err := pool.ReleaseRecordedIP(ip, now, func() error {
+		return this.ipamJournal.AppendRelease(req.PoolID, ip.String(), now)
+	}); err != nil {
+		log.Errorln("Error journalling address release:", err)
+	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// Key of a gateway in gatewayPools.
+func gatewayKey(addressSpace string, pool *net.IPNet, gateway net.IP) string {
+	return addressSpace + " " + pool.String() + " " + gateway.String()
+}
+
+// Returns the pool of the IPAM driver which a network's address data came
+// from, linked to the network, and its PoolID. That is the pool docker last
+// requested the network's gateway from. Networks using another IPAM driver
+// get a pool of their own, with an empty PoolID.
+func (this *VDENetworkDriver) linkPool(networkId string, data *network.IPAMData) (string, *IPAMNetworkPool, error) {
+	driverPool, err := NewIPAMNetworkPool(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	this.ipamMtx.Lock()
+	defer this.ipamMtx.Unlock()
+
+	linkedId, found := this.gatewayPools[gatewayKey(driverPool.addressSpace, &driverPool.pool, driverPool.gateway)]
+	if !found {
+		return "", driverPool, nil
+	}
+	linked := this.ipam[linkedId]
+
+	log := log.With("NetworkID", networkId).With("PoolID", linkedId)
+	linked.mtx.Lock()
+	other := linked.network
+	linked.mtx.Unlock()
+	if other != "" && other != networkId {
+		log.With("LinkedNetworkID", other).Warnln("IPAM pool of the network's gateway is used by another network, not sharing it")
+		return "", driverPool, nil
+	}
+	linked.linkNetwork(networkId)
+	log.Infoln("Linked network to IPAM pool")
+	return linkedId, linked, nil
+}
+
+// ListPools returns a snapshot of all IPAM pools and their allocations.
+func (this *VDENetworkDriver) ListPools() []AdminPoolInfo {
+	// Taken before the IPAM lock, which is never held while locking networks
+	holders := this.addressHolders()
+
+	this.ipamMtx.RLock()
+	defer this.ipamMtx.RUnlock()
+
+	result := make([]AdminPoolInfo, 0, len(this.ipam))
+	for poolId, pool := range this.ipam {
+		info := pool.info(poolId)
+		for i := range info.Assignments {
+			assignment := &info.Assignments[i]
+			if holder, found := holders[addressHolderKey(assignment.Address, assignment.MacAddress)]; found {
+				assignment.NetworkID = holder.NetworkID
+				assignment.EndpointID = holder.EndpointID
+			}
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// InspectPool returns a snapshot of an IPAM pool and its allocations. The pool
+// can be given by a unique prefix of its ID.
+func (this *VDENetworkDriver) InspectPool(poolId string) (*AdminPoolInfo, error) {
+	var matches []AdminPoolInfo
+	for _, info := range this.ListPools() {
+		if info.PoolID == poolId {
+			return &info, nil
+		}
+		if poolId != "" && strings.HasPrefix(info.PoolID, poolId) {
+			matches = append(matches, info)
+		}
+	}
+	if len(matches) > 1 {
+		return nil, errors.New(fmt.Sprintf("PoolID %s is ambiguous.", poolId))
+	} else if len(matches) == 0 {
+		return nil, errors.New(fmt.Sprintf("PoolID %s does not exist.", poolId))
+	}
+	return &matches[0], nil
+}
+
+// Returns the endpoints holding each address, by addressHolderKey.
+func (this *VDENetworkDriver) addressHolders() map[string]AdminAssignmentInfo {
+	holders := make(map[string]AdminAssignmentInfo)
+	for _, network := range this.ListNetworks() {
+		for _, endpoint := range network.Endpoints {
+			for _, address := range []string{endpoint.Address, endpoint.AddressIPv6} {
+				ip, _, err := net.ParseCIDR(address)
+				if err != nil {
+					continue
+				}
+				holders[addressHolderKey(ip.String(), endpoint.MacAddress)] = AdminAssignmentInfo{
+					NetworkID:  network.NetworkID,
+					EndpointID: endpoint.EndpointID,
+				}
+			}
+		}
+	}
+	return holders
+}
+
+// Pools may overlap, so holders are matched on the MAC address as well.
+func addressHolderKey(address string, mac string) string {
+	return address + "|" + mac
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// Returns a driver using the IPAM journal of another, as after a restart.
+func restartTestDriver(t *testing.T, driver *VDENetworkDriver) *VDENetworkDriver {
+	restarted := NewVDENetworkDriver(driver.socketRoot, NewSwitchManager(), driver.names, driver.requestTimeout,
+		driver.defaultPools, driver.addressSpaces)
+	if err := restarted.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+	return restarted
+}
+
+func TestRequestPoolReplay(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []*ipam.RequestPoolRequest{
+		{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24"},
+		{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24"},
+		{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24", SubPool: "10.1.0.128/25"},
+		{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24", Options: map[string]string{PoolOptionAddressAllocation: AllocationRandom}},
+		{AddressSpace: IPAMDefaultAddressSpaceLocal},
+	}
+	poolIds := map[string]bool{}
+	for _, req := range requests {
+		resp, err := driver.RequestPool(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolIds[resp.PoolID] = true
+	}
+	// Identical requests before a restart are separate networks.
+	if len(poolIds) != len(requests) {
+		t.Fatalf("%d requests got %d pools", len(requests), len(poolIds))
+	}
+
+	restarted := restartTestDriver(t, driver)
+	for i, req := range requests {
+		resp, err := restarted.RequestPool(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !poolIds[resp.PoolID] {
+			t.Errorf("Replayed request %d got new pool %s", i, resp.PoolID)
+		}
+		delete(poolIds, resp.PoolID)
+	}
+	if len(restarted.ipam) != len(requests) {
+		t.Fatalf("Replay left %d pools, expected %d", len(restarted.ipam), len(requests))
+	}
+
+	// Once every restored pool is claimed, requests get new pools again.
+	resp, err := restarted.RequestPool(requests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := driver.ipam[resp.PoolID]; found {
+		t.Fatal("Restored pool was handed out twice")
+	}
+}
+
+func TestRequestAddressReplay(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	poolReq := &ipam.RequestPoolRequest{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24"}
+	pool, err := driver.RequestPool(poolReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestGateway(t, driver, pool.PoolID, "10.1.0.1")
+	// Endpoints with and without a MAC address
+	requests := []*ipam.RequestAddressRequest{
+		{PoolID: pool.PoolID, Address: "10.1.0.2", Options: map[string]string{netlabel.MacAddress: testMAC(2).String()}},
+		{PoolID: pool.PoolID, Options: map[string]string{netlabel.MacAddress: testMAC(3).String()}},
+		{PoolID: pool.PoolID, Address: "10.1.0.4"},
+	}
+	for _, req := range requests {
+		resp, err := driver.RequestAddress(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, _, _ := net.ParseCIDR(resp.Address)
+		req.Address = ip.String()
+	}
+
+	// Docker replays the pool, gateway and address requests with the
+	// addresses it has.
+	restarted := restartTestDriver(t, driver)
+	if _, err := restarted.RequestPool(poolReq); err != nil {
+		t.Fatal(err)
+	}
+	requestGateway(t, restarted, pool.PoolID, "10.1.0.1")
+	for _, req := range requests {
+		resp, err := restarted.RequestAddress(req)
+		if err != nil {
+			t.Fatalf("Replaying request for %s: %v", req.Address, err)
+		}
+		if ip, _, _ := net.ParseCIDR(resp.Address); ip.String() != req.Address {
+			t.Fatalf("Replayed request for %s got %s", req.Address, resp.Address)
+		}
+	}
+
+	// Others can't request the addresses, unless they have the MAC address
+	// they were assigned to.
+	for _, req := range requests {
+		other := &ipam.RequestAddressRequest{PoolID: pool.PoolID, Address: req.Address, Options: map[string]string{netlabel.MacAddress: testMAC(9).String()}}
+		if _, err := restarted.RequestAddress(other); err == nil {
+			t.Errorf("Address %s was assigned twice", req.Address)
+		}
+	}
+	if _, err := restarted.RequestAddress(requests[0]); err != nil {
+		t.Fatal("Repeated request with the same MAC address failed:", err)
+	}
+}
+
+func TestExpireReplays(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]*ipam.RequestPoolRequest{
+		"replayed":  {AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24"},
+		"forgotten": {AddressSpace: "strict", Pool: "10.2.0.0/24"},
+		"linked":    {AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.3.0.0/24"},
+	}
+	poolIds := map[string]string{}
+	for name, req := range requests {
+		resp, err := driver.RequestPool(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolIds[name] = resp.PoolID
+		if _, err := driver.RequestAddress(&ipam.RequestAddressRequest{PoolID: resp.PoolID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := restartTestDriver(t, driver)
+	if _, err := restarted.RequestPool(requests["replayed"]); err != nil {
+		t.Fatal(err)
+	}
+	// As restoring the state of a network using the pool does
+	restarted.ipam[poolIds["linked"]].linkNetwork("network")
+	restarted.ExpireReplays()
+
+	// The forgotten pool is released for good, and its subnet free again.
+	restarted = restartTestDriver(t, restarted)
+	for name, poolId := range poolIds {
+		if _, found := restarted.ipam[poolId]; found != (name != "forgotten") {
+			t.Errorf("Pool %s exists: %v", name, found)
+		}
+	}
+	restarted.ExpireReplays()
+	resp, err := restarted.RequestPool(requests["forgotten"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PoolID == poolIds["forgotten"] {
+		t.Fatal("Released pool was handed out again")
+	}
+	address, err := restarted.RequestAddress(&ipam.RequestAddressRequest{PoolID: resp.PoolID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Address != "10.2.0.1/24" {
+		t.Fatalf("New pool assigned %s first", address.Address)
+	}
+}
+
+// Address requests to the same and different pools run in parallel, and are
+// journalled in the order they change each pool.
+func TestConcurrentAddressRequests(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	poolIds := []string{}
+	for i := 1; i <= 4; i++ {
+		resp, err := driver.RequestPool(&ipam.RequestPoolRequest{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: fmt.Sprintf("10.%d.0.0/24", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolIds = append(poolIds, resp.PoolID)
+	}
+	for i, err := range parallel(32, func(i int) error {
+		poolId := poolIds[i%len(poolIds)]
+		for j := 0; j < 8; j++ {
+			resp, err := driver.RequestAddress(&ipam.RequestAddressRequest{
+				PoolID:  poolId,
+				Options: map[string]string{netlabel.MacAddress: testMAC(i*8 + j).String()},
+			})
+			if err != nil {
+				return err
+			}
+			// Every other address is released again
+			if j%2 == 0 {
+				ip, _, _ := net.ParseCIDR(resp.Address)
+				if err := driver.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: poolId, Address: ip.String()}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}) {
+		if err != nil {
+			t.Errorf("requester %d: %v", i, err)
+		}
+	}
+
+	restarted := restartTestDriver(t, driver)
+	for _, poolId := range poolIds {
+		assigned := fmt.Sprint(driver.ipam[poolId].assignedIPs())
+		if restored := fmt.Sprint(restarted.ipam[poolId].assignedIPs()); restored != assigned {
+			t.Errorf("PoolID %s restored %s, expected %s", poolId, restored, assigned)
+		}
+		if n := len(driver.ipam[poolId].assignedIPs()); n != 32 {
+			t.Errorf("PoolID %s has %d addresses assigned", poolId, n)
+		}
+	}
+}
+
+func TestRequestPoolDenyOverlap(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &ipam.RequestPoolRequest{AddressSpace: "strict", Pool: "10.1.0.0/16"}
+	first, err := driver.RequestPool(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicting := []*ipam.RequestPoolRequest{
+		req,
+		{AddressSpace: "strict", Pool: "10.1.0.0/16", SubPool: "10.1.1.0/24"},
+		{AddressSpace: "strict", Pool: "10.1.2.0/24"},
+	}
+	for _, conflict := range conflicting {
+		if _, err := driver.RequestPool(conflict); err == nil {
+			t.Errorf("Overlapping pool %s %s was allowed", conflict.Pool, conflict.SubPool)
+		} else if !strings.Contains(err.Error(), first.PoolID) {
+			t.Errorf("Error does not name PoolID %s: %v", first.PoolID, err)
+		}
+	}
+	if len(driver.ipam) != 1 {
+		t.Fatalf("%d pools exist", len(driver.ipam))
+	}
+
+	// Docker replaying the request after a restart gets the pool back.
+	restarted := restartTestDriver(t, driver)
+	if resp, err := restarted.RequestPool(req); err != nil {
+		t.Fatal(err)
+	} else if resp.PoolID != first.PoolID {
+		t.Fatalf("Replayed request got pool %s, expected %s", resp.PoolID, first.PoolID)
+	}
+	if _, err := restarted.RequestPool(req); err == nil {
+		t.Fatal("Overlapping pool was allowed once the restored pool was claimed")
+	}
+}
+
+// Requests the gateway of a pool, as docker does before creating a network.
+func requestGateway(t *testing.T, driver *VDENetworkDriver, poolId string, gateway string) {
+	if _, err := driver.RequestAddress(&ipam.RequestAddressRequest{
+		PoolID:  poolId,
+		Address: gateway,
+		Options: map[string]string{"RequestAddressType": netlabel.Gateway},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkPoolOfGateway(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// Pools with the same subnet, as address spaces allowing overlaps have
+	poolIds := []string{}
+	for i := 0; i < 2; i++ {
+		resp, err := driver.RequestPool(&ipam.RequestPoolRequest{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/16"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolIds = append(poolIds, resp.PoolID)
+	}
+
+	// Each network is linked to the pool its gateway came from, whatever
+	// the order of the pools.
+	for i, networkId := range []string{"second", "first"} {
+		poolId := poolIds[1-i]
+		requestGateway(t, driver, poolId, "10.1.0.1")
+		if err := driver.CreateNetwork(createNetworkRequest(networkId, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if linked := driver.ipam[poolId].network; linked != networkId {
+			t.Errorf("PoolID %s is linked to network %q, expected %s", poolId, linked, networkId)
+		}
+	}
+
+	// A network whose gateway came from elsewhere has a pool of its own.
+	if err := driver.CreateNetwork(createNetworkRequest("other", 2)); err != nil {
+		t.Fatal(err)
+	}
+	network, err := driver.lockNetwork("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer network.mtx.Unlock()
+	if len(network.poolIds) != 0 {
+		t.Fatalf("Network is linked to pools %v", network.poolIds)
+	}
+}
+
+func TestIPAMCapabilities(t *testing.T) {
+	handler := sdk.NewHandler()
+	ipam.InitMux(ipamMux{handler, &IPAMDriver{}}, &IPAMDriver{})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, ipamCapabilitiesPath, nil))
+	capabilities := ipamCapabilitiesResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	if !capabilities.RequiresMACAddress || !capabilities.RequiresRequestReplay {
+		t.Fatalf("Unexpected capabilities %+v", capabilities)
+	}
+}
@@ -0,0 +1,235 @@
+// ipam_journal persists IPAM pools and address assignments in an append-only
+// journal under the socket root, so they survive plugin restarts. The journal
+// is compacted to a snapshot of the current pools whenever it is loaded.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+)
+
+// File the IPAM journal is kept in under the socket root
+const ipamJournalFile string = "ipam.journal"
+
+// Longest journal entry read. Compacted entries list every allocated address
+// of a pool.
+const maxIPAMJournalEntryLength = 64 * 1024 * 1024
+
+// Journal operations
+const (
+	// A pool was requested. Also used for the pools of a compacted journal.
+	ipamOpPool        string = "pool"
+	ipamOpReleasePool string = "release_pool"
+	ipamOpAssign      string = "assign"
+	ipamOpRelease     string = "release"
+	ipamOpGateway     string = "gateway"
+)
+
+// A single change to the IPAM state
+type ipamJournalEntry struct {
+	Op      string
+	PoolID  string
+	Pool    *poolState `json:",omitempty"`
+	Address string     `json:",omitempty"`
+	// When an address was assigned or released
+	Time *time.Time `json:",omitempty"`
+	// MAC address an address was assigned to, for sticky pools
+	MAC string `json:",omitempty"`
+}
+
+// IPAMJournal appends IPAM changes to the journal file.
+type IPAMJournal struct {
+	path string
+	file *os.File
+	mtx  sync.Mutex
+}
+
+// LoadIPAMJournal replays the journal under socketRoot and returns the pools
+// it describes, along with the journal opened for appending.
+func LoadIPAMJournal(socketRoot string) (*IPAMJournal, map[string]*IPAMNetworkPool, error) {
+	this := &IPAMJournal{path: filepath.Join(socketRoot, ipamJournalFile)}
+
+	pools, err := this.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := this.compact(pools); err != nil {
+		return nil, nil, errors.New(fmt.Sprintln("Could not compact IPAM journal:", err))
+	}
+
+	this.file, err = os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND, os.FileMode(0600))
+	if err != nil {
+		return nil, nil, err
+	}
+	return this, pools, nil
+}
+
+// Rebuild the pools from the journal file.
+func (this *IPAMJournal) replay() (map[string]*IPAMNetworkPool, error) {
+	pools := make(map[string]*IPAMNetworkPool)
+
+	f, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return pools, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxIPAMJournalEntryLength)
+	for line := 1; scanner.Scan(); line++ {
+		entry := ipamJournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Only the last entry can be cut short, by a crash while writing it
+			log.With("Line", line).Warnln("Ignoring unreadable IPAM journal entry:", err)
+			continue
+		}
+		if err := applyIPAMJournalEntry(pools, &entry); err != nil {
+			log.With("Line", line).With("PoolID", entry.PoolID).Warnln("Ignoring IPAM journal entry:", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintln("Could not read IPAM journal:", err))
+	}
+	return pools, nil
+}
+
+// Apply a journal entry to the pools.
+func applyIPAMJournalEntry(pools map[string]*IPAMNetworkPool, entry *ipamJournalEntry) error {
+	if entry.Op == ipamOpPool {
+		if entry.Pool == nil {
+			return errors.New("Pool entry has no pool")
+		}
+		pool, err := poolFromState(entry.Pool)
+		if err != nil {
+			return err
+		}
+		pools[entry.PoolID] = pool
+		return nil
+	}
+
+	pool, found := pools[entry.PoolID]
+	if !found {
+		return errors.New("Pool does not exist")
+	}
+	if entry.Op == ipamOpReleasePool {
+		delete(pools, entry.PoolID)
+		return nil
+	}
+
+	ip := net.ParseIP(entry.Address)
+	if ip == nil {
+		return errors.New(fmt.Sprintf("Malformed IP address: %s", entry.Address))
+	}
+	switch entry.Op {
+	case ipamOpAssign:
+		pool.markAssigned(ip)
+		pool.rememberMAC(entry.MAC, ip)
+		if entry.Time != nil {
+			pool.recordAssignment(ip, entry.MAC, *entry.Time)
+		}
+	case ipamOpRelease:
+		if entry.Time != nil {
+			pool.ReleaseIP(ip, *entry.Time)
+		} else {
+			pool.FreeIP(ip)
+		}
+	case ipamOpGateway:
+		pool.gateway = ip
+	default:
+		return errors.New(fmt.Sprintf("Unknown operation %q", entry.Op))
+	}
+	return nil
+}
+
+// Atomically replace the journal file with a snapshot of the pools.
+func (this *IPAMJournal) compact(pools map[string]*IPAMNetworkPool) error {
+	tmpPath := this.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for poolId, pool := range pools {
+		if err := encoder.Encode(&ipamJournalEntry{Op: ipamOpPool, PoolID: poolId, Pool: pool.state()}); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.path)
+}
+
+// Append durably records a change. Changes must be appended in the order they
+// are made.
+func (this *IPAMJournal) Append(op string, poolId string, pool *poolState, address string) error {
+	return this.append(&ipamJournalEntry{Op: op, PoolID: poolId, Pool: pool, Address: address})
+}
+
+// AppendAssign durably records an address assigned to an endpoint MAC
+// address, which may be empty, at the given time.
+func (this *IPAMJournal) AppendAssign(poolId string, address string, mac string, at time.Time) error {
+	return this.append(&ipamJournalEntry{Op: ipamOpAssign, PoolID: poolId, Address: address, MAC: mac, Time: &at})
+}
+
+// AppendRelease durably records an address released at the given time.
+func (this *IPAMJournal) AppendRelease(poolId string, address string, at time.Time) error {
+	return this.append(&ipamJournalEntry{Op: ipamOpRelease, PoolID: poolId, Address: address, Time: &at})
+}
+
+func (this *IPAMJournal) append(entry *ipamJournalEntry) error {
+	// Pools can be used without a journal, e.g. before one is loaded.
+	if this == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if _, err := this.file.Write(append(data, '\n')); err != nil {
+		return errors.New(fmt.Sprintln("Could not write IPAM journal:", err))
+	}
+	if err := this.file.Sync(); err != nil {
+		return errors.New(fmt.Sprintln("Could not write IPAM journal:", err))
+	}
+	return nil
+}
+
+// RestoreIPAM restores the IPAM pools from the journal under the socket root,
+// and records all further changes to them in it.
+func (this *VDENetworkDriver) RestoreIPAM() error {
+	journal, pools, err := LoadIPAMJournal(this.socketRoot)
+	if err != nil {
+		return err
+	}
+
+	// Docker replays its requests for pools in use once it restarts.
+	for _, pool := range pools {
+		pool.awaitReplay()
+	}
+
+	this.ipamMtx.Lock()
+	defer this.ipamMtx.Unlock()
+	this.ipam = pools
+	this.ipamJournal = journal
+	log.With("Pools", len(pools)).Infoln("Loaded IPAM journal")
+	return nil
+}
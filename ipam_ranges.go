@@ -0,0 +1,198 @@
+// ipam_ranges parses the excluded address ranges, named reservations and MAC
+// address bindings of IPAM pools.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An inclusive range of addresses
+type addressRange struct {
+	first net.IP
+	last  net.IP
+}
+
+func (this addressRange) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	return bytes.Compare(ip, this.first.To16()) >= 0 && bytes.Compare(ip, this.last.To16()) <= 0
+}
+
+// Number of addresses of the range inside a network.
+func (this addressRange) countIn(n *net.IPNet) *big.Int {
+	first, last := this.first, this.last
+	if !n.Contains(first) {
+		first = n.IP.Mask(n.Mask)
+	}
+	if !n.Contains(last) {
+		last, _ = lastAddr(n)
+	}
+	if bytes.Compare(first.To16(), last.To16()) > 0 {
+		return big.NewInt(0)
+	}
+	count := new(big.Int).Sub(new(big.Int).SetBytes(last.To16()), new(big.Int).SetBytes(first.To16()))
+	return count.Add(count, big.NewInt(1))
+}
+
+func (this addressRange) String() string {
+	if this.first.Equal(this.last) {
+		return this.first.String()
+	}
+	return this.first.String() + "-" + this.last.String()
+}
+
+// Parse a comma separated list of addresses, CIDR networks and ranges such
+// as 10.0.0.1-10.0.0.20. IPv4 addresses can be shortened to the last octet,
+// e.g. .1-.20, which is taken from the subpool. Ranges must not overlap.
+func parseAddressRanges(value string, subpool *net.IPNet) ([]addressRange, error) {
+	ranges := []addressRange{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var r addressRange
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			r.first = n.IP.Mask(n.Mask)
+			r.last, _ = lastAddr(n)
+		} else {
+			bounds := strings.SplitN(entry, "-", 2)
+			if r.first, err = parseRangeAddress(bounds[0], subpool); err != nil {
+				return nil, err
+			}
+			r.last = r.first
+			if len(bounds) == 2 {
+				if r.last, err = parseRangeAddress(bounds[1], subpool); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if (r.first.To4() == nil) != (subpool.IP.To4() == nil) || (r.last.To4() == nil) != (subpool.IP.To4() == nil) {
+			return nil, errors.New(fmt.Sprintf("Range %s is not of the address family of %s", entry, subpool))
+		}
+		if bytes.Compare(r.first.To16(), r.last.To16()) > 0 {
+			return nil, errors.New(fmt.Sprintf("Range %s ends before it starts", entry))
+		}
+		ranges = append(ranges, r)
+	}
+
+	sort.Sort(addressRangeList(ranges))
+	for i := 1; i < len(ranges); i++ {
+		if ranges[i-1].Contains(ranges[i].first) {
+			return nil, errors.New(fmt.Sprintf("Ranges %s and %s overlap", ranges[i-1], ranges[i]))
+		}
+	}
+	return ranges, nil
+}
+
+// Parse an address, or the last octet of an IPv4 address in the subpool.
+func parseRangeAddress(value string, subpool *net.IPNet) (net.IP, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, ".") {
+		base := subpool.IP.To4()
+		octet, err := strconv.ParseUint(value[1:], 10, 8)
+		if base == nil || err != nil {
+			return nil, errors.New(fmt.Sprintf("%q is not the last octet of an IPv4 address", value))
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, base)
+		ip[3] = byte(octet)
+		return ip, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("%q is not an IP address", value))
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// Parse a comma separated list of name=address reservations.
+func parseReservations(value string, pool *net.IPNet) (map[string]net.IP, error) {
+	reservations := make(map[string]net.IP)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, errors.New(fmt.Sprintf("Reservation %q is not of the form name=address", entry))
+		}
+		if _, found := reservations[name]; found {
+			return nil, errors.New(fmt.Sprintf("Reservation %s is given twice", name))
+		}
+		ip, err := parseRangeAddress(parts[1], pool)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.Contains(ip) {
+			return nil, errors.New(fmt.Sprintf("Reservation %s address %s is not in %s", name, ip, pool))
+		}
+		for other, otherIp := range reservations {
+			if otherIp.Equal(ip) {
+				return nil, errors.New(fmt.Sprintf("Reservations %s and %s have the same address %s", other, name, ip))
+			}
+		}
+		reservations[name] = ip
+	}
+	return reservations, nil
+}
+
+// Parse a comma separated list of mac=address bindings into maps of MAC
+// addresses to IPs and back.
+func parseMACBindings(value string, subpool *net.IPNet) (map[string]net.IP, map[string]string, error) {
+	bindings := make(map[string]net.IP)
+	boundIPs := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, errors.New(fmt.Sprintf("Binding %q is not of the form mac=address", entry))
+		}
+		mac, err := net.ParseMAC(strings.TrimSpace(parts[0]))
+		if err != nil || len(mac) != 6 {
+			return nil, nil, errors.New(fmt.Sprintf("%q is not a MAC address", parts[0]))
+		}
+		ip, err := parseRangeAddress(parts[1], subpool)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !subpool.Contains(ip) {
+			return nil, nil, errors.New(fmt.Sprintf("Binding %s address %s is not in %s", mac, ip, subpool))
+		}
+		if _, found := bindings[mac.String()]; found {
+			return nil, nil, errors.New(fmt.Sprintf("MAC address %s is bound twice", mac))
+		}
+		if other, found := boundIPs[ip.String()]; found {
+			return nil, nil, errors.New(fmt.Sprintf("MAC addresses %s and %s are bound to the same address %s", other, mac, ip))
+		}
+		bindings[mac.String()] = ip
+		boundIPs[ip.String()] = mac.String()
+	}
+	return bindings, boundIPs, nil
+}
+
+// Sortable list of address ranges
+type addressRangeList []addressRange
+
+func (s addressRangeList) Len() int { return len(s) }
+func (s addressRangeList) Less(i, j int) bool {
+	return bytes.Compare(s[i].first.To16(), s[j].first.To16()) < 0
+}
+func (s addressRangeList) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
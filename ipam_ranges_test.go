@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+var addressRangeTests = []struct {
+	value   string
+	subpool string
+	// Ranges parsed, or the error they give
+	expected string
+	err      string
+}{
+	{"", "10.1.0.0/24", "[]", ""},
+	{".1-.20", "10.1.0.0/24", "[10.1.0.1-10.1.0.20]", ""},
+	{" .30 , 10.1.0.128/28 ,.1-.20", "10.1.0.0/24", "[10.1.0.1-10.1.0.20 10.1.0.30 10.1.0.128-10.1.0.143]", ""},
+	{"10.1.0.1-.5", "10.1.0.0/24", "[10.1.0.1-10.1.0.5]", ""},
+	{"fd00::1-fd00::ff,fd00::1:0/112", "fd00::/64", "[fd00::1-fd00::ff fd00::1:0-fd00::1:ffff]", ""},
+	{".1-.20,.20-.30", "10.1.0.0/24", "", "overlap"},
+	{".1-.20,10.1.0.16/28", "10.1.0.0/24", "", "overlap"},
+	{".20-.1", "10.1.0.0/24", "", "ends before it starts"},
+	{".256", "10.1.0.0/24", "", "not the last octet"},
+	{".1-.20", "fd00::/64", "", "not the last octet"},
+	{"fd00::1", "10.1.0.0/24", "", "not of the address family"},
+	{"10.1.0.1-fd00::1", "10.1.0.0/24", "", "not of the address family"},
+	{"10.1.0.0/28", "fd00::/64", "", "not of the address family"},
+	{"router", "10.1.0.0/24", "", "not an IP address"},
+}
+
+func TestParseAddressRanges(t *testing.T) {
+	for _, test := range addressRangeTests {
+		_, subpool, _ := net.ParseCIDR(test.subpool)
+		ranges, err := parseAddressRanges(test.value, subpool)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q in %s: got error %v, expected %q", test.value, test.subpool, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q in %s: %v", test.value, test.subpool, err)
+		} else if parsed := fmt.Sprint(ranges); parsed != test.expected {
+			t.Errorf("%q in %s: parsed %s, expected %s", test.value, test.subpool, parsed, test.expected)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// ipam_spaces defines the IPAM address spaces and whether pools in each may
+// overlap.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Overlap policies of address spaces
+const (
+	// Pools may overlap, since VDE networks are separate layer 2 networks
+	OverlapAllow string = "allow"
+	// Pools must not overlap
+	OverlapDeny string = "deny"
+)
+
+// AddressSpaces are the address spaces pools can be requested in, with their
+// overlap policies.
+type AddressSpaces struct {
+	Overlap map[string]string
+	// Defaults docker uses for local and global networks
+	Local  string
+	Global string
+}
+
+// ParseAddressSpaces parses a comma separated list of name=policy address
+// spaces. The default local and global spaces allow overlaps unless given.
+func ParseAddressSpaces(spaces string, local string, global string) (*AddressSpaces, error) {
+	this := &AddressSpaces{
+		Overlap: map[string]string{
+			IPAMDefaultAddressSpaceLocal:  OverlapAllow,
+			IPAMDefaultAddressSpaceGlobal: OverlapAllow,
+		},
+		Local:  local,
+		Global: global,
+	}
+	for _, entry := range strings.Split(spaces, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		policy := OverlapAllow
+		if len(parts) == 2 {
+			policy = strings.TrimSpace(parts[1])
+		}
+		if name == "" {
+			return nil, errors.New(fmt.Sprintf("Address space %q has no name", entry))
+		}
+		if policy != OverlapAllow && policy != OverlapDeny {
+			return nil, errors.New(fmt.Sprintf("Address space %s overlap policy %q is not %s or %s", name, policy, OverlapAllow, OverlapDeny))
+		}
+		this.Overlap[name] = policy
+	}
+
+	for _, name := range []string{local, global} {
+		if _, found := this.Overlap[name]; !found {
+			return nil, errors.New(fmt.Sprintf("Default address space %s is not defined", name))
+		}
+	}
+	return this, nil
+}
+
+// Names of the address spaces, sorted.
+func (this *AddressSpaces) names() []string {
+	names := make([]string, 0, len(this.Overlap))
+	for name := range this.Overlap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check a new pool is allowed in its address space, given the existing pools
+// by ID. Replayed requests never get here, so in spaces denying overlaps even
+// a pool with the same subnets is a conflict.
+func (this *AddressSpaces) check(newPool *IPAMNetworkPool, pools map[string]*IPAMNetworkPool) error {
+	policy, found := this.Overlap[newPool.addressSpace]
+	if !found {
+		return errors.New(fmt.Sprintf("Unknown address space %q. Address spaces are: %s",
+			newPool.addressSpace, strings.Join(this.names(), ", ")))
+	}
+	if policy == OverlapAllow {
+		return nil
+	}
+
+	for poolId, other := range pools {
+		if other.addressSpace != newPool.addressSpace || overlapping(&newPool.pool, []*net.IPNet{&other.pool}) == nil {
+			continue
+		}
+		return errors.New(fmt.Sprintf("Pool %s overlaps pool %s (PoolID %s) in address space %s, which does not allow overlaps",
+			newPool.pool.String(), other.pool.String(), poolId, newPool.addressSpace))
+	}
+	return nil
+}
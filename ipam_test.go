@@ -0,0 +1,497 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// Returns a pool allocating addresses with the given strategy.
+func newTestPool(t testing.TB, pool string, allocation string) *IPAMNetworkPool {
+	return newTestPoolWithOptions(t, pool, map[string]string{PoolOptionAddressAllocation: allocation})
+}
+
+// Returns a pool requested with the given options.
+func newTestPoolWithOptions(t testing.TB, pool string, options map[string]string) *IPAMNetworkPool {
+	p, err := NewIPAMPool(&ipam.RequestPoolRequest{
+		AddressSpace: IPAMDefaultAddressSpaceLocal,
+		Pool:         pool,
+		Options:      options,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// MAC address of the i'th test endpoint
+func testMAC(i int) net.HardwareAddr {
+	mac, _ := net.ParseMAC(fmt.Sprintf("02:42:00:00:%02x:%02x", i>>8&0xff, i&0xff))
+	return mac
+}
+
+var allocationTests = []struct {
+	allocation string
+	pool       string
+	// Address of the first endpoint, or "" if it can't be predicted
+	first string
+}{
+	{AllocationSequential, "fd00::/64", "fd00::1"},
+	{AllocationSequential, "fd00::/120", "fd00::1"},
+	{AllocationEUI64, "fd00::/64", "fd00::42:ff:fe00:1"},
+	// Only the low bits of the interface identifier fit
+	{AllocationEUI64, "fd00::/120", "fd00::1"},
+	{AllocationHash, "fd00::/64", ""},
+	{AllocationHash, "fd00::/120", ""},
+	{AllocationRandom, "fd00::/64", ""},
+	{AllocationRandom, "fd00::/120", ""},
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	for _, test := range allocationTests {
+		name := test.allocation + " " + test.pool
+		pool := newTestPool(t, test.pool, test.allocation)
+
+		assigned := map[string]bool{}
+		for i := 1; i <= 64; i++ {
+			ip := pool.AssignIP(nil, testMAC(i))
+			if ip == nil {
+				t.Fatalf("%s: endpoint %d got no address", name, i)
+			}
+			if i == 1 && test.first != "" && !ip.Equal(net.ParseIP(test.first)) {
+				t.Errorf("%s: first address %s, expected %s", name, ip, test.first)
+			}
+			if !pool.subpool.Contains(ip) || ip.Equal(pool.subpool.IP) {
+				t.Errorf("%s: assigned unusable address %s", name, ip)
+			}
+			if assigned[ip.String()] {
+				t.Fatalf("%s: assigned %s twice", name, ip)
+			}
+			assigned[ip.String()] = true
+		}
+
+		// Addresses derived from the MAC address are the same in every pool.
+		if test.allocation == AllocationHash || test.allocation == AllocationEUI64 {
+			other := newTestPool(t, test.pool, test.allocation)
+			for i := 1; i <= 64; i++ {
+				if ip := other.AssignIP(nil, testMAC(i)); !assigned[ip.String()] {
+					t.Errorf("%s: endpoint %d got %s in another pool", name, i, ip)
+				}
+			}
+		}
+	}
+}
+
+func TestAllocationExhaustion(t *testing.T) {
+	for _, test := range allocationTests {
+		if test.pool != "fd00::/120" {
+			continue
+		}
+		pool := newTestPool(t, test.pool, test.allocation)
+
+		// Every address but the subnet-router anycast one is assigned.
+		for i := 1; i < 256; i++ {
+			if pool.AssignIP(nil, testMAC(i)) == nil {
+				t.Fatalf("%s: endpoint %d got no address", test.allocation, i)
+			}
+		}
+		if ip := pool.AssignIP(nil, testMAC(256)); ip != nil {
+			t.Fatalf("%s: exhausted pool assigned %s", test.allocation, ip)
+		}
+
+		// A freed address is the only one left to assign.
+		freed := net.ParseIP("fd00::80")
+		pool.ReleaseIP(freed, time.Now())
+		if ip := pool.AssignIP(nil, testMAC(256)); !ip.Equal(freed) {
+			t.Fatalf("%s: assigned %s, expected the freed %s", test.allocation, ip, freed)
+		}
+	}
+}
+
+// Checks the quarantined IPs of a pool and when they are freed.
+func checkQuarantine(t *testing.T, pool *IPAMNetworkPool, expected map[string]time.Time) {
+	quarantined := pool.quarantinedIPs()
+	if len(quarantined) != len(expected) {
+		t.Fatalf("Quarantined %v, expected %v", quarantined, expected)
+	}
+	for _, entry := range quarantined {
+		if until, found := expected[entry.ip.String()]; !found || !entry.until.Equal(until) {
+			t.Fatalf("%s quarantined until %s, expected %s", entry.ip, entry.until, until)
+		}
+	}
+}
+
+func TestReleaseQuarantine(t *testing.T) {
+	pool := newTestPoolWithOptions(t, "10.1.0.0/24", map[string]string{PoolOptionReleaseQuarantine: "1h"})
+	for i := 1; i <= 3; i++ {
+		pool.AssignIP(nil, testMAC(i))
+	}
+	released := net.ParseIP("10.1.0.2")
+	start := time.Now()
+	pool.ReleaseIP(released, start)
+	checkQuarantine(t, pool, map[string]time.Time{"10.1.0.2": start.Add(time.Hour)})
+
+	// Only explicit requests get an address during its quarantine.
+	if ip := pool.AssignIP(nil, testMAC(4)); !ip.Equal(net.ParseIP("10.1.0.4")) {
+		t.Fatalf("Assigned %s during quarantine, expected 10.1.0.4", ip)
+	}
+	for _, ip := range pool.assignedIPs() {
+		if ip.Equal(released) {
+			t.Fatalf("Quarantined %s is listed as assigned", released)
+		}
+	}
+
+	// Releasing it again does not extend its quarantine.
+	pool.ReleaseIP(released, start.Add(30*time.Minute))
+	checkQuarantine(t, pool, map[string]time.Time{"10.1.0.2": start.Add(time.Hour)})
+
+	// Claiming it explicitly ends its quarantine, and the queue entry left
+	// behind does not free it once it is quarantined again.
+	if ip := pool.AssignIP(released, testMAC(5)); !ip.Equal(released) {
+		t.Fatalf("Explicit request for quarantined %s got %v", released, ip)
+	}
+	checkQuarantine(t, pool, map[string]time.Time{})
+	pool.ReleaseIP(released, start.Add(30*time.Minute))
+	pool.mtx.Lock()
+	pool.expireQuarantine(start.Add(time.Hour))
+	pool.mtx.Unlock()
+	checkQuarantine(t, pool, map[string]time.Time{"10.1.0.2": start.Add(90 * time.Minute)})
+
+	pool.mtx.Lock()
+	pool.expireQuarantine(start.Add(90 * time.Minute))
+	pool.mtx.Unlock()
+	checkQuarantine(t, pool, map[string]time.Time{})
+	if ip := pool.AssignIP(nil, testMAC(6)); !ip.Equal(released) {
+		t.Fatalf("Assigned %s after quarantine, expected %s", ip, released)
+	}
+}
+
+// Quarantine restored from the journal lasts from when the IP was released,
+// not from the restart.
+func TestReleaseQuarantineRestored(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := driver.RequestPool(&ipam.RequestPoolRequest{
+		AddressSpace: IPAMDefaultAddressSpaceLocal,
+		Pool:         "10.1.0.0/24",
+		Options:      map[string]string{PoolOptionReleaseQuarantine: "1h"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := driver.RequestAddress(&ipam.RequestAddressRequest{PoolID: pool.PoolID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, _, _ := net.ParseCIDR(address.Address)
+	if err := driver.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: ip.String()}); err != nil {
+		t.Fatal(err)
+	}
+	until := driver.ipam[pool.PoolID].quarantinedUntil[ip.String()]
+
+	// Restored from the journal's release entry, then from the snapshot
+	// compacted out of it.
+	for i := 0; i < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		driver = restartTestDriver(t, driver)
+		checkQuarantine(t, driver.ipam[pool.PoolID], map[string]time.Time{ip.String(): until})
+	}
+	if reassigned := driver.ipam[pool.PoolID].AssignIP(nil, nil); reassigned.Equal(ip) {
+		t.Fatalf("Restored quarantined %s was reassigned", ip)
+	}
+}
+
+func TestRoundRobinWraps(t *testing.T) {
+	pool := newTestPool(t, "10.1.0.0/29", AllocationRoundRobin)
+	for i := 1; i <= 6; i++ {
+		if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP(fmt.Sprintf("10.1.0.%d", i))) {
+			t.Fatalf("Address %d is %s", i, ip)
+		}
+	}
+	pool.ReleaseIP(net.ParseIP("10.1.0.5"), time.Now())
+	pool.ReleaseIP(net.ParseIP("10.1.0.2"), time.Now())
+
+	// Past the broadcast address, round to the network address, and on to
+	// the lowest free address after it.
+	if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP("10.1.0.2")) {
+		t.Fatalf("Assigned %s, expected 10.1.0.2", ip)
+	}
+	// Addresses freed behind the last one assigned wait their turn.
+	pool.ReleaseIP(net.ParseIP("10.1.0.1"), time.Now())
+	for _, expected := range []string{"10.1.0.5", "10.1.0.1"} {
+		if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("Assigned %s, expected %s", ip, expected)
+		}
+	}
+	if ip := pool.AssignIP(nil, nil); ip != nil {
+		t.Fatalf("Full pool assigned %s", ip)
+	}
+}
+
+func TestExcludedRangesSkipped(t *testing.T) {
+	// Ranges are jumped over to the address after them.
+	pool := newTestPoolWithOptions(t, "10.1.0.0/24", map[string]string{PoolOptionExcludedRanges: ".1-.20,.22-.30"})
+	for _, expected := range []string{"10.1.0.21", "10.1.0.31"} {
+		if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("Assigned %s, expected %s", ip, expected)
+		}
+	}
+	if ip := pool.AssignIP(net.ParseIP("10.1.0.10"), nil); ip != nil {
+		t.Fatalf("Explicit request assigned excluded %s", ip)
+	}
+
+	// Ranges at the top of the subpool wrap around to its start.
+	pool = newTestPoolWithOptions(t, "10.1.0.0/29", map[string]string{
+		PoolOptionAddressAllocation: AllocationRoundRobin,
+		PoolOptionExcludedRanges:    ".5-.7",
+	})
+	for i := 1; i <= 4; i++ {
+		pool.AssignIP(nil, nil)
+	}
+	pool.ReleaseIP(net.ParseIP("10.1.0.2"), time.Now())
+	if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP("10.1.0.2")) {
+		t.Fatalf("Assigned %s, expected 10.1.0.2", ip)
+	}
+
+	// Including at the top of a /64, whose last offset can't be stepped past.
+	pool = newTestPoolWithOptions(t, "fd00::/64", map[string]string{
+		PoolOptionAddressAllocation: AllocationRoundRobin,
+		PoolOptionExcludedRanges:    "fd00::ffff:ffff:ffff:0/112",
+	})
+	pool.AssignIP(net.ParseIP("fd00::ffff:ffff:fffe:ffff"), nil)
+	if ip := pool.AssignIP(nil, nil); !ip.Equal(net.ParseIP("fd00::1")) {
+		t.Fatalf("Assigned %s, expected fd00::1", ip)
+	}
+}
+
+// Pools give up looking for an address after maxAllocationProbes unusable
+// ones, such as reserved or bound addresses.
+func TestAllocationProbesGiveUp(t *testing.T) {
+	_, subpool, _ := net.ParseCIDR("10.1.0.0/19")
+	// Offsets 1 to n, given as options, e.g. r1=10.1.0.1
+	entries := func(n int, entry func(i int, ip net.IP) string) string {
+		pool := newTestPool(t, subpool.String(), AllocationSequential)
+		values := []string{}
+		for i := 1; i <= n; i++ {
+			values = append(values, entry(i, pool.addressAt(uint64(i))))
+		}
+		return strings.Join(values, ",")
+	}
+	reservation := func(i int, ip net.IP) string { return fmt.Sprintf("r%d=%s", i, ip) }
+	binding := func(i int, ip net.IP) string { return fmt.Sprintf("%s=%s", testMAC(i), ip) }
+
+	for _, test := range []struct {
+		option string
+		entry  func(i int, ip net.IP) string
+	}{
+		{PoolOptionReservations, reservation},
+		{PoolOptionMACBindings, binding},
+	} {
+		// The network address and the unusable addresses after it use up
+		// every probe but the last.
+		pool := newTestPoolWithOptions(t, subpool.String(), map[string]string{test.option: entries(maxAllocationProbes-2, test.entry)})
+		expected := pool.addressAt(maxAllocationProbes - 1)
+		if ip := pool.AssignIP(nil, nil); !ip.Equal(expected) {
+			t.Fatalf("%s: assigned %s, expected %s", test.option, ip, expected)
+		}
+
+		pool = newTestPoolWithOptions(t, subpool.String(), map[string]string{test.option: entries(maxAllocationProbes-1, test.entry)})
+		if ip := pool.AssignIP(nil, nil); ip != nil {
+			t.Fatalf("%s: assigned %s after %d probes", test.option, ip, maxAllocationProbes)
+		}
+		// Free addresses past the probes can still be requested.
+		past := pool.addressAt(maxAllocationProbes)
+		if ip := pool.AssignIP(past, nil); !ip.Equal(past) {
+			t.Fatalf("%s: explicit request for %s got %s", test.option, past, ip)
+		}
+	}
+}
+
+var defaultPoolTests = []struct {
+	ranges string
+	v6     bool
+	used   []string
+	// Subnet picked, or the error given
+	expected string
+	err      string
+}{
+	{"", false, nil, "", "No default address pools"},
+	{" , ", false, nil, "", "No default address pools"},
+	{"10.1.0.0/16", false, nil, "10.1.0.0/24", ""},
+	{"10.1.0.0/16", false, []string{"10.1.0.0/24", "10.1.2.0/24"}, "10.1.1.0/24", ""},
+	// A used /16 covers every subnet of the first range
+	{"10.2.0.0/15", false, []string{"10.2.0.0/16"}, "10.3.0.0/24", ""},
+	{"10.1.0.0/16,172.16.0.0/16", false, []string{"10.1.0.0/16"}, "172.16.0.0/24", ""},
+	// Used networks starting before the range
+	{"10.1.128.0/17", false, []string{"10.1.0.0/16"}, "", "No free subnets are left in the default address pools 10.1.128.0/17"},
+	{"10.1.0.0/16,172.16.0.0/16", false, []string{"10.0.0.0/8"}, "172.16.0.0/24", ""},
+	// Used networks outside the range, or of the other family
+	{"10.1.0.0/16", false, []string{"10.0.0.0/16", "10.2.0.0/16", "fd00::/8"}, "10.1.0.0/24", ""},
+	{"10.1.0.0/23", false, []string{"10.1.0.0/24", "10.1.1.0/24"}, "", "No free subnets are left in the default address pools 10.1.0.0/23"},
+	{"10.1.0.0/16,fd00::/48", true, []string{"fd00::/64"}, "fd00:0:0:1::/64", ""},
+	{"10.1.0.0/16", true, nil, "", "No default address pools"},
+	{"fd00::/48", false, nil, "", "No default address pools"},
+}
+
+func TestDefaultAddressPools(t *testing.T) {
+	for _, test := range defaultPoolTests {
+		name := fmt.Sprintf("%q v6=%v used %v", test.ranges, test.v6, test.used)
+		pools, err := ParseDefaultAddressPools(test.ranges, 24, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		used := []*net.IPNet{}
+		for _, cidr := range test.used {
+			_, n, _ := net.ParseCIDR(cidr)
+			used = append(used, n)
+		}
+
+		picked, err := pools.pick(test.v6, used)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: picked %v, %v, expected error %q", name, picked, err, test.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if picked.String() != test.expected {
+			t.Errorf("%s: picked %s, expected %s", name, picked, test.expected)
+		}
+	}
+}
+
+var defaultPoolSizeTests = []struct {
+	ranges string
+	sizeV4 int
+	sizeV6 int
+	err    string
+}{
+	{"10.1.0.0/16,fd00::/48", 24, 64, ""},
+	{"10.1.0.1/32", 32, 128, ""},
+	{"10.1.0.0/16", 0, 64, "IPv4 default pool size /0"},
+	{"10.1.0.0/16", 33, 64, "IPv4 default pool size /33"},
+	{"fd00::/48", 24, 0, "IPv6 default pool size /0"},
+	{"fd00::/48", 24, 129, "IPv6 default pool size /129"},
+	{"10.1.0.0/24", 16, 64, "10.1.0.0/24 is smaller than a /16 pool"},
+	{"fd00::/64", 24, 48, "fd00::/64 is smaller than a /48 pool"},
+	{"10.1.0.0", 24, 64, "\"10.1.0.0\" is not a CIDR network"},
+}
+
+func TestParseDefaultAddressPools(t *testing.T) {
+	for _, test := range defaultPoolSizeTests {
+		name := fmt.Sprintf("%q /%d /%d", test.ranges, test.sizeV4, test.sizeV6)
+		_, err := ParseDefaultAddressPools(test.ranges, test.sizeV4, test.sizeV6)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, expected %q", name, err, test.err)
+		}
+	}
+}
+
+func TestMACBindings(t *testing.T) {
+	bound := net.ParseIP("10.1.0.16")
+	pool := newTestPoolWithOptions(t, "10.1.0.0/24", map[string]string{
+		PoolOptionMACBindings: fmt.Sprintf("%s=%s", testMAC(1), bound),
+	})
+
+	// Only the bound MAC address gets the IP, even when requesting it.
+	for _, mac := range []net.HardwareAddr{nil, testMAC(2)} {
+		if ip := pool.AssignIP(bound, mac); ip != nil {
+			t.Fatalf("Explicit request from %v was assigned bound %s", mac, ip)
+		}
+	}
+	if ip := pool.AssignIP(nil, testMAC(2)); ip.Equal(bound) {
+		t.Fatalf("%s was assigned bound %s", testMAC(2), ip)
+	}
+	if ip := pool.AssignIP(bound, testMAC(1)); !ip.Equal(bound) {
+		t.Fatalf("Explicit request from %s got %s, expected %s", testMAC(1), ip, bound)
+	}
+	pool.ReleaseIP(bound, time.Now())
+	if ip := pool.AssignIP(nil, testMAC(1)); !ip.Equal(bound) {
+		t.Fatalf("%s was assigned %s, expected %s", testMAC(1), ip, bound)
+	}
+}
+
+func TestStickyAddresses(t *testing.T) {
+	pool := newTestPoolWithOptions(t, "10.1.0.0/24", map[string]string{
+		PoolOptionStickyAddresses:   "true",
+		PoolOptionReleaseQuarantine: "1h",
+	})
+	sticky := pool.AssignIP(nil, testMAC(1))
+	pool.ReleaseIP(sticky, time.Now())
+
+	// The quarantined IP is kept from others, but reissued to its MAC address.
+	if ip := pool.AssignIP(nil, testMAC(2)); ip.Equal(sticky) {
+		t.Fatalf("%s was assigned quarantined %s", testMAC(2), ip)
+	}
+	if ip := pool.AssignIP(nil, testMAC(1)); !ip.Equal(sticky) {
+		t.Fatalf("%s was assigned %s, expected %s", testMAC(1), ip, sticky)
+	}
+	checkQuarantine(t, pool, map[string]time.Time{})
+
+	// Once another endpoint has the IP, the MAC address gets a new one.
+	pool.FreeIP(sticky)
+	if ip := pool.AssignIP(sticky, testMAC(3)); !ip.Equal(sticky) {
+		t.Fatalf("Explicit request for %s got %s", sticky, ip)
+	}
+	if ip := pool.AssignIP(nil, testMAC(1)); ip == nil || ip.Equal(sticky) {
+		t.Fatalf("%s was assigned %s, which %s has", testMAC(1), ip, testMAC(3))
+	}
+}
+
+// The IP last assigned to each MAC address is restored from the journal.
+func TestStickyAddressesRestored(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := driver.RequestPool(&ipam.RequestPoolRequest{
+		AddressSpace: IPAMDefaultAddressSpaceLocal,
+		Pool:         "10.1.0.0/24",
+		Options:      map[string]string{PoolOptionStickyAddresses: "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both addresses are released, so without stickiness the second MAC
+	// address would get the first one's back.
+	addresses := []string{}
+	for i := 1; i <= 2; i++ {
+		address, err := driver.RequestAddress(&ipam.RequestAddressRequest{
+			PoolID:  pool.PoolID,
+			Options: map[string]string{netlabel.MacAddress: testMAC(i).String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, _, _ := net.ParseCIDR(address.Address)
+		addresses = append(addresses, ip.String())
+	}
+	for _, address := range addresses {
+		if err := driver.ReleaseAddress(&ipam.ReleaseAddressRequest{PoolID: pool.PoolID, Address: address}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restored from the journal's assign entries, then from the snapshot
+	// compacted out of them.
+	for i := 0; i < 2; i++ {
+		driver = restartTestDriver(t, driver)
+		restored := driver.ipam[pool.PoolID]
+		if ip := restored.AssignIP(nil, testMAC(2)); ip == nil || ip.String() != addresses[1] {
+			t.Fatalf("Restart %d: %s was assigned %s, expected %s", i+1, testMAC(2), ip, addresses[1])
+		}
+		restored.FreeIP(net.ParseIP(addresses[1]))
+	}
+}
@@ -40,6 +40,8 @@ func NewLogWriter(logFunc func(args ...interface{})) io.Writer {
 }
 
 func (this *LogWriter) Write(p []byte) (n int, err error) {
-	this.lineIn <- p // Send all writes to ingress channel
+	// Send all writes to ingress channel. Writers may not keep p, so it is
+	// copied for the goroutine.
+	this.lineIn <- append([]byte(nil), p...)
 	return len(p), nil
 }
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 	"strings"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/go-plugins-helpers/network"
@@ -16,7 +17,10 @@ import (
 	"github.com/wrouesnel/docker-vde-plugin/fsutil"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"github.com/docker/go-plugins-helpers/sdk"
+	"net"
+	"net/http"
 	"net/url"
+	"path/filepath"
 	"runtime"
 )
 
@@ -28,9 +32,38 @@ const (
 func main() {
 	dockerPluginPath := kingpin.Flag("docker-net-plugins", "Listen path for the plugin.").Default("unix:///run/docker/plugins/vde.sock,unix:///run/docker/plugins/vde-ipam.sock").String()
 	socketRoot := kingpin.Flag("socket-root", "Path where networks and sockets should be created").Default("/run/docker-vde-plugin").String()
+	socketRootMode := kingpin.Flag("socket-root-mode", "Octal permissions the socket root is created with.").Default("0755").String()
+	dockerHost := kingpin.Flag("docker-host", "Docker daemon API address used to resolve network and container names.").Default("unix:///var/run/docker.sock").String()
+	adminSocket := kingpin.Flag("admin-socket", "Path of the unix socket serving the admin API. Empty to disable.").Default("/run/docker-vde-plugin-admin.sock").String()
+	metricsListen := kingpin.Flag("metrics-listen", "Addresses to serve Prometheus metrics on, e.g. tcp://0.0.0.0:9532. Empty to disable.").Default("").String()
+	adminSocketGroup := kingpin.Flag("admin-socket-group", "Group allowed to use the admin API. By default only root can.").Default("").String()
+	shutdownPolicy := kingpin.Flag("shutdown-policy", "What to do with networks on exit. \"teardown\" stops switches and removes taps and sockets, \"preserve\" leaves them running to be re-adopted on restart.").Default(ShutdownPolicyTeardown).Enum(ShutdownPolicyTeardown, ShutdownPolicyPreserve)
+	defaultAddressPools := kingpin.Flag("default-address-pools", "Comma separated networks subnets are carved from for IPAM pools requested without one.").Default("10.223.0.0/16,fd76:6465::/48").String()
+	defaultPoolSize := kingpin.Flag("default-pool-size", "Prefix length of IPv4 subnets carved from the default address pools.").Default("24").Int()
+	defaultPoolSizeV6 := kingpin.Flag("default-pool-size-v6", "Prefix length of IPv6 subnets carved from the default address pools.").Default("64").Int()
+	addressSpaces := kingpin.Flag("address-spaces", "Comma separated name=policy IPAM address spaces, where policy is allow or deny overlapping pools. The local and global spaces allow overlaps unless given.").Default("").String()
+	localAddressSpace := kingpin.Flag("local-address-space", "Default IPAM address space of local networks.").Default(IPAMDefaultAddressSpaceLocal).String()
+	globalAddressSpace := kingpin.Flag("global-address-space", "Default IPAM address space of global networks.").Default(IPAMDefaultAddressSpaceGlobal).String()
+	requestTimeout := kingpin.Flag("request-timeout", "Maximum time host commands run for a single plugin request may take. Keep below docker's plugin request timeout.").Default("25s").Duration()
+	ipamReplayWindow := kingpin.Flag("ipam-replay-window", "How long after starting docker may replay its IPAM requests. Restored pools not requested again by then are released, unless a network uses them.").Default("5m").Duration()
+	shutdownTimeout := kingpin.Flag("shutdown-timeout", "Maximum time to spend applying the shutdown policy.").Default("30s").Duration()
+	stateFile := kingpin.Flag("state-file", "Where network state is persisted by the preserve shutdown policy. Defaults to state.json in the socket root.").Default("").String()
+	configFile := kingpin.Flag("config", "YAML file of predefined switches to run. Reloaded on SIGHUP.").Default("").String()
 	loglevel := kingpin.Flag("log-level", "Logging Level").Default("info").String()
 	logformat := kingpin.Flag("log-format", "If set use a syslog logger or JSON logging. Example: logger:syslog?appname=bob&local=7 or logger:stdout?json=true. Defaults to stderr.").Default("stderr").String()
-	kingpin.Parse()
+	daemonCmd := kingpin.Command("daemon", "Run the plugin daemon.").Default()
+	clientCmds := registerClientCommands()
+	command := kingpin.Parse()
+
+	flag.Set("log.level", *loglevel)
+	flag.Set("log.format", *logformat)
+
+	if command != daemonCmd.FullCommand() {
+		if err := clientCmds.Run(command, *adminSocket); err != nil {
+			kingpin.Fatalf("%v", err)
+		}
+		os.Exit(0)
+	}
 
 	exitCh := make(chan int)
 	sigCh := make(chan os.Signal, 1)
@@ -67,28 +100,86 @@ func main() {
 		"dpipe",
 	)
 
-	flag.Set("log.level", *loglevel)
-	flag.Set("log.format", *logformat)
-
+	rootMode, err := parseFileMode(*socketRootMode)
+	if err != nil {
+		log.Panicln("Invalid socket-root-mode:", err)
+	}
 	if !fsutil.PathExists(*socketRoot) {
-		err := os.MkdirAll(*socketRoot, os.FileMode(0777))
+		err := os.MkdirAll(*socketRoot, rootMode)
+		if err == nil {
+			// MkdirAll is subject to the umask
+			err = os.Chmod(*socketRoot, rootMode)
+		}
 		if err != nil {
 			log.Panicln("socket-root does not exist.")
 		}
 	} else if !fsutil.PathIsDir(*socketRoot) {
 		log.Panicln("socket-root exists but is not a directory.")
+	} else if st, err := os.Stat(*socketRoot); err == nil && st.Mode()&0022 != 0 && st.Mode()&os.ModeSticky == 0 {
+		log.Warnln("socket-root is writable by other users, who can replace switch sockets:", *socketRoot)
 	}
 
 	log.Infoln("VDE default socket directories:", *socketRoot)
 	log.Infoln("Docker Plugin Path:", *dockerPluginPath)
 
-	driver := NewVDENetworkDriver(*socketRoot)
+	if *stateFile == "" {
+		*stateFile = filepath.Join(*socketRoot, "state.json")
+	}
+
+	names, err := LoadNameIndex(*socketRoot)
+	if err != nil {
+		log.Panicln("Could not load name index:", err)
+	}
+
+	defaultPools, err := ParseDefaultAddressPools(*defaultAddressPools, *defaultPoolSize, *defaultPoolSizeV6)
+	if err != nil {
+		log.Panicln("Invalid default address pools:", err)
+	}
+
+	spaces, err := ParseAddressSpaces(*addressSpaces, *localAddressSpace, *globalAddressSpace)
+	if err != nil {
+		log.Panicln("Invalid address spaces:", err)
+	}
+
+	switches := NewSwitchManager()
+	driver := NewVDENetworkDriver(*socketRoot, switches, names, *requestTimeout, defaultPools, spaces)
+	if err := driver.RestoreIPAM(); err != nil {
+		log.Panicln("Could not load IPAM journal:", err)
+	}
+
+	// Processes started from here on outlive the plugin if they are to be
+	// preserved.
+	detachChildProcesses = *shutdownPolicy == ShutdownPolicyPreserve
+
+	// Predefined switches are started first so preserved networks using them
+	// can be reconnected. Switches preserved along with them are adopted.
+	if *configFile != "" {
+		config, err := LoadConfig(*configFile, *socketRoot)
+		if err != nil {
+			log.Panicln("Could not load config file:", err)
+		}
+		switches.Apply(config, driver.SocketDirInUse)
+	}
+
 	ipamDriver := &IPAMDriver{driver}
 
+	// Re-adopt networks preserved by a previous instance, whatever the
+	// current policy.
+	if err := driver.RestoreState(*stateFile); err != nil {
+		log.Errorln("Could not restore preserved networks:", err)
+	}
+	time.AfterFunc(*ipamReplayWindow, driver.ExpireReplays)
+
+	resolver, err := NewDockerResolver(*dockerHost)
+	if err != nil {
+		log.Panicln("Could not parse docker host address:", err)
+	}
+	scenarios := NewScenarioRunner(driver, resolver)
+
 	handler := sdk.NewHandler()
 
 	network.InitMux(handler, driver)
-	ipam.InitMux(handler, ipamDriver)
+	ipam.InitMux(ipamMux{handler, ipamDriver}, ipamDriver)
 
 	// For the time being we only support serving on a unix-host since cross-
 	// host or remote support doesn't make sense.
@@ -116,9 +207,13 @@ func main() {
 	//	log.Panicln("Could not convert gid to integer:", u.Gid, err)
 	//}
 
+	// Sockets passed in by systemd are used in preference to binding our own,
+	// so docker can connect before the plugin has started.
+	activated := NewActivatedListeners()
+
 	// Handle listening on multiple addresses to work around docker 1.13
 	// multihost bug.
-	listeners, err := multihttp.Listen(listenAddrs, handler)
+	activatedListeners, listeners, err := activated.Listen(listenAddrs, InstrumentHandler(handler))
 	// Don't block if we were already cleaning up safely.
 	go func() {
 		if err != nil {
@@ -127,11 +222,91 @@ func main() {
 		}
 	}()
 
+	// Serve the admin API on its own socket so it can't be reached by anything
+	// which can talk to docker plugins.
+	var adminListeners []net.Listener
+	if *adminSocket != "" {
+		log.Infoln("Admin API Path:", *adminSocket)
+		var adminErr error
+		adminHandler := NewAdminHandler(driver, resolver, scenarios)
+		if l := activated.Take("unix://" + *adminSocket); l != nil {
+			// Permissions are up to the socket unit.
+			go http.Serve(l, adminHandler)
+			activatedListeners = append(activatedListeners, l)
+		} else {
+			adminListeners, adminErr = ListenAdmin(*adminSocket, *adminSocketGroup, adminHandler)
+		}
+		go func() {
+			if adminErr != nil {
+				log.Errorln("Failed to start admin API listener:", adminErr)
+				exitCh <- 1
+			}
+		}()
+	}
+
+	var metricsListeners []net.Listener
+	if *metricsListen != "" {
+		log.Infoln("Metrics Path:", *metricsListen)
+		var metricsErr error
+		var l []net.Listener
+		l, metricsListeners, metricsErr = activated.Listen(strings.Split(*metricsListen, ","), NewMetricsHandler(driver))
+		activatedListeners = append(activatedListeners, l...)
+		go func() {
+			if metricsErr != nil {
+				log.Errorln("Failed to start metrics listener:", metricsErr)
+				exitCh <- 1
+			}
+		}()
+	}
+
+	activated.CloseUnused()
+
+	if err := sdNotify(sdNotifyReady); err != nil {
+		log.Warnln("Failed to notify systemd of readiness:", err)
+	}
+	// The watchdog is only fed while the driver can take its locks.
+	startWatchdog(func() {
+		driver.ListNetworks()
+	})
+
+	// Reload predefined switches on SIGHUP
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for _ = range sigHup {
+			if *configFile == "" {
+				continue
+			}
+			log.Infoln("Reloading config file:", *configFile)
+			config, err := LoadConfig(*configFile, *socketRoot)
+			if err != nil {
+				log.Errorln("Could not reload config file, keeping current switches:", err)
+				continue
+			}
+			switches.Apply(config, driver.SocketDirInUse)
+		}
+	}()
+
 	// Wait to exit.
 	exitCode := <- exitCh
+	sdNotify(sdNotifyStopping)
 	for _, l := range listeners {
 		l.Close()
 	}
+	// Activated sockets belong to systemd, so they're closed but not removed.
+	for _, l := range activatedListeners {
+		l.Close()
+	}
+	multihttp.CloseAndCleanUpListeners(adminListeners)
+	multihttp.CloseAndCleanUpListeners(metricsListeners)
+
+	if err := driver.Shutdown(*shutdownPolicy, *stateFile, *shutdownTimeout); err != nil {
+		log.Errorln("Error shutting down:", err)
+		exitCode = 1
+	}
+	if *shutdownPolicy != ShutdownPolicyPreserve {
+		switches.StopAll()
+	}
 
 	os.Exit(exitCode)
 }
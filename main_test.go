@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Host commands the driver runs are replaced by scripts which log their
+// command line to $FAKE_COMMAND_LOG, and fail if it contains
+// $FAKE_COMMAND_FAIL. Long running vde tools wait for their stdin to close.
+var fakeCommands = map[string]string{
+	"ip":           "",
+	"vde_switch":   "exec cat >/dev/null\n",
+	"vde_plug2tap": "exec cat >/dev/null\n",
+	"dpipe":        "exec cat >/dev/null\n",
+}
+
+// Directory of the fake commands
+var fakeCommandDir string
+
+const fakeCommandPrologue = `#!/bin/sh
+line="$(basename "$0") $*"
+if [ -n "$FAKE_COMMAND_LOG" ]; then
+	echo "$line" >> "$FAKE_COMMAND_LOG"
+fi
+if [ -n "$FAKE_COMMAND_FAIL" ]; then
+	case "$line" in
+	*"$FAKE_COMMAND_FAIL"*)
+		echo "injected failure" >&2
+		exit 1
+		;;
+	esac
+fi
+`
+
+func TestMain(m *testing.M) {
+	binDir, err := ioutil.TempDir("", "vde-plugin-test-bin")
+	if err != nil {
+		panic(err)
+	}
+	fakeCommandDir = binDir
+	for name, body := range fakeCommands {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte(fakeCommandPrologue+body), os.FileMode(0755)); err != nil {
+			panic(err)
+		}
+	}
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	code := m.Run()
+	os.RemoveAll(binDir)
+	os.Exit(code)
+}
+
+// Returns a driver with its socket root in a temporary directory, and a
+// function removing it again.
+func newTestDriver(t testing.TB) (*VDENetworkDriver, func()) {
+	socketRoot, err := ioutil.TempDir("", "vde-plugin-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := LoadNameIndex(socketRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultPools, err := ParseDefaultAddressPools("10.223.0.0/16,fd76:6465::/48", 24, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spaces, err := ParseAddressSpaces("strict=deny", IPAMDefaultAddressSpaceLocal, IPAMDefaultAddressSpaceGlobal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := NewVDENetworkDriver(socketRoot, NewSwitchManager(), names, time.Second*10, defaultPools, spaces)
+	return driver, func() {
+		driver.Teardown(context.Background())
+		os.RemoveAll(socketRoot)
+	}
+}
+
+// Logs host commands run until the returned function is called, which
+// returns them. Commands matching fail fail.
+func recordCommands(t testing.TB, fail string) func() []string {
+	logFile, err := ioutil.TempFile("", "vde-plugin-test-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	os.Setenv("FAKE_COMMAND_LOG", logFile.Name())
+	os.Setenv("FAKE_COMMAND_FAIL", fail)
+
+	return func() []string {
+		os.Unsetenv("FAKE_COMMAND_LOG")
+		os.Unsetenv("FAKE_COMMAND_FAIL")
+		defer os.Remove(logFile.Name())
+		data, err := ioutil.ReadFile(logFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+// Makes a fake command impossible to start until the returned function is
+// called.
+func breakCommand(t testing.TB, name string) func() {
+	path := filepath.Join(fakeCommandDir, name)
+	if err := os.Chmod(path, os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chmod(path, os.FileMode(0755))
+	}
+}
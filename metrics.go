@@ -0,0 +1,418 @@
+// metrics exposes plugin health in the Prometheus text exposition format.
+// Counters are updated by instrumentation in the drivers, while gauges and
+// switch port counters are collected from the driver state on each scrape.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+)
+
+// Process names used as metric labels
+const (
+	processSwitch string = "vde_switch"
+	processPlug   string = "vde_plug2tap"
+)
+
+// Error types used as metric labels
+const (
+	errorSwitchStart      string = "switch_start"
+	errorPlugStart        string = "plug_start"
+	errorTapDevice        string = "tap_device"
+	errorAddressExhausted string = "address_exhausted"
+	errorAdminRequest     string = "admin_request"
+)
+
+// Buckets of the request duration histogram, in seconds
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	metricProcessStarts = newCounterVec("vde_plugin_process_starts_total",
+		"Number of vde_switch and vde_plug2tap processes started.", "process")
+	metricProcessRestarts = newCounterVec("vde_plugin_process_restarts_total",
+		"Number of vde_switch and vde_plug2tap processes restarted by the plugin.", "process")
+	metricProcessExits = newCounterVec("vde_plugin_process_exits_total",
+		"Number of vde_switch and vde_plug2tap processes which exited, by whether the plugin stopped them.", "process", "expected")
+	metricRequests = newCounterVec("vde_plugin_requests_total",
+		"Number of docker plugin API requests.", "method")
+	metricRequestErrors = newCounterVec("vde_plugin_request_errors_total",
+		"Number of docker plugin API requests which returned an error.", "method")
+	metricRequestDuration = newHistogramVec("vde_plugin_request_duration_seconds",
+		"Latency of docker plugin API requests.", requestDurationBuckets, "method")
+	metricErrors = newCounterVec("vde_plugin_errors_total",
+		"Number of internal errors by type.", "type")
+)
+
+// All instrumented metrics, in exposition order
+var registeredMetrics = []metricWriter{
+	metricProcessStarts,
+	metricProcessRestarts,
+	metricProcessExits,
+	metricRequests,
+	metricRequestErrors,
+	metricRequestDuration,
+	metricErrors,
+}
+
+type metricWriter interface {
+	write(w io.Writer)
+}
+
+// Label values are joined with a byte which can't appear in them to form map
+// keys.
+const labelSeparator = "\xff"
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Format a label set. extra holds additional name/value pairs.
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mtx    sync.Mutex
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (this *counterVec) Inc(labelValues ...string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+func (this *counterVec) write(w io.Writer) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	writeHeader(w, this.name, this.help, "counter")
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", this.name,
+			formatLabels(this.labels, strings.Split(key, labelSeparator)), formatValue(this.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+	mtx     sync.Mutex
+}
+
+type histogram struct {
+	// Non-cumulative counts per bucket
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (this *histogramVec) Observe(v float64, labelValues ...string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	key := strings.Join(labelValues, labelSeparator)
+	h, found := this.values[key]
+	if !found {
+		h = &histogram{counts: make([]uint64, len(this.buckets))}
+		this.values[key] = h
+	}
+	for i, bound := range this.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (this *histogramVec) write(w io.Writer) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	writeHeader(w, this.name, this.help, "histogram")
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := this.values[key]
+		labelValues := strings.Split(key, labelSeparator)
+		var cumulative uint64
+		for i, bound := range this.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.name,
+				formatLabels(this.labels, labelValues, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.name,
+			formatLabels(this.labels, labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.name, formatLabels(this.labels, labelValues), formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.name, formatLabels(this.labels, labelValues), h.count)
+	}
+}
+
+// A single sample of a metric collected at scrape time
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func writeSamples(w io.Writer, name string, help string, metricType string, labels []string, samples []sample) {
+	writeHeader(w, name, help, metricType)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labels), formatValue(s.value))
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusRecorder) WriteHeader(status int) {
+	this.status = status
+	this.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentHandler wraps the docker plugin API handler to count requests,
+// errors and latencies per method (e.g. "NetworkDriver.Join").
+func InstrumentHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler.ServeHTTP(recorder, r)
+
+		// Don't let unknown paths create arbitrary label values
+		method := strings.TrimPrefix(r.URL.Path, "/")
+		if recorder.status == http.StatusNotFound {
+			method = "unknown"
+		}
+		metricRequests.Inc(method)
+		metricRequestDuration.Observe(time.Since(start).Seconds(), method)
+		if recorder.status != http.StatusOK {
+			metricRequestErrors.Inc(method)
+		}
+	})
+}
+
+// NewMetricsHandler returns an http.Handler serving the metrics of the driver
+// on /metrics.
+func NewMetricsHandler(driver *VDENetworkDriver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		buf := new(bytes.Buffer)
+		for _, metric := range registeredMetrics {
+			metric.write(buf)
+		}
+		writeDriverMetrics(buf, driver)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+	return mux
+}
+
+// Write gauges describing the current networks, endpoints and pools, and the
+// port counters of each switch.
+func writeDriverMetrics(w io.Writer, driver *VDENetworkDriver) {
+	networks := driver.ListNetworks()
+
+	networkSamples := []sample{}
+	endpointSamples := []sample{}
+	for _, network := range networks {
+		running := 0.0
+		if network.Running {
+			running = 1
+		}
+		networkSamples = append(networkSamples, sample{[]string{shortId(network.NetworkID)}, running})
+
+		joined := 0.0
+		for _, endpoint := range network.Endpoints {
+			if endpoint.PlugPID != 0 {
+				joined++
+			}
+		}
+		endpointSamples = append(endpointSamples,
+			sample{[]string{shortId(network.NetworkID), "false"}, float64(len(network.Endpoints)) - joined},
+			sample{[]string{shortId(network.NetworkID), "true"}, joined})
+	}
+	writeSamples(w, "vde_plugin_networks", "Number of networks.", "gauge", nil,
+		[]sample{{nil, float64(len(networks))}})
+	writeSamples(w, "vde_plugin_network_switch_up", "Whether the vde_switch of a network is running.",
+		"gauge", []string{"network"}, networkSamples)
+	writeSamples(w, "vde_plugin_endpoints", "Number of endpoints per network, by whether a container has joined.",
+		"gauge", []string{"network", "joined"}, endpointSamples)
+
+	sizeSamples := []sample{}
+	allocatedSamples := []sample{}
+	for _, pool := range driver.ListPools() {
+		labels := []string{pool.PoolID, pool.Pool}
+		sizeSamples = append(sizeSamples, sample{labels, pool.Size})
+		allocatedSamples = append(allocatedSamples, sample{labels, float64(len(pool.Allocated))})
+	}
+	writeSamples(w, "vde_plugin_ipam_pool_size", "Number of assignable addresses in an IPAM pool.",
+		"gauge", []string{"pool_id", "pool"}, sizeSamples)
+	writeSamples(w, "vde_plugin_ipam_pool_allocated", "Number of allocated addresses in an IPAM pool.",
+		"gauge", []string{"pool_id", "pool"}, allocatedSamples)
+
+	packetSamples := []sample{}
+	byteSamples := []sample{}
+	for _, network := range networks {
+		if !network.Managed || !network.Running {
+			continue
+		}
+		ports, err := switchPortCounters(network.ManagementSocket)
+		if err != nil {
+			log.With("NetworkID", network.NetworkID).Debugln("Could not read switch port counters:", err)
+			continue
+		}
+		// Name ports after the endpoint whose plug is connected to them
+		endpointPids := make(map[int]string)
+		for _, endpoint := range network.Endpoints {
+			if endpoint.PlugPID != 0 {
+				endpointPids[endpoint.PlugPID] = shortId(endpoint.EndpointID)
+			}
+		}
+		for _, port := range ports {
+			if !port.counted {
+				continue
+			}
+			for _, dir := range []struct {
+				name    string
+				packets float64
+				bytes   float64
+			}{{"in", port.inPackets, port.inBytes}, {"out", port.outPackets, port.outBytes}} {
+				labels := []string{shortId(network.NetworkID), port.port, endpointPids[port.pid], dir.name}
+				packetSamples = append(packetSamples, sample{labels, dir.packets})
+				byteSamples = append(byteSamples, sample{labels, dir.bytes})
+			}
+		}
+	}
+	portLabels := []string{"network", "port", "endpoint", "direction"}
+	writeSamples(w, "vde_plugin_switch_port_packets_total", "Packets passed through a vde_switch port.",
+		"counter", portLabels, packetSamples)
+	writeSamples(w, "vde_plugin_switch_port_bytes_total", "Bytes passed through a vde_switch port.",
+		"counter", portLabels, byteSamples)
+}
+
+// Traffic counters of a vde_switch port
+type portCounters struct {
+	port string
+	pid  int
+	// False if the switch did not report counters for the port
+	counted    bool
+	inPackets  float64
+	inBytes    float64
+	outPackets float64
+	outBytes   float64
+}
+
+var (
+	portLineRegex    = regexp.MustCompile(`^Port\s+(\d+)`)
+	counterLineRegex = regexp.MustCompile(`^\s*(IN|OUT):\s+pkts\s+(\d+)\s+bytes\s+(\d+)`)
+	pidRegex         = regexp.MustCompile(`PID=(\d+)`)
+)
+
+// Read the port counters of a switch from its management socket. Switches
+// built without port counters report none.
+func switchPortCounters(mgmtSock string) ([]*portCounters, error) {
+	mgmt, err := DialVDEManagement(mgmtSock)
+	if err != nil {
+		return nil, err
+	}
+	defer mgmt.Close()
+
+	lines, err := mgmt.Command("port/allprint")
+	if err != nil {
+		return nil, err
+	}
+
+	ports := []*portCounters{}
+	var current *portCounters
+	for _, line := range lines {
+		if m := portLineRegex.FindStringSubmatch(line); m != nil {
+			current = &portCounters{port: m[1]}
+			ports = append(ports, current)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if m := counterLineRegex.FindStringSubmatch(line); m != nil {
+			packets, _ := strconv.ParseFloat(m[2], 64)
+			bytes, _ := strconv.ParseFloat(m[3], 64)
+			current.counted = true
+			if m[1] == "IN" {
+				current.inPackets, current.inBytes = packets, bytes
+			} else {
+				current.outPackets, current.outBytes = packets, bytes
+			}
+		} else if m := pidRegex.FindStringSubmatch(line); m != nil && current.pid == 0 {
+			current.pid, _ = strconv.Atoi(m[1])
+		}
+	}
+	return ports, nil
+}
@@ -0,0 +1,262 @@
+// naming allocates the socket directory and tap device names of networks and
+// endpoints. Names are unique, fit the kernel's length limits, and are
+// recorded in an index under the socket root so they survive plugin restarts.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+)
+
+// File the name index is kept in under the socket root
+const nameIndexFile string = "names.json"
+
+// Longest path a unix socket can be bound to (sun_path less the terminator)
+const maxUnixSocketPathLength = 107
+
+// Longest name vde_plug gives the sockets it creates in a switch socket
+// directory ("/.<pid>-<port>" with a 7 digit pid).
+const vdePortSocketNameLength = 15
+
+// Length of the ID prefix used for names, matching the docker CLI
+const namePrefixLength = 12
+
+// Longest generated socket directory name
+const maxNetworkNameLength = 16
+
+// Names users may give socket directories
+var switchNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// NameIndex records the names allocated to networks and endpoints.
+type NameIndex struct {
+	path string
+	// Socket directory names under the socket root by network ID
+	Networks map[string]string `json:"networks"`
+	// Tap device names by endpoint ID
+	Interfaces map[string]string `json:"interfaces"`
+	mtx        sync.Mutex
+}
+
+// LoadNameIndex reads the name index under socketRoot, or starts an empty one.
+func LoadNameIndex(socketRoot string) (*NameIndex, error) {
+	this := &NameIndex{
+		path:       filepath.Join(socketRoot, nameIndexFile),
+		Networks:   make(map[string]string),
+		Interfaces: make(map[string]string),
+	}
+
+	data, err := ioutil.ReadFile(this.path)
+	if os.IsNotExist(err) {
+		return this, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, this); err != nil {
+		return nil, errors.New(fmt.Sprintln("Could not parse name index:", err))
+	}
+	if this.Networks == nil {
+		this.Networks = make(map[string]string)
+	}
+	if this.Interfaces == nil {
+		this.Interfaces = make(map[string]string)
+	}
+	return this, nil
+}
+
+// Write the index atomically. Caller must hold mtx.
+func (this *NameIndex) save() error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := this.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.path)
+}
+
+// AllocateSocketDir returns the socket directory for a network under the
+// socket root. name is used if given, otherwise a name is derived from the
+// network ID. Allocating again for the same network returns the same path.
+func (this *NameIndex) AllocateSocketDir(networkId string, name string) (string, error) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	socketRoot := filepath.Dir(this.path)
+	if existing, found := this.Networks[networkId]; found {
+		return filepath.Join(socketRoot, existing), nil
+	}
+
+	taken := func(candidate string) bool {
+		for _, used := range this.Networks {
+			if used == candidate {
+				return true
+			}
+		}
+		path := filepath.Join(socketRoot, candidate)
+		return candidate == nameIndexFile || fsutil.PathExists(path) || fsutil.PathExists(path+managementSocketSuffix)
+	}
+
+	var candidate string
+	if name != "" {
+		if !switchNamePattern.MatchString(name) {
+			return "", errors.New(fmt.Sprintf("Switch name %q may only contain letters, digits, _, . and -", name))
+		}
+		if taken(name) {
+			return "", errors.New(fmt.Sprintf("Switch name %q is already in use", name))
+		}
+		candidate = name
+	} else {
+		candidate = uniqueName(networkId, "", namePrefixLength, maxNetworkNameLength, taken)
+		if candidate == "" {
+			return "", errors.New("Could not find a free socket directory name for network")
+		}
+	}
+
+	sockDir := filepath.Join(socketRoot, candidate)
+	if err := checkSocketDirLength(sockDir); err != nil {
+		return "", err
+	}
+
+	this.Networks[networkId] = candidate
+	if err := this.save(); err != nil {
+		delete(this.Networks, networkId)
+		return "", errors.New(fmt.Sprintln("Could not save name index:", err))
+	}
+	return sockDir, nil
+}
+
+// AllocateInterface returns the tap device name for an endpoint. Allocating
+// again for the same endpoint returns the same name.
+func (this *NameIndex) AllocateInterface(endpointId string) (string, error) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if existing, found := this.Interfaces[endpointId]; found {
+		return existing, nil
+	}
+
+	taken := func(candidate string) bool {
+		for _, used := range this.Interfaces {
+			if used == candidate {
+				return true
+			}
+		}
+		return fsutil.PathExists(filepath.Join("/sys/class/net", candidate))
+	}
+
+	// The 11 character prefix older versions of the plugin used is tried
+	// first, so names stay the same where possible.
+	name := uniqueName(endpointId, InterfacePrefix, namePrefixLength-1, maxInterfaceNameLength-len(InterfacePrefix), taken)
+	if name == "" {
+		return "", errors.New("Could not find a free tap device name for endpoint")
+	}
+
+	this.Interfaces[endpointId] = name
+	if err := this.save(); err != nil {
+		delete(this.Interfaces, endpointId)
+		return "", errors.New(fmt.Sprintln("Could not save name index:", err))
+	}
+	return name, nil
+}
+
+// ReleaseSocketDir forgets the socket directory name of a network.
+func (this *NameIndex) ReleaseSocketDir(networkId string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.release(this.Networks, networkId)
+}
+
+// ReleaseInterface forgets the tap device name of an endpoint.
+func (this *NameIndex) ReleaseInterface(endpointId string) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	this.release(this.Interfaces, endpointId)
+}
+
+// ReleaseInterfaceName forgets an allocated tap device by name. Returns false
+// if the index did not allocate it.
+func (this *NameIndex) ReleaseInterfaceName(name string) bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for endpointId, used := range this.Interfaces {
+		if used == name {
+			this.release(this.Interfaces, endpointId)
+			return true
+		}
+	}
+	return false
+}
+
+// Caller must hold mtx.
+func (this *NameIndex) release(names map[string]string, id string) {
+	if _, found := names[id]; !found {
+		return
+	}
+	delete(names, id)
+	if err := this.save(); err != nil {
+		log.With("ID", id).Errorln("Could not save name index:", err)
+	}
+}
+
+// IsInterface returns true if the index allocated the named tap device.
+func (this *NameIndex) IsInterface(name string) bool {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for _, used := range this.Interfaces {
+		if used == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick a name from the shortest free prefix of id between minLength and
+// maxLength characters. If those are all taken, a counter replaces the end of
+// the longest one. Returns "" if nothing is free.
+func uniqueName(id string, prefix string, minLength int, maxLength int, taken func(string) bool) string {
+	for l := minLength; l <= maxLength && l <= len(id); l++ {
+		if candidate := prefix + id[:l]; !taken(candidate) {
+			return candidate
+		}
+	}
+
+	// IDs are hex, so a counter can't clash with a plain ID prefix.
+	base := id
+	if len(base) > maxLength-4 {
+		base = base[:maxLength-4]
+	}
+	for i := 0; i < 0x1000; i++ {
+		if candidate := fmt.Sprintf("%s%s_%03x", prefix, base, i); !taken(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// checkSocketDirLength checks the sockets of a switch at sockDir can be bound.
+func checkSocketDirLength(sockDir string) error {
+	longest := len(sockDir) + vdePortSocketNameLength
+	if l := len(sockDir) + len(managementSocketSuffix); l > longest {
+		longest = l
+	}
+	if longest > maxUnixSocketPathLength {
+		return errors.New(fmt.Sprintf("Socket directory %s is too long for unix sockets, it must be at most %d characters",
+			sockDir, maxUnixSocketPathLength-vdePortSocketNameLength))
+	}
+	return nil
+}
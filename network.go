@@ -1,27 +1,62 @@
 package main
 
 import (
+	"context"
 	"os/exec"
 
+	"github.com/wrouesnel/go.log"
+
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
 )
 
+// Time to wait for vde_switch to clean up its sockets when stopping it before
+// it is killed.
+const VdeSwitchStopTimeout time.Duration = time.Second * 5
+
 type VDENetworkDesc struct {
 	sockDir  string
 	mgmtSock string
 	mgmtPipe io.WriteCloser
 	// vde_switch process
 	switchp *exec.Cmd
+	// Command line used to start vde_switch. nil if the switch is not under
+	// our control.
+	switchArgs []string
+	// User to hand the socket directory and sockets to. 0 to leave them to root.
+	socketOwnerUid int
 	// Channel for vde_switch Wait() call
 	switchpCh <-chan error
-	// IPAM data for this network
+	// Set while the plugin is stopping the switch. Accessed atomically.
+	switchStopping int32
+	// IPAM data for this network. Pools of the plugin's IPAM driver are
+	// shared with it.
 	pool4 []*IPAMNetworkPool
 	pool6 []*IPAMNetworkPool
+	// IDs of the shared IPAM driver pools
+	poolIds map[*IPAMNetworkPool]string
 	// Currently executed vde_plug2tap processes
 	networkEndpoints VDENetworkEndpoints
-	// Mutex for networkEndpoints
+	// Administratively disabled switch ("all cables unplugged")
+	linkDown bool
+	// Fingerprint of the CreateNetwork request, to recognize retries
+	createRequest string
+	// Set once the network is deleted or failed to be created. Operations
+	// which were waiting for the lock must give up.
+	removed bool
+	// Held for writing to change the switch or the set of endpoints, and for
+	// reading (plus the endpoint lock) to operate on a single endpoint.
 	mtx sync.RWMutex
 }
 
@@ -42,6 +77,152 @@ func (this *VDENetworkDesc) IsRunning() bool {
 	return true
 }
 
+// Start the vde_switch process for the network with the stored arguments.
+func (this *VDENetworkDesc) startSwitch() error {
+	log := log.With("SocketDir", this.sockDir)
+
+	atomic.StoreInt32(&this.switchStopping, 0)
+	cmd, mgmtPipe, stderr, err := startChildProcess("vde_switch", this.switchArgs...)
+	if err != nil {
+		log.Errorln("Error starting vde_switch:", err)
+		metricErrors.Inc(errorSwitchStart)
+		return errors.New(fmt.Sprint("Error starting vde_switch for network: ", err))
+	}
+	metricProcessStarts.Inc(processSwitch)
+
+	// Spawn a goroutine to wait for the switch to exit. The channel is
+	// buffered and closed so we never block the process from exiting.
+	cmdErrCh := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		log.Infoln("vde_switch process has exited:", err)
+		expected := atomic.LoadInt32(&this.switchStopping) == 1
+		metricProcessExits.Inc(processSwitch, strconv.FormatBool(expected))
+		cmdErrCh <- err
+		close(cmdErrCh)
+	}()
+	// Start the VDE switch grace period.
+	<- time.After(VdeSwitchGracePeriod)
+	select {
+	case err := <- cmdErrCh:
+		if err == nil {
+			err = errors.New("exited during start-up")
+		}
+		execErr := fsutil.NewExecError(cmd.Args, err, stderr())
+		log.Errorln("vde_switch exited during start-up:", execErr)
+		metricErrors.Inc(errorSwitchStart)
+		return errors.New(fmt.Sprint("Error starting vde_switch for network: ", execErr))
+	default: // Do nothing - process still up.
+		log.Debugln("vde_switch still up after grace-period.")
+	}
+
+	this.switchp = cmd
+	this.switchpCh = cmdErrCh
+	this.mgmtPipe = mgmtPipe
+
+	if err := this.chownSockets(); err != nil {
+		log.Errorln("Error changing owner of switch sockets:", err)
+		this.stopSwitch()
+		return errors.New("Error changing owner of vde_switch sockets for network.")
+	}
+	return nil
+}
+
+// Hand the socket directory, control socket and management socket of a
+// freshly started switch to the socket owner. vde_switch has no option for
+// it, and sockets it creates for later connections stay owned by root.
+func (this *VDENetworkDesc) chownSockets() error {
+	if this.socketOwnerUid == 0 {
+		return nil
+	}
+
+	ctlSock := filepath.Join(this.sockDir, "ctl")
+	deadline := time.Now().Add(managementSocketWait)
+	for !fsutil.PathIsSocket(ctlSock) || !fsutil.PathIsSocket(this.mgmtSock) {
+		if time.Now().After(deadline) {
+			return errors.New("vde_switch did not create its sockets")
+		}
+		time.Sleep(VdeSwitchGracePeriod)
+	}
+
+	for _, path := range []string{this.sockDir, ctlSock, this.mgmtSock} {
+		if err := os.Chown(path, this.socketOwnerUid, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Supervise an already running vde_switch left behind by a previous instance
+// of the plugin.
+func (this *VDENetworkDesc) adoptSwitch(pid int) {
+	atomic.StoreInt32(&this.switchStopping, 0)
+	this.switchp, this.switchpCh = adoptProcess(pid, func() {
+		log.With("SocketDir", this.sockDir).Infoln("vde_switch process has exited")
+		expected := atomic.LoadInt32(&this.switchStopping) == 1
+		metricProcessExits.Inc(processSwitch, strconv.FormatBool(expected))
+	})
+}
+
+// Stop the vde_switch process if we're in control of it. The switch is asked
+// to exit cleanly first so it removes its sockets, and killed if it doesn't.
+func (this *VDENetworkDesc) stopSwitch() {
+	if this.mgmtPipe != nil {
+		this.mgmtPipe.Close()
+		this.mgmtPipe = nil
+	}
+
+	if this.switchp == nil {
+		return
+	}
+
+	atomic.StoreInt32(&this.switchStopping, 1)
+	this.switchp.Process.Signal(syscall.SIGTERM)
+	select {
+	case <- this.switchpCh:
+	case <- time.After(VdeSwitchStopTimeout):
+		log.With("SocketDir", this.sockDir).Warnln("vde_switch did not exit cleanly, killing it.")
+		this.switchp.Process.Kill()
+		<- this.switchpCh
+	}
+	this.switchp = nil
+	this.switchpCh = nil
+}
+
+// Restart the vde_switch process and reconnect all joined endpoints to it.
+// Caller must hold the write lock.
+func (this *VDENetworkDesc) restartSwitch(ctx context.Context) error {
+	if this.switchArgs == nil {
+		return errors.New("vde_switch for network is not managed by the plugin")
+	}
+
+	this.stopSwitch()
+	if err := this.startSwitch(); err != nil {
+		return err
+	}
+	metricProcessRestarts.Inc(processSwitch)
+
+	var lastErr error
+	for endpointId, endpoint := range this.networkEndpoints {
+		if endpoint.tapPlugCmd == nil {
+			continue
+		}
+		log := log.With("EndpointID", endpointId)
+		if err := endpoint.replug(ctx, this.sockDir); err != nil {
+			log.Errorln("Error reconnecting endpoint to restarted switch:", err)
+			lastErr = err
+			continue
+		}
+		if this.linkDown || endpoint.linkDown {
+			if err := endpoint.applyLinkState(ctx, true); err != nil {
+				log.Errorln("Error disabling link of reconnected endpoint:", err)
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
 // For a given IP, find a suitable gateway IP in the current network. Return nil
 // if nothing suitable is found.
 func (this *VDENetworkDesc) GetGateway(ip net.IP) net.IP {
@@ -57,16 +238,74 @@ func (this *VDENetworkDesc) GetGateway(ip net.IP) net.IP {
 	// Check if our IP is contained in the subpool
 	for _, subpool := range searchPool {
 		if subpool.pool.Contains(ip) {
-			return subpool.gateway
+			return subpool.GetGateway(ip)
 		}
 	}
 
 	return nil
 }
 
-func (this *VDENetworkDesc) EndpointExists(endpointId string) bool {
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	_, found := this.networkEndpoints[endpointId]
-	return found
+// Unlink the network from the IPAM driver pools it shares.
+func (this *VDENetworkDesc) unlinkPools(networkId string) {
+	for pool := range this.poolIds {
+		pool.unlinkNetwork(networkId)
+	}
+}
+
+// Set the administrative link state of the whole network. Endpoints which
+// were individually disabled stay down when the network is brought back up.
+// Caller must hold the write lock.
+func (this *VDENetworkDesc) setLinkState(ctx context.Context, up bool) error {
+	this.linkDown = !up
+	var lastErr error
+	for endpointId, endpoint := range this.networkEndpoints {
+		if err := endpoint.applyLinkState(ctx, this.linkDown || endpoint.linkDown); err != nil {
+			log.With("EndpointID", endpointId).Errorln("Error applying link state:", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Set the administrative link state of a single endpoint. Caller must hold
+// the write lock.
+func (this *VDENetworkDesc) setEndpointLinkState(ctx context.Context, endpointId string, up bool) error {
+	endpoint, found := this.networkEndpoints[endpointId]
+	if !found {
+		return errors.New("Endpoint does not exist")
+	}
+	endpoint.linkDown = !up
+	return endpoint.applyLinkState(ctx, this.linkDown || endpoint.linkDown)
+}
+
+// Returns the link state string for the network
+func (this *VDENetworkDesc) GetLinkState() string {
+	if this.linkDown {
+		return LinkStateDown
+	}
+	return LinkStateUp
+}
+
+// Returns a snapshot of the network state for the admin API. Caller must hold
+// the read lock.
+func (this *VDENetworkDesc) info(networkId string) AdminNetworkInfo {
+	info := AdminNetworkInfo{
+		NetworkID:        networkId,
+		SocketDir:        this.sockDir,
+		ManagementSocket: this.mgmtSock,
+		Managed:          this.switchArgs != nil,
+		Running:          this.IsRunning(),
+		LinkState:        this.GetLinkState(),
+		Endpoints:        make([]AdminEndpointInfo, 0, len(this.networkEndpoints)),
+	}
+	if this.switchp != nil {
+		info.SwitchPID = this.switchp.Process.Pid
+	}
+	for _, pool := range append(append([]*IPAMNetworkPool{}, this.pool4...), this.pool6...) {
+		info.Pools = append(info.Pools, pool.info(this.poolIds[pool]))
+	}
+	for endpointId, endpoint := range this.networkEndpoints {
+		info.Endpoints = append(info.Endpoints, endpoint.info(endpointId, this.linkDown))
+	}
+	return info
 }
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"os/exec"
 
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/wrouesnel/go.log"
 
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -16,6 +16,7 @@ import (
 
 	"github.com/wrouesnel/docker-vde-plugin/fsutil"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,24 +24,6 @@ const (
 	InterfacePrefix string = "vde"
 )
 
-// Option parameters we recognize for networks
-const (
-	// Specifies an existing VDE switch to associate with a network
-	NetworkOptionSwitchSocket string = "socket_dir"
-	// Specifies the existing VDE switches management socket.
-	// Can be left out (management options will not work from the driver)
-	NetworkOptionSwitchManagementSocket string = "management_socket"
-	// Specifies that if the supplied sockets do not exist, they should be
-	// used as the paths for a new vde_switch for the network.
-	NetworkOptionsAllowCreate string = "create_sockets"
-	// Specify the group owner for the created socket.
-	NetworkOptionsSocketGroup string = "socket_group"
-	// Specify the number of switch ports (default is 32)
-	NetworkOptionsNumSwitchports string = "num_switchports"
-	// Specify a path or network to link to this network
-	NetworkOptionsJoinNetwork string = "join_network"
-)
-
 const NetworkDefaultNumSwitchports int64 = 32
 
 // vde_switch might just fail on startup. Since we need to hand control back to
@@ -55,35 +38,119 @@ type VDENetworkDriver struct {
 	// Currently managed networks
 	networks map[string]*VDENetworkDesc
 	// IPAM data - docker isolates IPAM, but since pool ranges will target
-	// matching networks we just need to do some separate tracking. It does
-	// mean in practice we store this information twice.
+	// matching networks we just need to do some separate tracking. Networks
+	// share the pools their address data came from.
 	ipam map[string]*IPAMNetworkPool
-	// Protect ipam. Hold read-lock when updating pools.
+	// Journal of changes to ipam. nil if not persisted.
+	ipamJournal *IPAMJournal
+	// Protect ipam. Requests which add, remove or link pools, or set their
+	// gateway, hold the write-lock, so changes are journalled in order.
+	// Address requests only change their pool, and hold the read-lock. Each
+	// pool has its own lock, which keeps its changes in order.
 	ipamMtx  sync.RWMutex
-
+	// PoolID each gateway was last requested from, by address space, subnet
+	// and gateway. Docker requests the gateway of a pool just before
+	// creating the network using it. Only used under the write-lock of
+	// ipamMtx.
+	gatewayPools map[string]string
+	// Ranges pools requested without a subnet are carved from
+	defaultPools *DefaultAddressPools
+	// Address spaces pools can be requested in
+	addressSpaces *AddressSpaces
+	// Predefined switches networks can refer to by name
+	switches *SwitchManager
+	// Socket directory and tap device names
+	names *NameIndex
+	// Longest time host commands run by a request may take
+	requestTimeout time.Duration
+
+	// Protect the networks map only. Each network has its own lock, which is
+	// never acquired while holding this one.
 	mtx      sync.RWMutex
 }
 
-// Consistently shorten a network ID to something manageable by vde_switch,
-// which has problems with the very long path names generated.
-func shortenNetworkId(networkId string) string {
-	// vde_switch has an internal limit on the length of this name from the
-	// command line it seems. Base64 encoding isn't really enough to beat it,
-	// so we truncate to docker cli length for convenience and ensure our own
-	// commands can handle conflicts.
-	return networkId[:12]
-}
-
-func (this *VDENetworkDriver) getNetworkSocketDirName(networkId string) string {
-	ctlDirName := filepath.Join(this.socketRoot, shortenNetworkId(networkId))
-	return ctlDirName
+// Get a network without locking it.
+func (this *VDENetworkDriver) getNetwork(networkId string) (*VDENetworkDesc, bool) {
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+	vdeNetwork, found := this.networks[networkId]
+	return vdeNetwork, found
 }
 
-func (this *VDENetworkDriver) networkExists(networkId string) bool {
+// Snapshot the managed networks. Networks in the snapshot may be removed
+// before they are locked, so callers must check removed.
+func (this *VDENetworkDriver) listNetworks() map[string]*VDENetworkDesc {
 	this.mtx.RLock()
 	defer this.mtx.RUnlock()
-	_, found := this.networks[networkId]
-	return found
+	networks := make(map[string]*VDENetworkDesc, len(this.networks))
+	for networkId, vdeNetwork := range this.networks {
+		networks[networkId] = vdeNetwork
+	}
+	return networks
+}
+
+// Add a new network. Fails if the network ID is already in use.
+func (this *VDENetworkDriver) addNetwork(networkId string, vdeNetwork *VDENetworkDesc) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if _, found := this.networks[networkId]; found {
+		return errors.New("Network already exists.")
+	}
+	this.networks[networkId] = vdeNetwork
+	return nil
+}
+
+// Remove a network. The caller must hold the network's write lock.
+func (this *VDENetworkDriver) removeNetwork(networkId string, vdeNetwork *VDENetworkDesc) {
+	vdeNetwork.removed = true
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	if this.networks[networkId] == vdeNetwork {
+		delete(this.networks, networkId)
+	}
+}
+
+// Write-lock a network. The caller must unlock it.
+func (this *VDENetworkDriver) lockNetwork(networkId string) (*VDENetworkDesc, error) {
+	vdeNetwork, found := this.getNetwork(networkId)
+	if !found {
+		return nil, errors.New("Network does not exist")
+	}
+	vdeNetwork.mtx.Lock()
+	if vdeNetwork.removed {
+		vdeNetwork.mtx.Unlock()
+		return nil, errors.New("Network does not exist")
+	}
+	return vdeNetwork, nil
+}
+
+// Lock a single endpoint, holding its network for reading so other endpoints
+// can be worked on in parallel. The returned function unlocks both.
+func (this *VDENetworkDriver) lockEndpoint(networkId string, endpointId string) (*VDENetworkDesc, *VDENetworkEndpoint, func(), error) {
+	vdeNetwork, found := this.getNetwork(networkId)
+	if !found {
+		return nil, nil, nil, errors.New("Network does not exist")
+	}
+	vdeNetwork.mtx.RLock()
+	if vdeNetwork.removed {
+		vdeNetwork.mtx.RUnlock()
+		return nil, nil, nil, errors.New("Network does not exist")
+	}
+	vdeEndpoint, found := vdeNetwork.networkEndpoints[endpointId]
+	if !found {
+		vdeNetwork.mtx.RUnlock()
+		return nil, nil, nil, errors.New("Endpoint does not exist")
+	}
+	vdeEndpoint.mtx.Lock()
+	return vdeNetwork, vdeEndpoint, func() {
+		vdeEndpoint.mtx.Unlock()
+		vdeNetwork.mtx.RUnlock()
+	}, nil
+}
+
+// Context bounding the host commands of a single request.
+func (this *VDENetworkDriver) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), this.requestTimeout)
 }
 
 func (this *VDENetworkDriver) GetCapabilities() (*network.CapabilitiesResponse, error) {
@@ -143,62 +210,92 @@ func (this *VDENetworkDriver) CreateNetwork(req *network.CreateNetworkRequest) e
 		netOptionsLogs = netOptionsLogs.With(k, v)
 	}
 	netOptionsLogs.Debugln("Network options")
-	// Check our state at a high level to see if we can make a new network.
-	if this.networkExists(req.NetworkID) {
-		return errors.New("Network already exists.")
+	// Docker retries requests which timed out, so an existing network is
+	// only an error if it was created with different parameters.
+	fingerprint := requestFingerprint(req.Options, req.IPv4Data, req.IPv6Data)
+	if _, found := this.getNetwork(req.NetworkID); found {
+		return this.retryCreateNetwork(req.NetworkID, fingerprint)
 	}
 
-	// Parse network creation options
-	var socketName string
-	var managementSocketName string
-	var createSockets string
-	var socketGroup string
-	var numSwitchPortsStr string
-	//var joinNetwork string // TODO
-
-	if req.Options != nil {
-		if req.Options["com.docker.network.generic"] != nil {
-			dockerCliOptions := req.Options["com.docker.network.generic"].(map[string]interface{})
-			socketName, _ = dockerCliOptions[NetworkOptionSwitchSocket].(string)
-			managementSocketName, _ = dockerCliOptions[NetworkOptionSwitchManagementSocket].(string)
-			createSockets, _ = dockerCliOptions[NetworkOptionsAllowCreate].(string)
-			socketGroup, _ = dockerCliOptions[NetworkOptionsSocketGroup].(string)
-			numSwitchPortsStr, _ = dockerCliOptions[NetworkOptionsNumSwitchports].(string)
-			//joinNetwork, _ = dockerCliOptions[NetworkOptionsJoinNetwork].(string)
+	options, err := ParseNetworkOptions(req.Options)
+	if err != nil {
+		return err
+	}
+	socketName := options.SocketDir
+	managementSocketName := options.ManagementSocket
+	createSockets := options.CreateSockets
+
+	log.Debugln("Using vde_switch size:", options.NumSwitchports)
+
+	// Refer to predefined switches by name
+	if sockDir, mgmtSock, found := this.switches.Lookup(socketName); found {
+		// Switch options need create_sockets, which predefined switches take
+		// from the config file instead.
+		if createSockets {
+			return errors.New(fmt.Sprintf("Option create_sockets cannot be used with predefined switch %s", socketName))
 		}
+		log.Infoln("Using predefined switch:", socketName)
+		socketName = sockDir
+		if managementSocketName == "" {
+			managementSocketName = mgmtSock
+		}
+	} else if socketName != "" && !filepath.IsAbs(socketName) {
+		return errors.New(fmt.Sprintf("Option socket_dir must be an absolute path or the name of a predefined switch, got %q", socketName))
 	}
 
-	pool4 := make([]*IPAMNetworkPool, 0)
-	pool6 := make([]*IPAMNetworkPool, 0)
+	// Reserve the network ID before doing anything slow, so concurrent
+	// duplicate requests fail straight away and requests for the network wait
+	// until it is ready.
+	network := &VDENetworkDesc{
+		pool4:            make([]*IPAMNetworkPool, 0),
+		pool6:            make([]*IPAMNetworkPool, 0),
+		poolIds:          make(map[*IPAMNetworkPool]string),
+		networkEndpoints: make(VDENetworkEndpoints),
+		createRequest:    fingerprint,
+	}
+	network.mtx.Lock()
+	defer network.mtx.Unlock()
+	if err := this.addNetwork(req.NetworkID, network); err != nil {
+		// A concurrent request for the network got there first
+		return this.retryCreateNetwork(req.NetworkID, fingerprint)
+	}
 
-	// Parse network IP data.
+	// Every step from here on is undone if a later one fails. Deferred after
+	// the unlock, so it runs first.
+	undo := newUndoStack(log, this.requestTimeout)
+	defer undo.Rollback()
+	undo.Push("remove network", func(ctx context.Context) error {
+		this.removeNetwork(req.NetworkID, network)
+		return nil
+	})
+
+	// Parse network IP data, sharing the pools of our IPAM driver so
+	// gateways and assignments are the same on both sides.
+	undo.Push("unlink IPAM pools", func(ctx context.Context) error {
+		network.unlinkPools(req.NetworkID)
+		return nil
+	})
 	for _, ipampool := range req.IPv4Data {
-		driverPool, err := NewIPAMNetworkPool(ipampool)
+		poolId, driverPool, err := this.linkPool(req.NetworkID, ipampool)
 		if err != nil {
 			return err
 		}
-		pool4 = append(pool4, driverPool)
+		network.pool4 = append(network.pool4, driverPool)
+		if poolId != "" {
+			network.poolIds[driverPool] = poolId
+		}
 	}
 
 	for _, ipampool := range req.IPv6Data {
-		driverPool, err := NewIPAMNetworkPool(ipampool)
+		poolId, driverPool, err := this.linkPool(req.NetworkID, ipampool)
 		if err != nil {
 			return err
 		}
-		pool6 = append(pool6, driverPool)
-	}
-
-	numSwitchports := NetworkDefaultNumSwitchports
-	{
-		var err error
-		if numSwitchPortsStr != "" {
-			numSwitchports, err = strconv.ParseInt(numSwitchPortsStr, 10, 32)
-			if err != nil {
-				return errors.New(fmt.Sprintf("Unparseable number of switch ports requested: %v %v", numSwitchPortsStr, err))
-			}
+		network.pool6 = append(network.pool6, driverPool)
+		if poolId != "" {
+			network.poolIds[driverPool] = poolId
 		}
 	}
-	log.Debugln("Using vde_switch size:", numSwitchports)
 
 	// There's a few options here:
 	// - make a socket in the default location
@@ -206,19 +303,19 @@ func (this *VDENetworkDriver) CreateNetwork(req *network.CreateNetworkRequest) e
 	// - create a socket in a specified location
 
 	if socketName == "" {
-		incrementNumber := 0
-		baseSocketName := this.getNetworkSocketDirName(req.NetworkID)
-		socketName = baseSocketName
-		for fsutil.PathExists(socketName) {
-			socketName = baseSocketName + fmt.Sprintf("_%d", incrementNumber)
-			log.Debugln("Truncated networkID exists, trying a new suffix:", socketName)
-			incrementNumber++
+		socketName, err = this.names.AllocateSocketDir(req.NetworkID, options.SwitchName)
+		if err != nil {
+			return err
 		}
+		undo.Push("release socket directory name", func(ctx context.Context) error {
+			this.names.ReleaseSocketDir(req.NetworkID)
+			return nil
+		})
 		log.Infoln("Creating new vde_switch with socket path:", socketName)
 		// Force create_sockets to true
-		createSockets = "true"
-		managementSocketName = socketName + ".mgmt.sock"
-	} else if socketName != "" && createSockets == "" {
+		createSockets = true
+		managementSocketName = socketName + managementSocketSuffix
+	} else if socketName != "" && !createSockets {
 		// Check the existing socket is a directory with a ctl socket in it
 		if !fsutil.PathIsDir(socketName) {
 			log.Errorln("Existing socket directory for network switch does not exist:", socketName)
@@ -237,107 +334,117 @@ func (this *VDENetworkDriver) CreateNetwork(req *network.CreateNetworkRequest) e
 	} else {
 		// Generate a management socket name if one wasn't specified
 		if managementSocketName == "" {
-			managementSocketName = socketName + ".mgmt.sock"
+			managementSocketName = socketName + managementSocketSuffix
+		}
+		if err := checkSocketDirLength(socketName); err != nil {
+			return err
 		}
 		log.Infoln("Creating new vde_switch with given socket path:", socketName)
 	}
 
-	var cmd *exec.Cmd
-	var mgmtPipe io.WriteCloser
-	var cmdErrCh chan error
-	if createSockets != "" {
-		var err error
+	// Stash the network info
+	network.sockDir = socketName
+	network.mgmtSock = managementSocketName
+
+	if createSockets {
 		// Check the base-path for the network exists, otherwise VDE will fail.
 		// This happens when using deep-paths with docker-compose and is a
-		// little surprising when it does. We don't clean this up afterwards,
-		// since you should've realized what you were asking.
+		// little surprising when it does. We don't clean this up when the
+		// network is deleted, since you should've realized what you were
+		// asking.
 		socketRoot := filepath.Dir(socketName)
-		if fsutil.PathNotExist(socketRoot) {
-			if err := os.MkdirAll(socketRoot, os.FileMode(0755)); err != nil {
-				return errors.New("Socket root directory did not exist, and couldn't make it.")
-			}
+		createdDir, err := fsutil.MkdirAllCreated(socketRoot, os.FileMode(0755))
+		if err != nil {
+			return errors.New(fmt.Sprint("Socket root directory did not exist, and couldn't make it: ", err))
+		}
+		if createdDir != "" {
+			undo.Push("remove created socket root directory", func(ctx context.Context) error {
+				// Only directories we made, and only if nothing else appeared in them
+				for dir := socketRoot; ; dir = filepath.Dir(dir) {
+					if err := os.Remove(dir); err != nil {
+						return err
+					}
+					if dir == createdDir {
+						return nil
+					}
+				}
+			})
 		}
 
 		// Start the VDE switch for the new network
-		cmdArgs := []string{
+		network.switchArgs = []string{
 			"--sock", socketName,
 			"--mgmt", managementSocketName,
-			"--numports", fmt.Sprintf("%v", numSwitchports),
+			"--numports", fmt.Sprintf("%v", options.NumSwitchports),
 		}
 
 		// If group specified, add it
-		if socketGroup != "" {
-			cmdArgs = append(cmdArgs, "--group", socketGroup)
+		if options.SocketGroup != "" {
+			network.switchArgs = append(network.switchArgs, "--group", options.SocketGroup)
 		}
+		if options.SocketMode != 0 {
+			network.switchArgs = append(network.switchArgs, "--mode", fmt.Sprintf("%04o", options.SocketMode))
+		}
+		if options.ManagementSocketGroup != "" {
+			network.switchArgs = append(network.switchArgs, "--mgmtgroup", options.ManagementSocketGroup)
+		}
+		if options.ManagementSocketMode != 0 {
+			network.switchArgs = append(network.switchArgs, "--mgmtmode", fmt.Sprintf("%04o", options.ManagementSocketMode))
+		}
+		network.socketOwnerUid = options.SocketOwnerUid
 
-		cmd := fsutil.LoggedCommand("vde_switch", cmdArgs...)
-		mgmtPipe, err = cmd.StdinPipe()
-		if err != nil {
-			return errors.New("Error setting up stdin pipe for vde_switch.")
-		}
-		if err := cmd.Start(); err != nil {
-			return errors.New("Error starting vde_switch for network.")
-		}
-
-		// Spawn a goroutine to wait for the switch to exit.
-		cmdErrCh = make(chan error)
-		go func() {
-			cmdErrCh <- cmd.Wait()
-			close(cmdErrCh)
-			log.Infoln("vde_switch process has exited.")
-		}()
-		// Start the VDE switch grace period.
-		<- time.After(VdeSwitchGracePeriod)
-		select {
-		case <- cmdErrCh:
-			return errors.New("Error starting vde_switch for network. Use --log-level debug to look for errors.")
-		default: // Do nothing - process still up.
-			log.Debugln("vde_switch still up after grace-period.")
-		}
-
-		// We need to consume the error in order to allow the process to
-		// actually exit later on.
-		go func() {
-			// TODO: if the process *does* exit early, it might be an idea to
-			// delete the network from our knowledge. But we have no path to
-			// inform docker this is happening.
-			err := <- cmdErrCh
-			log.Debugln("vde_switch exited from Wait():", err)
-		}()
-	}
-
-	// Stash the network info
-	network := VDENetworkDesc{
-		sockDir:          socketName,
-		mgmtSock:         managementSocketName,
-		mgmtPipe:         mgmtPipe,
-		switchp:          cmd,
-		switchpCh:		  cmdErrCh,
-		pool4:            pool4,
-		pool6:            pool6,
-		networkEndpoints: make(VDENetworkEndpoints),
+		if err := network.startSwitch(); err != nil {
+			return err
+		}
+		undo.Push("stop vde_switch", func(ctx context.Context) error {
+			network.stopSwitch()
+			if err := os.RemoveAll(network.sockDir); err != nil {
+				return err
+			}
+			if err := os.Remove(network.mgmtSock); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
 	}
 
-	// Add the network
-	this.mtx.Lock()
-	defer this.mtx.Unlock()
-	this.networks[req.NetworkID] = &network
+	undo.Commit()
 	log.With(NetworkOptionSwitchSocket, socketName).
 		With(NetworkOptionSwitchManagementSocket, managementSocketName).
 		Infoln("Created new network")
 	return nil
 }
 
-func (this *VDENetworkDriver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
-	log.With("NetworkID", req.NetworkID).Infoln("DeleteNetwork request received")
+// Handle a CreateNetwork request for a network which already exists. Waits
+// for the network to finish being created. Repeating the request which created
+// it succeeds, anything else is a conflict.
+func (this *VDENetworkDriver) retryCreateNetwork(networkId string, fingerprint string) error {
+	vdeNetwork, err := this.lockNetwork(networkId)
+	if err != nil {
+		return err
+	}
+	defer vdeNetwork.mtx.Unlock()
 
-	if !this.networkExists(req.NetworkID) {
-		return errors.New("Network does not exist.")
+	// Networks restored from older state files don't record their request
+	if vdeNetwork.createRequest != "" && vdeNetwork.createRequest != fingerprint {
+		return errors.New("Network already exists with different parameters.")
 	}
+	log.With("NetworkID", networkId).Infoln("Network already exists, treating request as a retry")
+	return nil
+}
 
-	this.mtx.Lock()
-	defer this.mtx.Unlock()
-	network, _ := this.networks[req.NetworkID]
+func (this *VDENetworkDriver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
+	log := log.With("NetworkID", req.NetworkID)
+	log.Infoln("DeleteNetwork request received")
+
+	// lockNetwork only fails if the network does not exist, in which case
+	// this is a retry of a request which already deleted it.
+	network, err := this.lockNetwork(req.NetworkID)
+	if err != nil {
+		log.Warnln("Network does not exist, treating request as a retry")
+		return nil
+	}
+	defer network.mtx.Unlock()
 
 	// Check that all endpoints have been removed
 	if len(network.networkEndpoints) > 0 {
@@ -345,18 +452,15 @@ func (this *VDENetworkDriver) DeleteNetwork(req *network.DeleteNetworkRequest) e
 	}
 
 	// Kill the vde_switch process if we're in control of it.
-	if network.mgmtPipe != nil {
-		network.mgmtPipe.Close()
-	}
-
 	if network.switchp != nil {
-		network.switchp.Process.Kill()
-		network.switchp.Wait()
+		network.stopSwitch()
 		// Delete socket directories only if we controlled the process to start with
 		os.RemoveAll(network.sockDir)
 		os.Remove(network.mgmtSock)
 	}
-	delete(this.networks, req.NetworkID)
+	this.removeNetwork(req.NetworkID, network)
+	network.unlinkPools(req.NetworkID)
+	this.names.ReleaseSocketDir(req.NetworkID)
 
 	return nil
 }
@@ -375,21 +479,32 @@ func (this *VDENetworkDriver) CreateEndpoint(req *network.CreateEndpointRequest)
 			Infoln("CreateEndpoint request received")
 	}
 
-	if !this.networkExists(req.NetworkID) {
-		return nil, errors.New("Network does not exist")
+	options, err := ParseEndpointOptions(req.Options)
+	if err != nil {
+		return nil, err
 	}
-	// Grab the network and hold onto it till we finish.
-	// This is so no-one deletes it while we're setting up an endpoint.
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	vdeNetwork, _ := this.networks[req.NetworkID]
-	// Check if the endpoint already exists
-	if vdeNetwork.EndpointExists(req.EndpointID) {
-		return nil, errors.New("Endpoint already exists")
+
+	// Creating an endpoint runs no host commands, so the network is held
+	// for writing throughout.
+	vdeNetwork, err := this.lockNetwork(req.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+	defer vdeNetwork.mtx.Unlock()
+
+	// A retry of the request which created the endpoint gets the same
+	// response.
+	fingerprint := requestFingerprint(req.Interface, req.Options)
+	if endpoint, found := vdeNetwork.networkEndpoints[req.EndpointID]; found {
+		if endpoint.createRequest != "" && endpoint.createRequest != fingerprint {
+			return nil, errors.New("Endpoint already exists with different parameters")
+		}
+		log.Infoln("Endpoint already exists, treating request as a retry")
+		return createEndpointResponse(req, endpoint), nil
 	}
 
 	// Start instantiating a new endpoint
-	endpoint := &VDENetworkEndpoint{}
+	endpoint := &VDENetworkEndpoint{linkDown: options.LinkDown, createRequest: fingerprint}
 
 	if req.Interface.Address != "" {
 		ip, net, err := net.ParseCIDR(req.Interface.Address)
@@ -434,11 +549,13 @@ func (this *VDENetworkDriver) CreateEndpoint(req *network.CreateEndpointRequest)
 	log.Debugln("Endpoint IPv6 Gateway:", endpoint.gateway.String())
 
 	// Add the endpoint to the network
-	vdeNetwork.mtx.Lock()
-	defer vdeNetwork.mtx.Unlock()
 	vdeNetwork.networkEndpoints[req.EndpointID] = endpoint
 
-	// Construct a response
+	return createEndpointResponse(req, endpoint), nil
+}
+
+// Construct the response to a CreateEndpoint request.
+func createEndpointResponse(req *network.CreateEndpointRequest, endpoint *VDENetworkEndpoint) *network.CreateEndpointResponse {
 	resp := &network.CreateEndpointResponse{}
 	if req.Interface == nil {
 		resp.Interface = &network.EndpointInterface{}
@@ -446,52 +563,49 @@ func (this *VDENetworkDriver) CreateEndpoint(req *network.CreateEndpointRequest)
 		resp.Interface.AddressIPv6 = endpoint.GetIPv6CIDRAddress()
 		resp.Interface.MacAddress = endpoint.GetMACAddress()
 	}
-
-	return resp, nil
+	return resp
 }
 
 func (this *VDENetworkDriver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
-	if !this.networkExists(req.NetworkID) {
-		return errors.New("Network does not exist")
+	// Remove the endpoint from the network first, so the network is only
+	// held for writing briefly, then clean it up. Nothing else can reach the
+	// endpoint once it is removed.
+	// A missing network or endpoint means this is a retry of a request
+	// which already deleted it.
+	vdeNetwork, err := this.lockNetwork(req.NetworkID)
+	if err != nil {
+		log.With("NetworkID", req.NetworkID).Warnln("Network does not exist, treating request as a retry")
+		return nil
 	}
-	// Grab the network and hold onto it till we finish. This is so no-one deletes it while we're setting up an endpoint.
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	vdeNetwork, _ := this.networks[req.NetworkID]
-	// Check the endpoint exists
-	if !vdeNetwork.EndpointExists(req.EndpointID) {
-		return errors.New("Endpoint does not exist")
+	vdeEndpoint, found := vdeNetwork.networkEndpoints[req.EndpointID]
+	if !found {
+		vdeNetwork.mtx.Unlock()
+		log.With("EndpointID", req.EndpointID).Warnln("Endpoint does not exist, treating request as a retry")
+		return nil
 	}
-	// Grab the endpoint and hold onto it till we're done
-	vdeNetwork.mtx.Lock()
-	defer vdeNetwork.mtx.Unlock()
-	vdeEndpoint, _ := vdeNetwork.networkEndpoints[req.EndpointID]
+	delete(vdeNetwork.networkEndpoints, req.EndpointID)
+	vdeNetwork.mtx.Unlock()
+
+	ctx, cancel := this.requestContext()
+	defer cancel()
+	vdeEndpoint.mtx.Lock()
+	defer vdeEndpoint.mtx.Unlock()
 
 	// It's possible the endpoint is being killed while it's "Joined" - so ensure
 	// we clean up it's processes.
 	vdeEndpoint.KillTapCmd()
-	vdeEndpoint.DeleteTapDevice()
+	vdeEndpoint.DeleteTapDevice(ctx)
 
-	// Delete the endpoint
-	delete(vdeNetwork.networkEndpoints, req.EndpointID)
+	this.names.ReleaseInterface(req.EndpointID)
 	return nil
 }
 
 func (this *VDENetworkDriver) EndpointInfo(req *network.InfoRequest) (*network.InfoResponse, error) {
-	if !this.networkExists(req.NetworkID) {
-		return nil, errors.New("Network does not exist")
-	}
-	// Grab the network and hold onto it till we finish. This is so no-one deletes it while we're setting up an endpoint.
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	vdeNetwork, _ := this.networks[req.NetworkID]
-	// Check the endpoint exists
-	if !vdeNetwork.EndpointExists(req.EndpointID) {
-		return nil, errors.New("Endpoint does not exist")
+	vdeNetwork, vdeEndpoint, unlock, err := this.lockEndpoint(req.NetworkID, req.EndpointID)
+	if err != nil {
+		return nil, err
 	}
-	vdeNetwork.mtx.RLock()
-	defer vdeNetwork.mtx.RUnlock()
-	vdeEndpoint, _ := vdeNetwork.networkEndpoints[req.EndpointID]
+	defer unlock()
 
 	r := &network.InfoResponse{
 		Value: make(map[string]string),
@@ -501,7 +615,7 @@ func (this *VDENetworkDriver) EndpointInfo(req *network.InfoRequest) (*network.I
 	r.Value["socket_dir"] = vdeNetwork.sockDir
 	r.Value["management_socket"] = vdeNetwork.mgmtSock
 	if vdeNetwork.switchp != nil {
-		r.Value["switch_pid"] = string(vdeNetwork.switchp.Process.Pid)
+		r.Value["switch_pid"] = strconv.Itoa(vdeNetwork.switchp.Process.Pid)
 		r.Value["create_sockets"] = ""
 	} else {
 		r.Value["switch_pid"] = ""
@@ -509,12 +623,18 @@ func (this *VDENetworkDriver) EndpointInfo(req *network.InfoRequest) (*network.I
 	}
 
 	if vdeEndpoint.tapPlugCmd != nil {
-		r.Value["plug_pid"] = string(vdeEndpoint.tapPlugCmd.Process.Pid)
+		r.Value["plug_pid"] = strconv.Itoa(vdeEndpoint.tapPlugCmd.Process.Pid)
 	} else {
 		r.Value["plug_pid"] = ""
 	}
 
 	r.Value["tap_device"] = vdeEndpoint.tapDevName
+	if vdeNetwork.linkDown {
+		r.Value["link_state"] = LinkStateDown
+	} else {
+		r.Value["link_state"] = vdeEndpoint.GetLinkState()
+	}
+	r.Value["impairment"] = vdeEndpoint.impairment.String()
 
 	return r, nil
 }
@@ -523,21 +643,14 @@ func (this *VDENetworkDriver) Join(req *network.JoinRequest) (*network.JoinRespo
 	log := log.With("EndpointID", req.EndpointID).With("SandboxKey", req.SandboxKey)
 	log.Infoln("Join Request Received")
 
-	if !this.networkExists(req.NetworkID) {
-		return nil, errors.New("Network does not exist")
-	}
-	// Grab the network and hold onto it till we finish. This is so no-one deletes it while we're setting up an endpoint.
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	vdeNetwork, _ := this.networks[req.NetworkID]
-	// Check the endpoint exists
-	if !vdeNetwork.EndpointExists(req.EndpointID) {
-		return nil, errors.New("Endpoint does not exist")
+	// Other endpoints of the network can be joined in parallel.
+	vdeNetwork, vdeEndpoint, unlock, err := this.lockEndpoint(req.NetworkID, req.EndpointID)
+	if err != nil {
+		return nil, err
 	}
-	// Grab the endpoint and hold onto it till we're done
-	vdeNetwork.mtx.Lock()
-	defer vdeNetwork.mtx.Unlock()
-	vdeEndpoint, _ := vdeNetwork.networkEndpoints[req.EndpointID]
+	defer unlock()
+	ctx, cancel := this.requestContext()
+	defer cancel()
 
 	// Check that the network is actually running!
 	if vdeNetwork.IsRunning() == false {
@@ -545,66 +658,93 @@ func (this *VDENetworkDriver) Join(req *network.JoinRequest) (*network.JoinRespo
 		return nil, errors.New("Network switch process has exited.")
 	}
 
-	// It shouldn't really be possible to get here. For now fail, in future,
-	// maybe blow away the old endpoint if it's hanging around?
-	if vdeEndpoint.tapDevName == "" {
-		vdeEndpoint.tapDevName = InterfacePrefix + req.EndpointID[:11]
-	} else {
+	// A retry of the request which joined the endpoint gets the same
+	// response. Otherwise, it shouldn't really be possible to get here. For
+	// now fail, in future, maybe blow away the old endpoint if it's hanging
+	// around?
+	if vdeEndpoint.tapDevName != "" {
+		if vdeEndpoint.tapPlugCmd != nil && vdeEndpoint.sandboxKey == req.SandboxKey {
+			log.Infoln("Endpoint already joined, treating request as a retry")
+			return joinResponse(vdeEndpoint), nil
+		}
+		if vdeEndpoint.sandboxKey != "" && vdeEndpoint.sandboxKey != req.SandboxKey {
+			return nil, errors.New(fmt.Sprintf("Endpoint already joined to sandbox %s", vdeEndpoint.sandboxKey))
+		}
 		log.Errorln("Tap device still exists for endpoint:", vdeEndpoint.tapDevName)
 		return nil, errors.New("Tap device still exists for endpoint")
 	}
 
-	if err := fsutil.CheckExec("ip", "tuntap", "add", "dev", vdeEndpoint.tapDevName, "mode", "tap"); err != nil {
-		return nil, errors.New("Error creating tap device")
-	}
+	// Every step from here on is undone if a later one fails.
+	undo := newUndoStack(log, this.requestTimeout)
+	defer undo.Rollback()
 
-	failedDeviceSetup := new(bool)
-	*failedDeviceSetup = true
-	defer func() {
-		if *failedDeviceSetup {
-			if err := fsutil.CheckExec("ip", "link", "delete", "dev", vdeEndpoint.tapDevName); err != nil {
-				log.Errorln("Error removing created tap device:", vdeEndpoint.tapDevName)
-			}
-		}
-	}()
+	tapDevName, err := this.names.AllocateInterface(req.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	vdeEndpoint.tapDevName = tapDevName
+	undo.Push("release tap device name", func(ctx context.Context) error {
+		vdeEndpoint.tapDevName = ""
+		this.names.ReleaseInterface(req.EndpointID)
+		return nil
+	})
+
+	if err := fsutil.CheckExec(ctx, "ip", "tuntap", "add", "dev", vdeEndpoint.tapDevName, "mode", "tap"); err != nil {
+		metricErrors.Inc(errorTapDevice)
+		return nil, errors.New(fmt.Sprint("Error creating tap device: ", err))
+	}
+	// Deleting the tap device also removes the addresses added to it.
+	undo.Push("delete tap device", func(ctx context.Context) error {
+		return fsutil.CheckExec(ctx, "ip", "link", "delete", "dev", tapDevName)
+	})
 
-	if err := fsutil.CheckExec("ip", "link", "set", "dev", vdeEndpoint.tapDevName, "address", vdeEndpoint.macAddress.String()); err != nil {
-		return nil, errors.New("Error setting MAC address")
+	if err := fsutil.CheckExec(ctx, "ip", "link", "set", "dev", vdeEndpoint.tapDevName, "address", vdeEndpoint.macAddress.String()); err != nil {
+		return nil, errors.New(fmt.Sprint("Error setting MAC address: ", err))
 	}
 
-	if err := fsutil.CheckExec("ip", "link", "set", "dev", vdeEndpoint.tapDevName, "up"); err != nil {
-		return nil, errors.New("Error setting device up")
+	if err := fsutil.CheckExec(ctx, "ip", "link", "set", "dev", vdeEndpoint.tapDevName, "up"); err != nil {
+		return nil, errors.New(fmt.Sprint("Error setting device up: ", err))
 	}
 
 	if vdeEndpoint.GetIPv4CIDRAddress() != "" {
-		if err := fsutil.CheckExec("ip", "address", "add", vdeEndpoint.GetIPv4CIDRAddress(), "dev", vdeEndpoint.tapDevName); err != nil {
-			return nil, errors.New(fmt.Sprintln("Error setting IPv4 address:", vdeEndpoint.GetIPv4CIDRAddress()))
+		if err := fsutil.CheckExec(ctx, "ip", "address", "add", vdeEndpoint.GetIPv4CIDRAddress(), "dev", vdeEndpoint.tapDevName); err != nil {
+			return nil, errors.New(fmt.Sprint("Error setting IPv4 address: ", err))
 		}
 	}
 
 	if vdeEndpoint.GetIPv6CIDRAddress() != "" {
-		if err := fsutil.CheckExec("ip", "address", "add", vdeEndpoint.GetIPv6CIDRAddress(), "dev", vdeEndpoint.tapDevName); err != nil {
-			return nil, errors.New(fmt.Sprintln("Error setting IPv6 address:", vdeEndpoint.GetIPv6CIDRAddress()))
+		if err := fsutil.CheckExec(ctx, "ip", "address", "add", vdeEndpoint.GetIPv6CIDRAddress(), "dev", vdeEndpoint.tapDevName); err != nil {
+			return nil, errors.New(fmt.Sprint("Error setting IPv6 address: ", err))
 		}
 	}
 
 	// Plug the interface into the network switch
-	cmd := fsutil.LoggedCommand("vde_plug2tap", "--sock", vdeNetwork.sockDir, vdeEndpoint.tapDevName)
-	cmdPipe, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, errors.New("Failed to setup vde_plug2tap mgmt pipe")
+	if err := vdeEndpoint.startTapCmd("vde_plug2tap", "--sock", vdeNetwork.sockDir, vdeEndpoint.tapDevName); err != nil {
+		return nil, err
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, errors.New("Error starting vde_plug2tap for endpoint tap adaptor")
+	undo.Push("stop vde_plug2tap", func(ctx context.Context) error {
+		vdeEndpoint.KillTapCmd()
+		return nil
+	})
+
+	// Restore an administratively disabled link. Failing this leaves the
+	// link up, which is logged rather than failing the join.
+	if vdeNetwork.linkDown || vdeEndpoint.linkDown {
+		if err := vdeEndpoint.applyLinkState(ctx, true); err != nil {
+			log.Errorln("Error disabling link of joined endpoint:", err)
+		}
 	}
 
-	vdeEndpoint.tapPlugCmd = cmd
-	vdeEndpoint.tapCmdPipe = cmdPipe
+	// We have succeeded, keep the tap device and plug.
+	undo.Commit()
+	vdeEndpoint.sandboxKey = req.SandboxKey
 
-	// We have succeeded, do not delete the interface on function exit.
-	*failedDeviceSetup = false
+	return joinResponse(vdeEndpoint), nil
+}
 
-	r := &network.JoinResponse{
+// Construct the response to a Join request.
+func joinResponse(vdeEndpoint *VDENetworkEndpoint) *network.JoinResponse {
+	return &network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   vdeEndpoint.tapDevName,
 			DstPrefix: InterfacePrefix,
@@ -612,32 +752,29 @@ func (this *VDENetworkDriver) Join(req *network.JoinRequest) (*network.JoinRespo
 		Gateway:     vdeEndpoint.GetIPv4Gateway(),
 		GatewayIPv6: vdeEndpoint.GetIPv6Gateway(),
 	}
+}
 
-	return r, nil
+// Fingerprint the parameters of a request, so a retry of it can be told
+// apart from a conflicting request.
+func requestFingerprint(params ...interface{}) string {
+	// Maps are marshalled with sorted keys, so equal parameters give equal
+	// fingerprints.
+	data, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
 
 func (this *VDENetworkDriver) Leave(req *network.LeaveRequest) error {
-	if !this.networkExists(req.NetworkID) {
-		return errors.New("Network does not exist")
-	}
-	// Grab the network and hold onto it till we finish. This is so
-	// no-one deletes it while we're setting up an endpoint.
-	this.mtx.RLock()
-	defer this.mtx.RUnlock()
-	vdeNetwork, _ := this.networks[req.NetworkID]
-	// Check the endpoint exists
-	if !vdeNetwork.EndpointExists(req.EndpointID) {
-		return errors.New("Endpoint does not exist")
+	_, vdeEndpoint, unlock, err := this.lockEndpoint(req.NetworkID, req.EndpointID)
+	if err != nil {
+		return err
 	}
-	// Grab the endpoint and hold onto it till we're done
-	vdeNetwork.mtx.Lock()
-	defer vdeNetwork.mtx.Unlock()
-	vdeEndpoint, _ := vdeNetwork.networkEndpoints[req.EndpointID]
+	defer unlock()
 
 	// Kill off the network connection processes
-	vdeEndpoint.tapCmdPipe.Close()
-	vdeEndpoint.tapPlugCmd.Process.Kill()
-	vdeEndpoint.tapPlugCmd.Wait()
+	vdeEndpoint.KillTapCmd()
 
 	// Strictly speaking we should remove the endpoint here. However, it's not
 	// in the root namespace yet and we don't know where it is. As a kind of
@@ -666,11 +803,226 @@ func (this *VDENetworkDriver) RevokeExternalConnectivity(req *network.RevokeExte
 	return nil
 }
 
+// Resolve a full or unique prefix of a network ID to a managed network ID.
+func (this *VDENetworkDriver) resolveNetworkId(networkId string) (string, error) {
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+	if _, found := this.networks[networkId]; found {
+		return networkId, nil
+	}
+
+	resolved := ""
+	for candidateId := range this.networks {
+		if networkId != "" && strings.HasPrefix(candidateId, networkId) {
+			if resolved != "" {
+				return "", errors.New(fmt.Sprintf("Network ID prefix is ambiguous: %s", networkId))
+			}
+			resolved = candidateId
+		}
+	}
+	if resolved == "" {
+		return "", errors.New("Network does not exist")
+	}
+	return resolved, nil
+}
+
+// Resolve a full or unique prefix of an endpoint ID on a network. Caller
+// must hold the network lock.
+func (this *VDENetworkDesc) resolveEndpointId(endpointId string) (string, error) {
+	if _, found := this.networkEndpoints[endpointId]; found {
+		return endpointId, nil
+	}
+
+	resolved := ""
+	for candidateId := range this.networkEndpoints {
+		if endpointId != "" && strings.HasPrefix(candidateId, endpointId) {
+			if resolved != "" {
+				return "", errors.New(fmt.Sprintf("Endpoint ID prefix is ambiguous: %s", endpointId))
+			}
+			resolved = candidateId
+		}
+	}
+	if resolved == "" {
+		return "", errors.New("Endpoint does not exist")
+	}
+	return resolved, nil
+}
+
+// Run fn with the network write-locked and a request context. The network ID
+// may be a unique prefix.
+func (this *VDENetworkDriver) withNetwork(networkId string, fn func(context.Context, string, *VDENetworkDesc) error) error {
+	networkId, err := this.resolveNetworkId(networkId)
+	if err != nil {
+		return err
+	}
+
+	vdeNetwork, err := this.lockNetwork(networkId)
+	if err != nil {
+		return err
+	}
+	defer vdeNetwork.mtx.Unlock()
+
+	ctx, cancel := this.requestContext()
+	defer cancel()
+	return fn(ctx, networkId, vdeNetwork)
+}
+
+// SetLinkState administratively enables or disables the link of an endpoint,
+// or of every endpoint on the network if endpointId is empty. This simulates
+// unplugging the cable without stopping the container.
+func (this *VDENetworkDriver) SetLinkState(networkId string, endpointId string, up bool) error {
+	return this.withNetwork(networkId, func(ctx context.Context, networkId string, vdeNetwork *VDENetworkDesc) error {
+		log.With("NetworkID", networkId).With("EndpointID", endpointId).With("LinkUp", up).
+			Infoln("SetLinkState request received")
+
+		if endpointId == "" {
+			return vdeNetwork.setLinkState(ctx, up)
+		}
+
+		endpointId, err := vdeNetwork.resolveEndpointId(endpointId)
+		if err != nil {
+			return err
+		}
+		return vdeNetwork.setEndpointLinkState(ctx, endpointId, up)
+	})
+}
+
+// SetImpairment applies netem impairments to an endpoint, or to every joined
+// endpoint on the network if endpointId is empty. A nil impairment clears
+// existing impairments.
+func (this *VDENetworkDriver) SetImpairment(networkId string, endpointId string, impairment *Impairment) error {
+	if impairment != nil {
+		if err := impairment.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return this.withNetwork(networkId, func(ctx context.Context, networkId string, vdeNetwork *VDENetworkDesc) error {
+		log.With("NetworkID", networkId).With("EndpointID", endpointId).With("Impairment", impairment.String()).
+			Infoln("SetImpairment request received")
+
+		if endpointId != "" {
+			endpointId, err := vdeNetwork.resolveEndpointId(endpointId)
+			if err != nil {
+				return err
+			}
+			return vdeNetwork.networkEndpoints[endpointId].setImpairment(ctx, impairment)
+		}
+
+		var lastErr error
+		for endpointId, endpoint := range vdeNetwork.networkEndpoints {
+			if endpoint.tapPlugCmd == nil {
+				continue
+			}
+			if err := endpoint.setImpairment(ctx, impairment); err != nil {
+				log.With("EndpointID", endpointId).Errorln("Error applying impairment:", err)
+				lastErr = err
+			}
+		}
+		return lastErr
+	})
+}
+
+// Restore clears impairments and administrative link downs from an endpoint,
+// or from the network and all of its endpoints if endpointId is empty.
+func (this *VDENetworkDriver) Restore(networkId string, endpointId string) error {
+	return this.withNetwork(networkId, func(ctx context.Context, networkId string, vdeNetwork *VDENetworkDesc) error {
+		log.With("NetworkID", networkId).With("EndpointID", endpointId).Infoln("Restore request received")
+
+		endpoints := vdeNetwork.networkEndpoints
+		if endpointId != "" {
+			endpointId, err := vdeNetwork.resolveEndpointId(endpointId)
+			if err != nil {
+				return err
+			}
+			endpoints = VDENetworkEndpoints{endpointId: vdeNetwork.networkEndpoints[endpointId]}
+		} else {
+			vdeNetwork.linkDown = false
+		}
+
+		var lastErr error
+		for endpointId, endpoint := range endpoints {
+			log := log.With("EndpointID", endpointId)
+			if err := endpoint.setImpairment(ctx, nil); err != nil {
+				log.Errorln("Error clearing impairment:", err)
+				lastErr = err
+			}
+			endpoint.linkDown = false
+			if err := endpoint.applyLinkState(ctx, vdeNetwork.linkDown); err != nil {
+				log.Errorln("Error applying link state:", err)
+				lastErr = err
+			}
+		}
+		return lastErr
+	})
+}
+
+// RestartSwitch restarts the vde_switch process of a network the plugin
+// manages, reconnecting all joined endpoints.
+func (this *VDENetworkDriver) RestartSwitch(networkId string) error {
+	return this.withNetwork(networkId, func(ctx context.Context, networkId string, vdeNetwork *VDENetworkDesc) error {
+		log.With("NetworkID", networkId).Infoln("RestartSwitch request received")
+		return vdeNetwork.restartSwitch(ctx)
+	})
+}
+
+// ForceDeleteEndpoint kills the plug, deletes the tap device and forgets an
+// endpoint regardless of what docker thinks its state is.
+func (this *VDENetworkDriver) ForceDeleteEndpoint(networkId string, endpointId string) error {
+	return this.withNetwork(networkId, func(ctx context.Context, networkId string, vdeNetwork *VDENetworkDesc) error {
+		endpointId, err := vdeNetwork.resolveEndpointId(endpointId)
+		if err != nil {
+			return err
+		}
+		log.With("NetworkID", networkId).With("EndpointID", endpointId).
+			Warnln("Forcibly cleaning up endpoint")
+
+		err = vdeNetwork.networkEndpoints[endpointId].forceCleanup(ctx)
+		delete(vdeNetwork.networkEndpoints, endpointId)
+		this.names.ReleaseInterface(endpointId)
+		return err
+	})
+}
+
+// SocketDirInUse returns true if a network uses the given switch socket
+// directory.
+func (this *VDENetworkDriver) SocketDirInUse(sockDir string) bool {
+	for _, vdeNetwork := range this.listNetworks() {
+		vdeNetwork.mtx.RLock()
+		inUse := !vdeNetwork.removed && vdeNetwork.sockDir == sockDir
+		vdeNetwork.mtx.RUnlock()
+		if inUse {
+			return true
+		}
+	}
+	return false
+}
+
+// ListNetworks returns a snapshot of all managed networks and their endpoints.
+func (this *VDENetworkDriver) ListNetworks() []AdminNetworkInfo {
+	networks := this.listNetworks()
+	result := make([]AdminNetworkInfo, 0, len(networks))
+	for networkId, vdeNetwork := range networks {
+		vdeNetwork.mtx.RLock()
+		if !vdeNetwork.removed {
+			result = append(result, vdeNetwork.info(networkId))
+		}
+		vdeNetwork.mtx.RUnlock()
+	}
+	return result
+}
+
 // Implements both the Network and IPAM interfaces.
-func NewVDENetworkDriver(socketRoot string) *VDENetworkDriver {
+func NewVDENetworkDriver(socketRoot string, switches *SwitchManager, names *NameIndex, requestTimeout time.Duration, defaultPools *DefaultAddressPools, addressSpaces *AddressSpaces) *VDENetworkDriver {
 	return &VDENetworkDriver{
-		socketRoot: socketRoot,
+		socketRoot:     socketRoot,
+		switches:       switches,
+		names:          names,
+		requestTimeout: requestTimeout,
+		defaultPools:   defaultPools,
+		addressSpaces:  addressSpaces,
 		networks:   make(map[string]*VDENetworkDesc),
 		ipam: make(map[string]*IPAMNetworkPool),
+		gatewayPools: make(map[string]string),
 	}
 }
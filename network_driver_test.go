@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// Requests for a network with a /16 pool and the vde_switch started by us.
+func createNetworkRequest(networkId string, subnet int) *network.CreateNetworkRequest {
+	return &network.CreateNetworkRequest{
+		NetworkID: networkId,
+		IPv4Data: []*network.IPAMData{{
+			AddressSpace: IPAMDefaultAddressSpaceLocal,
+			Pool:         fmt.Sprintf("10.%d.0.0/16", subnet),
+			Gateway:      fmt.Sprintf("10.%d.0.1/16", subnet),
+		}},
+	}
+}
+
+// Runs an endpoint through its whole lifecycle.
+func cycleEndpoint(driver *VDENetworkDriver, networkId string, subnet int, i int) error {
+	endpointId := fmt.Sprintf("%s-endpoint-%d", networkId, i)
+	if _, err := driver.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  networkId,
+		EndpointID: endpointId,
+		Interface: &network.EndpointInterface{
+			Address:    fmt.Sprintf("10.%d.1.%d/16", subnet, i+1),
+			MacAddress: fmt.Sprintf("02:42:0a:%02x:01:%02x", subnet, i+1),
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := driver.Join(&network.JoinRequest{
+		NetworkID:  networkId,
+		EndpointID: endpointId,
+		SandboxKey: "/var/run/docker/netns/" + endpointId,
+	}); err != nil {
+		return err
+	}
+	if _, err := driver.EndpointInfo(&network.InfoRequest{NetworkID: networkId, EndpointID: endpointId}); err != nil {
+		return err
+	}
+	if err := driver.Leave(&network.LeaveRequest{NetworkID: networkId, EndpointID: endpointId}); err != nil {
+		return err
+	}
+	return driver.DeleteEndpoint(&network.DeleteEndpointRequest{NetworkID: networkId, EndpointID: endpointId})
+}
+
+// Runs fn n times in parallel and returns the errors.
+func parallel(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestConcurrentEndpointsOfOneNetwork(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if err := driver.CreateNetwork(createNetworkRequest("network", 1)); err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range parallel(16, func(i int) error {
+		return cycleEndpoint(driver, "network", 1, i)
+	}) {
+		if err != nil {
+			t.Errorf("endpoint %d: %v", i, err)
+		}
+	}
+
+	if err := driver.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "network"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.ListNetworks()) != 0 {
+		t.Fatal("Network was not removed")
+	}
+}
+
+func TestConcurrentNetworks(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for i, err := range parallel(4, func(n int) error {
+		networkId := fmt.Sprintf("network-%d", n)
+		if err := driver.CreateNetwork(createNetworkRequest(networkId, n)); err != nil {
+			return err
+		}
+		for _, err := range parallel(4, func(i int) error {
+			return cycleEndpoint(driver, networkId, n, i)
+		}) {
+			if err != nil {
+				return err
+			}
+		}
+		return driver.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: networkId})
+	}) {
+		if err != nil {
+			t.Errorf("network %d: %v", i, err)
+		}
+	}
+	if len(driver.ListNetworks()) != 0 {
+		t.Fatal("Networks were not removed")
+	}
+}
+
+// Duplicate requests, as docker sends when retrying, must all succeed with
+// a single network created.
+func TestConcurrentDuplicateCreateNetwork(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	for i, err := range parallel(8, func(int) error {
+		return driver.CreateNetwork(createNetworkRequest("network", 1))
+	}) {
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if n := len(driver.ListNetworks()); n != 1 {
+		t.Fatalf("%d networks created", n)
+	}
+
+	conflicting := createNetworkRequest("network", 2)
+	if err := driver.CreateNetwork(conflicting); err == nil {
+		t.Fatal("Conflicting request for an existing network succeeded")
+	}
+}
+
+// Deleting a network while endpoints are created and joined either fails
+// because it is in use, or makes the endpoint requests fail. Either way the
+// network ends up consistent.
+func TestConcurrentDeleteNetworkWithEndpoints(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if err := driver.CreateNetwork(createNetworkRequest("network", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := false
+	var mtx sync.Mutex
+	parallel(16, func(i int) error {
+		if i%4 == 0 {
+			if err := driver.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "network"}); err == nil {
+				mtx.Lock()
+				deleted = true
+				mtx.Unlock()
+			}
+			return nil
+		}
+		return cycleEndpoint(driver, "network", 1, i)
+	})
+
+	networks := driver.ListNetworks()
+	if deleted {
+		if len(networks) != 0 {
+			t.Fatal("Deleted network still exists")
+		}
+		return
+	}
+	if len(networks) != 1 || len(networks[0].Endpoints) != 0 {
+		t.Fatalf("Endpoints left behind: %+v", networks)
+	}
+	if err := driver.DeleteNetwork(&network.DeleteNetworkRequest{NetworkID: "network"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Host commands only optional features use are needed once they are used.
+func TestOptionalCommandsMissing(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	if err := driver.CreateNetwork(createNetworkRequest("network", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "network",
+		EndpointID: "endpoint",
+		Interface:  &network.EndpointInterface{Address: "10.1.0.2/16", MacAddress: "02:42:0a:01:00:02"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Join(&network.JoinRequest{NetworkID: "network", EndpointID: "endpoint", SandboxKey: "/var/run/docker/netns/test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the fake commands, which don't include nsenter or tc
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", fakeCommandDir)
+	defer os.Setenv("PATH", path)
+	err := driver.SetImpairment("network", "endpoint", &Impairment{Loss: 10})
+	if err == nil || !strings.Contains(err.Error(), "needs tc") {
+		t.Fatalf("Expected an error naming tc, got %v", err)
+	}
+	err = driver.SetLinkState("network", "endpoint", false)
+	if err == nil || !strings.Contains(err.Error(), "needs nsenter") {
+		t.Fatalf("Expected an error naming nsenter, got %v", err)
+	}
+}
@@ -0,0 +1,513 @@
+// options defines the driver options accepted by docker network create and
+// docker network connect, and validates them before anything is created.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runc/libcontainer/user"
+)
+
+// Option parameters we recognize for networks
+const (
+	// Specifies an existing VDE switch to associate with a network
+	NetworkOptionSwitchSocket string = "socket_dir"
+	// Specifies the existing VDE switches management socket.
+	// Can be left out (management options will not work from the driver)
+	NetworkOptionSwitchManagementSocket string = "management_socket"
+	// Specifies that if the supplied sockets do not exist, they should be
+	// used as the paths for a new vde_switch for the network.
+	NetworkOptionsAllowCreate string = "create_sockets"
+	// Specify the group owner for the created socket.
+	NetworkOptionsSocketGroup string = "socket_group"
+	// Specify the number of switch ports (default is 32)
+	NetworkOptionsNumSwitchports string = "num_switchports"
+	// Name of the socket directory created under the socket root
+	NetworkOptionsSwitchName string = "switch_name"
+	// Specify the user owning the created socket directory and sockets.
+	NetworkOptionsSocketOwner string = "socket_owner"
+	// Specify the permissions of the created sockets.
+	NetworkOptionsSocketMode string = "socket_mode"
+	// Specify the group owner and permissions of the management socket.
+	NetworkOptionsManagementSocketGroup string = "management_socket_group"
+	NetworkOptionsManagementSocketMode  string = "management_socket_mode"
+)
+
+// Option parameters we recognize for endpoints
+const (
+	// Initial link state of the endpoint
+	EndpointOptionLinkState string = "link_state"
+)
+
+// Option parameters we recognize for IPAM pools
+const (
+	// How addresses are picked out of the pool
+	PoolOptionAddressAllocation string = "address_allocation"
+	// How long released addresses are held back before being reassigned
+	PoolOptionReleaseQuarantine string = "release_quarantine"
+	// Addresses never assigned out of the pool
+	PoolOptionExcludedRanges string = "excluded_ranges"
+	// Named addresses only assigned when requested explicitly
+	PoolOptionReservations string = "reservations"
+	// Addresses only assigned to endpoints with the given MAC addresses
+	PoolOptionMACBindings string = "mac_bindings"
+	// Reassign the last address of a MAC address to it when free
+	PoolOptionStickyAddresses string = "sticky_addresses"
+)
+
+// Key docker passes network driver options (-o) under
+const dockerGenericOptions string = "com.docker.network.generic"
+
+// Prefix of options docker itself adds to endpoint requests
+const dockerOptionPrefix string = "com.docker."
+
+// Types of option values
+const (
+	OptionTypeString string = "string"
+	OptionTypePath   string = "path"
+	OptionTypeBool   string = "bool"
+	OptionTypeInt    string = "int"
+	OptionTypeEnum   string = "enum"
+	// Go duration, e.g. 5m
+	OptionTypeDuration string = "duration"
+	// Octal file permissions
+	OptionTypeMode string = "mode"
+)
+
+// OptionSpec describes an option accepted by the driver
+type OptionSpec struct {
+	Name        string
+	Type        string
+	Description string
+	// Inclusive range of int options
+	Min int64 `json:",omitempty"`
+	Max int64 `json:",omitempty"`
+	// Accepted values of enum options
+	Values []string `json:",omitempty"`
+}
+
+// Options accepted by docker network create
+var networkOptionSpecs = []OptionSpec{
+	{
+		Name:        NetworkOptionSwitchSocket,
+		Type:        OptionTypeString,
+		Description: "Absolute path of a vde_switch socket directory, or the name of a predefined switch.",
+	},
+	{
+		Name:        NetworkOptionSwitchManagementSocket,
+		Type:        OptionTypePath,
+		Description: "Absolute path of the management socket of the switch. Requires socket_dir.",
+	},
+	{
+		Name:        NetworkOptionsAllowCreate,
+		Type:        OptionTypeBool,
+		Description: "Start a vde_switch at socket_dir if it does not exist. Requires socket_dir.",
+	},
+	{
+		Name:        NetworkOptionsSocketGroup,
+		Type:        OptionTypeString,
+		Description: "Group owning the sockets of a switch started by the plugin.",
+	},
+	{
+		Name:        NetworkOptionsNumSwitchports,
+		Type:        OptionTypeInt,
+		Description: "Number of ports of a switch started by the plugin.",
+		Min:         1,
+		Max:         65535,
+	},
+	{
+		Name:        NetworkOptionsSocketOwner,
+		Type:        OptionTypeString,
+		Description: "User owning the socket directory and control socket of a switch started by the plugin.",
+	},
+	{
+		Name:        NetworkOptionsSocketMode,
+		Type:        OptionTypeMode,
+		Description: "Octal permissions of the sockets of a switch started by the plugin, e.g. 0660.",
+	},
+	{
+		Name:        NetworkOptionsManagementSocketGroup,
+		Type:        OptionTypeString,
+		Description: "Group owning the management socket of a switch started by the plugin.",
+	},
+	{
+		Name:        NetworkOptionsManagementSocketMode,
+		Type:        OptionTypeMode,
+		Description: "Octal permissions of the management socket of a switch started by the plugin.",
+	},
+	{
+		Name:        NetworkOptionsSwitchName,
+		Type:        OptionTypeString,
+		Description: "Name of the switch socket directory created under the socket root. Defaults to the network ID.",
+	},
+}
+
+// Options accepted by docker network connect --driver-opt
+var endpointOptionSpecs = []OptionSpec{
+	{
+		Name:        EndpointOptionLinkState,
+		Type:        OptionTypeEnum,
+		Description: "Initial link state of the endpoint.",
+		Values:      []string{LinkStateUp, LinkStateDown},
+	},
+}
+
+// Options accepted by docker network create --ipam-opt
+var poolOptionSpecs = []OptionSpec{
+	{
+		Name:        PoolOptionAddressAllocation,
+		Type:        OptionTypeEnum,
+		Description: "How addresses are picked: sequential (IPv4 default), round-robin after the last assigned address, eui64 from the endpoint MAC (IPv6 default), hash of the endpoint MAC, or random.",
+		Values:      []string{AllocationSequential, AllocationRoundRobin, AllocationEUI64, AllocationHash, AllocationRandom},
+	},
+	{
+		Name:        PoolOptionReleaseQuarantine,
+		Type:        OptionTypeDuration,
+		Description: "How long a released address is not reassigned, unless requested explicitly, e.g. 5m. Defaults to 0.",
+	},
+	{
+		Name:        PoolOptionExcludedRanges,
+		Type:        OptionTypeString,
+		Description: "Comma separated addresses, networks and ranges never assigned, e.g. 10.0.0.1-10.0.0.20 or .1-.20 for IPv4.",
+	},
+	{
+		Name:        PoolOptionReservations,
+		Type:        OptionTypeString,
+		Description: "Comma separated name=address reservations, only assigned when requested explicitly.",
+	},
+	{
+		Name:        PoolOptionMACBindings,
+		Type:        OptionTypeString,
+		Description: "Comma separated mac=address bindings. The address is assigned to, and only to, endpoints with the MAC address.",
+	},
+	{
+		Name:        PoolOptionStickyAddresses,
+		Type:        OptionTypeBool,
+		Description: "Give an endpoint the address last assigned to its MAC address again, if it is free.",
+	},
+}
+
+// Options which only apply to switches the plugin starts
+var switchCreationOptions = []string{
+	NetworkOptionsSocketGroup,
+	NetworkOptionsNumSwitchports,
+	NetworkOptionsSocketOwner,
+	NetworkOptionsSocketMode,
+	NetworkOptionsManagementSocketGroup,
+	NetworkOptionsManagementSocketMode,
+}
+
+// NetworkOptions are the validated options of a network
+type NetworkOptions struct {
+	SocketDir        string
+	ManagementSocket string
+	CreateSockets    bool
+	SocketGroup      string
+	NumSwitchports   int64
+	SwitchName       string
+	// 0 leaves the sockets owned by root
+	SocketOwnerUid int
+	// 0 for the vde_switch defaults
+	SocketMode            os.FileMode
+	ManagementSocketGroup string
+	ManagementSocketMode  os.FileMode
+}
+
+// EndpointOptions are the validated options of an endpoint
+type EndpointOptions struct {
+	LinkDown bool
+}
+
+// PoolOptions are the validated options of an IPAM pool
+type PoolOptions struct {
+	// Empty for the default of the address family
+	Allocation string
+	// 0 reassigns released addresses straight away
+	Quarantine time.Duration
+	// Unparsed, since they depend on the subpool
+	ExcludedRanges string
+	Reservations   string
+	MACBindings    string
+	Sticky         bool
+}
+
+// ParseNetworkOptions validates the options of a CreateNetwork request.
+func ParseNetworkOptions(reqOptions map[string]interface{}) (*NetworkOptions, error) {
+	generic := make(map[string]interface{})
+	if raw, found := reqOptions[dockerGenericOptions]; found && raw != nil {
+		var ok bool
+		if generic, ok = raw.(map[string]interface{}); !ok {
+			return nil, errors.New(fmt.Sprintf("Network options must be a map of option names to values, got %T", raw))
+		}
+	}
+
+	values, err := parseOptions(networkOptionSpecs, generic)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &NetworkOptions{NumSwitchports: NetworkDefaultNumSwitchports}
+	_, hasSocketDir := values[NetworkOptionSwitchSocket]
+	_, hasCreate := values[NetworkOptionsAllowCreate]
+	for name, value := range values {
+		switch name {
+		case NetworkOptionSwitchSocket:
+			this.SocketDir = value.(string)
+		case NetworkOptionSwitchManagementSocket:
+			this.ManagementSocket = value.(string)
+		case NetworkOptionsAllowCreate:
+			this.CreateSockets = value.(bool)
+		case NetworkOptionsSocketGroup:
+			this.SocketGroup = value.(string)
+		case NetworkOptionsNumSwitchports:
+			this.NumSwitchports = value.(int64)
+		case NetworkOptionsSwitchName:
+			this.SwitchName = value.(string)
+		case NetworkOptionsSocketOwner:
+			this.SocketOwnerUid, err = lookupUid(value.(string))
+		case NetworkOptionsSocketMode:
+			this.SocketMode = value.(os.FileMode)
+		case NetworkOptionsManagementSocketGroup:
+			this.ManagementSocketGroup = value.(string)
+			_, err = lookupGid(this.ManagementSocketGroup)
+		case NetworkOptionsManagementSocketMode:
+			this.ManagementSocketMode = value.(os.FileMode)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", name, err))
+		}
+	}
+	if this.SocketGroup != "" {
+		if _, err := lookupGid(this.SocketGroup); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", NetworkOptionsSocketGroup, err))
+		}
+	}
+
+	if this.SocketDir == "" && hasSocketDir {
+		return nil, errors.New("Option socket_dir must not be empty")
+	}
+	if _, found := values[NetworkOptionsSwitchName]; found {
+		if hasSocketDir {
+			return nil, errors.New("Option switch_name cannot be used with socket_dir")
+		}
+		if this.SwitchName == "" {
+			return nil, errors.New("Option switch_name must not be empty")
+		}
+	}
+	if !hasSocketDir {
+		for _, name := range []string{NetworkOptionSwitchManagementSocket, NetworkOptionsAllowCreate} {
+			if _, found := values[name]; found {
+				return nil, errors.New(fmt.Sprintf("Option %s requires socket_dir", name))
+			}
+		}
+	}
+	// Options of switches the plugin starts make no sense for an existing one
+	if hasSocketDir && !this.CreateSockets {
+		for _, name := range switchCreationOptions {
+			if _, found := values[name]; found {
+				if hasCreate {
+					return nil, errors.New(fmt.Sprintf("Option %s cannot be used with create_sockets=false", name))
+				}
+				return nil, errors.New(fmt.Sprintf("Option %s requires create_sockets=true when socket_dir is set", name))
+			}
+		}
+	}
+	return this, nil
+}
+
+// ParseEndpointOptions validates the options of a CreateEndpoint request.
+// Options docker adds itself are ignored.
+func ParseEndpointOptions(reqOptions map[string]interface{}) (*EndpointOptions, error) {
+	driverOptions := make(map[string]interface{})
+	for name, value := range reqOptions {
+		if !strings.HasPrefix(name, dockerOptionPrefix) {
+			driverOptions[name] = value
+		}
+	}
+
+	values, err := parseOptions(endpointOptionSpecs, driverOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &EndpointOptions{}
+	if state, found := values[EndpointOptionLinkState]; found {
+		this.LinkDown = state.(string) == LinkStateDown
+	}
+	return this, nil
+}
+
+// ParsePoolOptions validates the options of a RequestPool request. Options
+// docker adds itself are ignored.
+func ParsePoolOptions(reqOptions map[string]string) (*PoolOptions, error) {
+	driverOptions := make(map[string]interface{})
+	for name, value := range reqOptions {
+		if !strings.HasPrefix(name, dockerOptionPrefix) {
+			driverOptions[name] = value
+		}
+	}
+
+	values, err := parseOptions(poolOptionSpecs, driverOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &PoolOptions{}
+	if allocation, found := values[PoolOptionAddressAllocation]; found {
+		this.Allocation = allocation.(string)
+	}
+	if quarantine, found := values[PoolOptionReleaseQuarantine]; found {
+		this.Quarantine = quarantine.(time.Duration)
+	}
+	if excluded, found := values[PoolOptionExcludedRanges]; found {
+		this.ExcludedRanges = excluded.(string)
+	}
+	if reservations, found := values[PoolOptionReservations]; found {
+		this.Reservations = reservations.(string)
+	}
+	if bindings, found := values[PoolOptionMACBindings]; found {
+		this.MACBindings = bindings.(string)
+	}
+	if sticky, found := values[PoolOptionStickyAddresses]; found {
+		this.Sticky = sticky.(bool)
+	}
+	return this, nil
+}
+
+// Check options against specs, returning their values converted to the
+// option types (string, bool, int64 or time.Duration).
+func parseOptions(specs []OptionSpec, options map[string]interface{}) (map[string]interface{}, error) {
+	specsByName := make(map[string]OptionSpec)
+	for _, spec := range specs {
+		specsByName[spec.Name] = spec
+	}
+
+	// Sorted so errors are stable when several options are wrong
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make(map[string]interface{})
+	for _, name := range names {
+		spec, found := specsByName[name]
+		if !found {
+			return nil, errors.New(fmt.Sprintf("Unknown option %q. Accepted options are: %s",
+				name, strings.Join(optionNames(specs), ", ")))
+		}
+		value, err := spec.parse(options[name])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for option %s: %v", name, err))
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+func optionNames(specs []OptionSpec) []string {
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+	return names
+}
+
+// Convert a raw option value to the type of the option.
+func (this OptionSpec) parse(raw interface{}) (interface{}, error) {
+	var str string
+	switch v := raw.(type) {
+	case string:
+		str = v
+	case bool:
+		str = strconv.FormatBool(v)
+	case float64:
+		str = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return nil, errors.New(fmt.Sprintf("expected a %s, got %T", this.Type, raw))
+	}
+
+	switch this.Type {
+	case OptionTypePath:
+		if !filepath.IsAbs(str) {
+			return nil, errors.New(fmt.Sprintf("%q is not an absolute path", str))
+		}
+		return filepath.Clean(str), nil
+	case OptionTypeBool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%q is not true or false", str))
+		}
+		return b, nil
+	case OptionTypeInt:
+		i, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%q is not an integer", str))
+		}
+		if i < this.Min || i > this.Max {
+			return nil, errors.New(fmt.Sprintf("%d is not between %d and %d", i, this.Min, this.Max))
+		}
+		return i, nil
+	case OptionTypeEnum:
+		for _, value := range this.Values {
+			if str == value {
+				return str, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("%q is not one of %s", str, strings.Join(this.Values, ", ")))
+	case OptionTypeMode:
+		return parseFileMode(str)
+	case OptionTypeDuration:
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			return nil, errors.New(fmt.Sprintf("%q is not a duration such as 5m", str))
+		}
+		return d, nil
+	}
+	return str, nil
+}
+
+// Parse octal permissions such as 0660. Special bits are not accepted.
+func parseFileMode(str string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, errors.New(fmt.Sprintf("%q is not an octal mode between 0001 and 0777", str))
+	}
+	return os.FileMode(mode), nil
+}
+
+// Resolve a user name or numeric ID to the uid of an existing user.
+func lookupUid(name string) (int, error) {
+	u, err := user.LookupUser(name)
+	if err != nil {
+		if uid, convErr := strconv.Atoi(name); convErr == nil {
+			u, err = user.LookupUid(uid)
+		}
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("no such user %q", name))
+	}
+	return u.Uid, nil
+}
+
+// Resolve a group name or numeric ID to the gid of an existing group.
+func lookupGid(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if gid, convErr := strconv.Atoi(name); convErr == nil {
+			g, err = user.LookupGid(gid)
+		}
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("no such group %q", name))
+	}
+	return g.Gid, nil
+}
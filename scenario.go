@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+	"gopkg.in/yaml.v2"
+)
+
+// Actions a scenario step can apply
+const (
+	ScenarioActionImpair        string = "impair"
+	ScenarioActionClearImpair   string = "clear-impairment"
+	ScenarioActionLinkDown      string = "link-down"
+	ScenarioActionLinkUp        string = "link-up"
+	ScenarioActionRestartSwitch string = "restart-switch"
+	// Clear impairments and bring links back up
+	ScenarioActionRestore string = "restore"
+)
+
+// Scenario is a timed list of faults to inject into VDE networks. Scenarios
+// are written in YAML (or JSON, which is valid YAML):
+//
+//   name: failover
+//   steps:
+//     - at: 30s
+//       action: impair
+//       network: vdetest
+//       endpoint: web1
+//       loss: 20
+//     - at: 60s
+//       action: link-down
+//       network: vdetest
+//       endpoint: db1
+//     - at: 90s
+//       action: restore
+//       network: vdetest
+//
+// Networks are docker network names or IDs. Endpoints are container names or
+// IDs, or endpoint IDs. Leaving out the endpoint applies the step to every
+// endpoint on the network.
+type Scenario struct {
+	Name  string         `yaml:"name"`
+	Steps []ScenarioStep `yaml:"steps"`
+}
+
+type ScenarioStep struct {
+	// Offset from the start of the scenario
+	At         time.Duration `yaml:"at"`
+	Action     string        `yaml:"action"`
+	Network    string        `yaml:"network"`
+	Endpoint   string        `yaml:"endpoint"`
+	Impairment `yaml:",inline"`
+}
+
+// Record of a step applied by the scenario runner
+type ScenarioLogEntry struct {
+	Time     time.Time
+	At       time.Duration
+	Action   string
+	Network  string
+	Endpoint string
+	Err      string
+}
+
+// Current state of a scenario
+type ScenarioStatus struct {
+	Name    string
+	Running bool
+	Started time.Time
+	Log     []ScenarioLogEntry
+}
+
+// ParseScenario parses and validates a YAML or JSON scenario.
+func ParseScenario(data []byte) (*Scenario, error) {
+	scenario := &Scenario{}
+	if err := yaml.UnmarshalStrict(data, scenario); err != nil {
+		return nil, errors.New(fmt.Sprintln("Could not parse scenario:", err))
+	}
+
+	if scenario.Name == "" {
+		return nil, errors.New("Scenario must have a name")
+	}
+
+	for idx, step := range scenario.Steps {
+		if step.Network == "" {
+			return nil, errors.New(fmt.Sprintf("Scenario step %d has no network", idx))
+		}
+		if step.At < 0 {
+			return nil, errors.New(fmt.Sprintf("Scenario step %d has a negative offset", idx))
+		}
+		switch step.Action {
+		case ScenarioActionImpair:
+			if err := step.Impairment.Validate(); err != nil {
+				return nil, errors.New(fmt.Sprintf("Scenario step %d: %v", idx, err))
+			}
+		case ScenarioActionRestartSwitch:
+			if step.Endpoint != "" {
+				return nil, errors.New(fmt.Sprintf("Scenario step %d: %s applies to a whole network", idx, step.Action))
+			}
+		case ScenarioActionClearImpair, ScenarioActionLinkDown, ScenarioActionLinkUp, ScenarioActionRestore:
+		default:
+			return nil, errors.New(fmt.Sprintf("Scenario step %d has unknown action: %s", idx, step.Action))
+		}
+	}
+
+	// Steps are applied in time order, keeping file order for equal offsets.
+	sort.Stable(scenarioStepsByTime(scenario.Steps))
+	return scenario, nil
+}
+
+// ParseScenarioFile reads a scenario from a file.
+func ParseScenarioFile(filename string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseScenario(data)
+}
+
+type scenarioStepsByTime []ScenarioStep
+
+func (s scenarioStepsByTime) Len() int           { return len(s) }
+func (s scenarioStepsByTime) Less(i, j int) bool { return s[i].At < s[j].At }
+func (s scenarioStepsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ScenarioRunner executes scenarios against the networks of a driver.
+type ScenarioRunner struct {
+	driver   *VDENetworkDriver
+	resolver *DockerResolver
+
+	// Scenarios by name, including finished ones
+	scenarios map[string]*scenarioRun
+	mtx       sync.Mutex
+}
+
+type scenarioRun struct {
+	scenario *Scenario
+	started  time.Time
+	stopCh   chan struct{}
+	running  bool
+	log      []ScenarioLogEntry
+}
+
+// NewScenarioRunner returns a scenario runner. resolver may be nil, in which
+// case networks and endpoints must be given as IDs.
+func NewScenarioRunner(driver *VDENetworkDriver, resolver *DockerResolver) *ScenarioRunner {
+	return &ScenarioRunner{
+		driver:    driver,
+		resolver:  resolver,
+		scenarios: make(map[string]*scenarioRun),
+	}
+}
+
+// Start running a scenario. A finished scenario of the same name is replaced.
+func (this *ScenarioRunner) Start(scenario *Scenario) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if existing, found := this.scenarios[scenario.Name]; found && existing.running {
+		return errors.New(fmt.Sprintf("Scenario is already running: %s", scenario.Name))
+	}
+
+	run := &scenarioRun{
+		scenario: scenario,
+		started:  time.Now(),
+		stopCh:   make(chan struct{}),
+		running:  true,
+		log:      make([]ScenarioLogEntry, 0),
+	}
+	this.scenarios[scenario.Name] = run
+
+	log.With("Scenario", scenario.Name).Infoln("Starting scenario")
+	go this.run(run)
+	return nil
+}
+
+// Stop a running scenario. Already applied steps are not undone.
+func (this *ScenarioRunner) Stop(name string) error {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	run, found := this.scenarios[name]
+	if !found {
+		return errors.New(fmt.Sprintf("Scenario does not exist: %s", name))
+	}
+	if run.running {
+		close(run.stopCh)
+		run.running = false
+		log.With("Scenario", name).Infoln("Stopped scenario")
+	}
+	return nil
+}
+
+// List the status of all known scenarios.
+func (this *ScenarioRunner) List() []ScenarioStatus {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	result := make([]ScenarioStatus, 0, len(this.scenarios))
+	for name, run := range this.scenarios {
+		result = append(result, ScenarioStatus{
+			Name:    name,
+			Running: run.running,
+			Started: run.started,
+			Log:     append([]ScenarioLogEntry{}, run.log...),
+		})
+	}
+	return result
+}
+
+func (this *ScenarioRunner) run(run *scenarioRun) {
+	for _, step := range run.scenario.Steps {
+		select {
+		case <-time.After(run.started.Add(step.At).Sub(time.Now())):
+		case <-run.stopCh:
+			return
+		}
+
+		err := this.apply(step)
+
+		entry := ScenarioLogEntry{
+			Time:     time.Now(),
+			At:       step.At,
+			Action:   step.Action,
+			Network:  step.Network,
+			Endpoint: step.Endpoint,
+		}
+		stepLog := log.With("Scenario", run.scenario.Name).
+			With("At", step.At).
+			With("Action", step.Action).
+			With("Network", step.Network).
+			With("Endpoint", step.Endpoint)
+		if err != nil {
+			entry.Err = err.Error()
+			stepLog.Errorln("Scenario step failed:", err)
+		} else {
+			stepLog.Infoln("Scenario step applied")
+		}
+
+		this.mtx.Lock()
+		run.log = append(run.log, entry)
+		this.mtx.Unlock()
+	}
+
+	this.mtx.Lock()
+	if run.running {
+		run.running = false
+		close(run.stopCh)
+	}
+	this.mtx.Unlock()
+	log.With("Scenario", run.scenario.Name).Infoln("Scenario finished")
+}
+
+// Apply a single scenario step
+func (this *ScenarioRunner) apply(step ScenarioStep) error {
+	networkId := this.resolver.ResolveNetwork(step.Network)
+	endpointId := this.resolver.ResolveEndpoint(networkId, step.Endpoint)
+
+	switch step.Action {
+	case ScenarioActionImpair:
+		impairment := step.Impairment
+		return this.driver.SetImpairment(networkId, endpointId, &impairment)
+	case ScenarioActionClearImpair:
+		return this.driver.SetImpairment(networkId, endpointId, nil)
+	case ScenarioActionLinkDown:
+		return this.driver.SetLinkState(networkId, endpointId, false)
+	case ScenarioActionLinkUp:
+		return this.driver.SetLinkState(networkId, endpointId, true)
+	case ScenarioActionRestartSwitch:
+		return this.driver.RestartSwitch(networkId)
+	case ScenarioActionRestore:
+		return this.driver.Restore(networkId, endpointId)
+	}
+	return errors.New(fmt.Sprintf("Unknown scenario action: %s", step.Action))
+}
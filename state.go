@@ -0,0 +1,631 @@
+// state implements the shutdown policies of the plugin. Networks are either
+// torn down on exit, or left running with their state persisted so a
+// restarted plugin can re-adopt the switches and plugs.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+)
+
+// Shutdown policies
+const (
+	// Leave switches and plugs running and persist state for re-adoption
+	ShutdownPolicyPreserve string = "preserve"
+	// Stop plugs, delete taps, stop switches and remove their sockets
+	ShutdownPolicyTeardown string = "teardown"
+)
+
+// Interval at which processes the plugin adopted are checked for exit
+const adoptedProcessPollInterval time.Duration = time.Millisecond * 250
+
+// Set when child processes should outlive the plugin so they can be
+// re-adopted after a restart.
+var detachChildProcesses bool
+
+// Persisted driver state
+type driverState struct {
+	Networks map[string]*networkState
+	Pools    map[string]*poolState
+}
+
+type networkState struct {
+	SockDir  string
+	MgmtSock string
+	// nil if the switch is not managed by the plugin
+	SwitchArgs []string
+	SwitchPID  int
+	// 0 if the sockets are owned by root
+	SocketOwnerUid int
+	LinkDown       bool
+	Pool4          []*poolState
+	Pool6          []*poolState
+	Endpoints      map[string]*endpointState
+	CreateRequest  string `json:",omitempty"`
+}
+
+type endpointState struct {
+	Address       string
+	AddressIPv6   string
+	MacAddress    string
+	Gateway       string
+	GatewayIPv6   string
+	TapDevice     string
+	SandboxKey    string
+	PlugPID       int
+	LinkDown      bool
+	Impairment    *Impairment
+	CreateRequest string `json:",omitempty"`
+}
+
+type poolState struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Gateway      string
+	Allocated    []string
+	// Blocks the network address, and broadcast of IPv4 subpools
+	ReserveEnds bool `json:",omitempty"`
+	// Addresses blocked by ReserveEnds in state saved before it was recorded
+	Unusable   []string `json:",omitempty"`
+	Allocation string   `json:",omitempty"`
+	// Offset round-robin allocation continues from
+	NextOffset   uint64               `json:",omitempty"`
+	Quarantine   time.Duration        `json:",omitempty"`
+	Quarantined  []quarantinedIPState `json:",omitempty"`
+	Excluded     []string             `json:",omitempty"`
+	Reservations map[string]string    `json:",omitempty"`
+	MACBindings  map[string]string    `json:",omitempty"`
+	Sticky       bool                 `json:",omitempty"`
+	// Last IP of each MAC address of sticky pools
+	StickyAddresses map[string]string `json:",omitempty"`
+	// Who requested each assigned IP and when, by IP
+	Assignments map[string]poolAssignmentState `json:",omitempty"`
+	// IPAM driver pool a network pool is shared with
+	PoolID string `json:",omitempty"`
+	// Fingerprint of the RequestPool request of IPAM driver pools
+	Request string `json:",omitempty"`
+}
+
+type poolAssignmentState struct {
+	MAC  string `json:",omitempty"`
+	Time time.Time
+}
+
+type quarantinedIPState struct {
+	Address string
+	Until   time.Time
+}
+
+// startChildProcess starts a long running vde process and returns its stdin
+// pipe, and a function returning the last of its stderr output. vde tools
+// exit when stdin is closed, which normally ties their lifetime to the
+// plugin. Detached children also hold the write end of their own stdin, run
+// in their own process group and write output straight to our stderr, so
+// they survive the plugin exiting. Their output is not captured, since a
+// pipe read by us would break when we exit, so the function always returns
+// an empty string for them and errors about them carry no Stderr.
+func startChildProcess(command string, args ...string) (*exec.Cmd, io.WriteCloser, func() string, error) {
+	if !detachChildProcesses {
+		cmd, stderr := fsutil.LoggedCommandWithStderr(command, args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, nil, fsutil.NewExecError(cmd.Args, err, "")
+		}
+		return cmd, stdin, stderr, nil
+	}
+
+	log.Debugln("Executing Detached Command:", command, args)
+	stdinRead, stdinWrite, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer stdinRead.Close()
+
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = stdinRead
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{stdinWrite}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		stdinWrite.Close()
+		return nil, nil, nil, fsutil.NewExecError(cmd.Args, err, "")
+	}
+	// Output goes straight to our stderr, so none is kept.
+	return cmd, stdinWrite, func() string { return "" }, nil
+}
+
+// adoptProcess returns a handle for a running process which isn't our child,
+// and a channel which is closed when it exits, like the ones fed by Wait()
+// for our own children. onExit is called first.
+func adoptProcess(pid int, onExit func()) (*exec.Cmd, <-chan error) {
+	proc, _ := os.FindProcess(pid)
+	cmd := &exec.Cmd{Process: proc}
+
+	exitCh := make(chan error, 1)
+	go func() {
+		for processAlive(pid) {
+			time.Sleep(adoptedProcessPollInterval)
+		}
+		onExit()
+		close(exitCh)
+	}()
+	return cmd, exitCh
+}
+
+// Check a pid is alive and still the process we expect, by looking for
+// an argument in its command line.
+func processMatches(pid int, arg string) bool {
+	if pid == 0 || !processAlive(pid) {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	for _, a := range strings.Split(string(cmdline), "\x00") {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *IPAMNetworkPool) state() *poolState {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	state := &poolState{
+		AddressSpace:    this.addressSpace,
+		Pool:            this.pool.String(),
+		SubPool:         this.subpool.String(),
+		Allocation:      this.allocation,
+		Allocated:       []string{},
+		ReserveEnds:     this.reserveEnds,
+		NextOffset:      this.nextOffset,
+		Quarantine:      this.quarantine,
+		Reservations:    make(map[string]string),
+		MACBindings:     make(map[string]string),
+		Sticky:          this.sticky,
+		StickyAddresses: make(map[string]string),
+		Assignments:     make(map[string]poolAssignmentState),
+		Request:         this.request,
+	}
+	if this.gateway != nil {
+		state.Gateway = this.gateway.String()
+	}
+	for _, ip := range this.assignedIPs() {
+		state.Allocated = append(state.Allocated, ip.String())
+	}
+	for _, r := range this.excluded {
+		state.Excluded = append(state.Excluded, r.String())
+	}
+	for name, ip := range this.reservations {
+		state.Reservations[name] = ip.String()
+	}
+	for mac, ip := range this.macBindings {
+		state.MACBindings[mac] = ip.String()
+	}
+	for mac, ip := range this.stickyIPs {
+		state.StickyAddresses[mac] = ip.String()
+	}
+	for ip, assignment := range this.assignments {
+		state.Assignments[ip] = poolAssignmentState{assignment.mac, assignment.at}
+	}
+	for _, entry := range this.quarantinedIPs() {
+		state.Quarantined = append(state.Quarantined, quarantinedIPState{entry.ip.String(), entry.until})
+	}
+	return state
+}
+
+// Returns the IPAM driver pool a network pool is shared with, linked to the
+// network, or rebuilds the pool if it is not shared or was since released.
+func (this *VDENetworkDesc) poolFromState(networkId string, state *poolState, pools map[string]*IPAMNetworkPool) (*IPAMNetworkPool, error) {
+	if pool, found := pools[state.PoolID]; found && state.PoolID != "" {
+		pool.linkNetwork(networkId)
+		this.poolIds[pool] = state.PoolID
+		return pool, nil
+	}
+	return poolFromState(state)
+}
+
+func poolFromState(state *poolState) (*IPAMNetworkPool, error) {
+	_, pool, err := net.ParseCIDR(state.Pool)
+	if err != nil {
+		return nil, err
+	}
+	_, subpool, err := net.ParseCIDR(state.SubPool)
+	if err != nil {
+		return nil, err
+	}
+
+	allocation := state.Allocation
+	if allocation == "" {
+		allocation = defaultAllocation(subpool)
+	}
+	reserveEnds := state.ReserveEnds || len(state.Unusable) > 0
+	result := newPool(state.AddressSpace, pool, subpool, net.ParseIP(state.Gateway), allocation, reserveEnds)
+	result.quarantine = state.Quarantine
+	result.request = state.Request
+	if result.excluded, err = parseAddressRanges(strings.Join(state.Excluded, ","), subpool); err != nil {
+		return nil, err
+	}
+	for name, s := range state.Reservations {
+		if ip := net.ParseIP(s); ip != nil {
+			result.reservations[name] = ip
+		}
+	}
+	for mac, s := range state.MACBindings {
+		if ip := net.ParseIP(s); ip != nil {
+			result.macBindings[mac] = ip
+			result.boundIPs[ip.String()] = mac
+		}
+	}
+	result.sticky = state.Sticky
+	for mac, s := range state.StickyAddresses {
+		if ip := net.ParseIP(s); ip != nil {
+			result.stickyIPs[mac] = ip
+		}
+	}
+	for _, s := range state.Allocated {
+		if ip := net.ParseIP(s); ip != nil {
+			result.markAssigned(ip)
+		}
+	}
+	for _, entry := range state.Quarantined {
+		if ip := net.ParseIP(entry.Address); ip != nil {
+			result.quarantineIP(ip, entry.Until)
+		}
+	}
+	// Only records of the addresses restored as assigned are kept.
+	for s, assignment := range state.Assignments {
+		if ip := net.ParseIP(s); ip != nil && result.isAssigned(ip) {
+			result.recordAssignment(ip, assignment.MAC, assignment.Time)
+		}
+	}
+	// Restoring the assigned addresses moved it
+	result.nextOffset = state.NextOffset
+	return result, nil
+}
+
+// Caller must hold the network lock.
+func (this *VDENetworkEndpoint) state() *endpointState {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	state := &endpointState{
+		Address:       this.GetIPv4CIDRAddress(),
+		AddressIPv6:   this.GetIPv6CIDRAddress(),
+		MacAddress:    this.GetMACAddress(),
+		Gateway:       this.GetIPv4Gateway(),
+		GatewayIPv6:   this.GetIPv6Gateway(),
+		TapDevice:     this.tapDevName,
+		SandboxKey:    this.sandboxKey,
+		LinkDown:      this.linkDown,
+		Impairment:    this.impairment,
+		CreateRequest: this.createRequest,
+	}
+	if this.tapPlugCmd != nil {
+		state.PlugPID = this.tapPlugCmd.Process.Pid
+	}
+	return state
+}
+
+func endpointFromState(state *endpointState) (*VDENetworkEndpoint, error) {
+	endpoint := &VDENetworkEndpoint{
+		gateway:       net.ParseIP(state.Gateway),
+		gateway6:      net.ParseIP(state.GatewayIPv6),
+		tapDevName:    state.TapDevice,
+		sandboxKey:    state.SandboxKey,
+		linkDown:      state.LinkDown,
+		impairment:    state.Impairment,
+		createRequest: state.CreateRequest,
+	}
+
+	var err error
+	if endpoint.macAddress, err = net.ParseMAC(state.MacAddress); err != nil {
+		return nil, err
+	}
+	if state.Address != "" {
+		ip, ipNet, err := net.ParseCIDR(state.Address)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.address, endpoint.addressNet = ip, *ipNet
+	}
+	if state.AddressIPv6 != "" {
+		ip, ipNet, err := net.ParseCIDR(state.AddressIPv6)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.address6, endpoint.addressNet6 = ip, *ipNet
+	}
+	return endpoint, nil
+}
+
+func (this *VDENetworkDesc) state() *networkState {
+	state := &networkState{
+		SockDir:        this.sockDir,
+		MgmtSock:       this.mgmtSock,
+		SwitchArgs:     this.switchArgs,
+		SocketOwnerUid: this.socketOwnerUid,
+		LinkDown:       this.linkDown,
+		CreateRequest:  this.createRequest,
+		Pool4:          []*poolState{},
+		Pool6:          []*poolState{},
+		Endpoints:      make(map[string]*endpointState),
+	}
+	if this.switchp != nil {
+		state.SwitchPID = this.switchp.Process.Pid
+	}
+	for _, pool := range this.pool4 {
+		poolState := pool.state()
+		poolState.PoolID = this.poolIds[pool]
+		state.Pool4 = append(state.Pool4, poolState)
+	}
+	for _, pool := range this.pool6 {
+		poolState := pool.state()
+		poolState.PoolID = this.poolIds[pool]
+		state.Pool6 = append(state.Pool6, poolState)
+	}
+	for endpointId, endpoint := range this.networkEndpoints {
+		state.Endpoints[endpointId] = endpoint.state()
+	}
+	return state
+}
+
+// Rebuild a network from persisted state, adopting its switch and plugs if
+// they are still running and restarting them if not. Pools shared with the
+// IPAM driver are linked again if they are in pools, by PoolID.
+func networkFromState(ctx context.Context, networkId string, state *networkState, pools map[string]*IPAMNetworkPool) (*VDENetworkDesc, error) {
+	log := log.With("NetworkID", networkId)
+
+	network := &VDENetworkDesc{
+		sockDir:          state.SockDir,
+		mgmtSock:         state.MgmtSock,
+		switchArgs:       state.SwitchArgs,
+		socketOwnerUid:   state.SocketOwnerUid,
+		linkDown:         state.LinkDown,
+		createRequest:    state.CreateRequest,
+		poolIds:          make(map[*IPAMNetworkPool]string),
+		networkEndpoints: make(VDENetworkEndpoints),
+	}
+	for _, s := range state.Pool4 {
+		pool, err := network.poolFromState(networkId, s, pools)
+		if err != nil {
+			return nil, err
+		}
+		network.pool4 = append(network.pool4, pool)
+	}
+	for _, s := range state.Pool6 {
+		pool, err := network.poolFromState(networkId, s, pools)
+		if err != nil {
+			return nil, err
+		}
+		network.pool6 = append(network.pool6, pool)
+	}
+
+	switchAlive := state.SwitchArgs == nil || processMatches(state.SwitchPID, state.SockDir)
+	if switchAlive && state.SwitchArgs != nil {
+		network.adoptSwitch(state.SwitchPID)
+		log.With("PID", state.SwitchPID).Infoln("Adopted running vde_switch")
+	} else if !switchAlive {
+		log.Warnln("vde_switch is no longer running, restarting it")
+		os.RemoveAll(network.sockDir)
+		os.Remove(network.mgmtSock)
+		if err := network.startSwitch(); err != nil {
+			return nil, err
+		}
+		metricProcessRestarts.Inc(processSwitch)
+	}
+
+	for endpointId, s := range state.Endpoints {
+		log := log.With("EndpointID", endpointId)
+		endpoint, err := endpointFromState(s)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Could not restore endpoint", endpointId, err))
+		}
+		network.networkEndpoints[endpointId] = endpoint
+
+		// Endpoints which weren't joined have nothing to adopt
+		if s.PlugPID == 0 {
+			continue
+		}
+		if switchAlive && processMatches(s.PlugPID, state.SockDir) {
+			endpoint.adoptTapCmd(s.PlugPID)
+			continue
+		}
+
+		// Plugs into a restarted switch have to be reconnected too.
+		log.Warnln("Reconnecting endpoint to vde_switch")
+		if err := endpoint.replug(ctx, network.sockDir); err != nil {
+			log.Errorln("Error reconnecting endpoint:", err)
+			continue
+		}
+		if network.linkDown || endpoint.linkDown {
+			if err := endpoint.applyLinkState(ctx, true); err != nil {
+				log.Errorln("Error disabling link of reconnected endpoint:", err)
+			}
+		}
+	}
+	return network, nil
+}
+
+// SaveState writes the state of all networks and pools to path.
+func (this *VDENetworkDriver) SaveState(path string) error {
+	state := &driverState{
+		Networks: make(map[string]*networkState),
+		Pools:    make(map[string]*poolState),
+	}
+	for networkId, network := range this.listNetworks() {
+		network.mtx.RLock()
+		if !network.removed {
+			state.Networks[networkId] = network.state()
+		}
+		network.mtx.RUnlock()
+	}
+
+	this.ipamMtx.RLock()
+	defer this.ipamMtx.RUnlock()
+	for poolId, pool := range this.ipam {
+		state.Pools[poolId] = pool.state()
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write atomically so a crash can't leave a truncated state file
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RestoreState loads networks and pools persisted by SaveState and re-adopts
+// their processes. The state file is removed afterwards, since it is stale
+// as soon as the plugin starts handling requests.
+func (this *VDENetworkDriver) RestoreState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	state := &driverState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return errors.New(fmt.Sprintln("Could not parse state file:", err))
+	}
+
+	// Pools restored from the IPAM journal are more recent.
+	this.ipamMtx.Lock()
+	for poolId, s := range state.Pools {
+		if _, found := this.ipam[poolId]; found {
+			continue
+		}
+		pool, err := poolFromState(s)
+		if err != nil {
+			log.With("PoolID", poolId).Errorln("Could not restore pool:", err)
+			continue
+		}
+		if err := this.ipamJournal.Append(ipamOpPool, poolId, s, ""); err != nil {
+			log.With("PoolID", poolId).Errorln("Could not journal restored pool:", err)
+		}
+		pool.awaitReplay()
+		this.ipam[poolId] = pool
+	}
+	this.ipamMtx.Unlock()
+
+	// Networks share the restored pools. Copied so the IPAM lock is not
+	// held with the driver lock.
+	this.ipamMtx.RLock()
+	pools := make(map[string]*IPAMNetworkPool, len(this.ipam))
+	for poolId, pool := range this.ipam {
+		pools[poolId] = pool
+	}
+	this.ipamMtx.RUnlock()
+
+	// Restoring happens before requests are handled, so holding the driver
+	// lock throughout is fine.
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+	for networkId, s := range state.Networks {
+		ctx, cancel := this.requestContext()
+		network, err := networkFromState(ctx, networkId, s, pools)
+		cancel()
+		if err != nil {
+			log.With("NetworkID", networkId).Errorln("Could not restore network:", err)
+			continue
+		}
+		this.networks[networkId] = network
+		log.With("NetworkID", networkId).With("Endpoints", len(network.networkEndpoints)).
+			Infoln("Restored network")
+	}
+	return nil
+}
+
+// Teardown stops every plug, deletes every tap device and stops every
+// switch the plugin manages, removing their sockets. Host commands are
+// killed once ctx is done.
+func (this *VDENetworkDriver) Teardown(ctx context.Context) {
+	for networkId, network := range this.listNetworks() {
+		log := log.With("NetworkID", networkId)
+		network.mtx.Lock()
+		if network.removed {
+			network.mtx.Unlock()
+			continue
+		}
+		for endpointId, endpoint := range network.networkEndpoints {
+			if err := endpoint.forceCleanup(ctx); err != nil {
+				log.With("EndpointID", endpointId).Errorln("Error cleaning up endpoint:", err)
+			}
+			this.names.ReleaseInterface(endpointId)
+		}
+		if network.switchp != nil {
+			network.stopSwitch()
+			os.RemoveAll(network.sockDir)
+			os.Remove(network.mgmtSock)
+		}
+		this.removeNetwork(networkId, network)
+		this.names.ReleaseSocketDir(networkId)
+		network.mtx.Unlock()
+		log.Infoln("Tore down network")
+	}
+}
+
+// Shutdown applies the shutdown policy, giving up after timeout. With the
+// preserve policy the state is written to statePath.
+func (this *VDENetworkDriver) Shutdown(policy string, statePath string, timeout time.Duration) error {
+	log.With("Policy", policy).Infoln("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Host commands still running at the timeout are killed through ctx.
+	doneCh := make(chan error, 1)
+	go func() {
+		switch policy {
+		case ShutdownPolicyPreserve:
+			if err := os.MkdirAll(filepath.Dir(statePath), os.FileMode(0755)); err != nil {
+				doneCh <- err
+				return
+			}
+			doneCh <- this.SaveState(statePath)
+		case ShutdownPolicyTeardown:
+			this.Teardown(ctx)
+			doneCh <- nil
+		default:
+			doneCh <- errors.New(fmt.Sprintln("Unknown shutdown policy:", policy))
+		}
+	}()
+
+	select {
+	case err := <-doneCh:
+		return err
+	case <-ctx.Done():
+		return errors.New("Shutdown did not complete before the timeout")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/docker/libnetwork/netlabel"
+)
+
+// Saves a pool and restores it again, as its state file or journal entry.
+func roundTripPool(t *testing.T, pool *IPAMNetworkPool) *IPAMNetworkPool {
+	data, err := json.Marshal(pool.state())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &poolState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := poolFromState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restored
+}
+
+func TestPoolStateRoundTrip(t *testing.T) {
+	pool, err := NewIPAMPool(&ipam.RequestPoolRequest{
+		AddressSpace: IPAMDefaultAddressSpaceLocal,
+		Pool:         "10.1.0.0/24",
+		Options:      map[string]string{PoolOptionReleaseQuarantine: "1h"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		pool.AssignIP(nil, testMAC(i))
+	}
+	released := net.ParseIP("10.1.0.2")
+	pool.ReleaseIP(released, pool.assignments[released.String()].at)
+
+	restored := roundTripPool(t, pool)
+	saved, _ := json.Marshal(pool.state())
+	if restoredSaved, _ := json.Marshal(restored.state()); string(restoredSaved) != string(saved) {
+		t.Fatalf("Restored pool %s, expected %s", restoredSaved, saved)
+	}
+	if len(restored.assignments) != 3 {
+		t.Fatalf("Restored assignments %v, expected %v", restored.assignments, pool.assignments)
+	}
+	if !restored.reserveEnds {
+		t.Fatal("IPAM driver pool no longer reserves its ends")
+	}
+
+	// Network pools don't reserve their ends, even with nothing assigned.
+	networkPool, err := NewIPAMNetworkPool(&network.IPAMData{Pool: "10.2.0.0/24", Gateway: "10.2.0.1/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTripPool(t, networkPool).reserveEnds {
+		t.Fatal("Network pool reserves its ends once restored")
+	}
+
+	// State saved before ReserveEnds was recorded lists the addresses.
+	restored, err = poolFromState(&poolState{Pool: "10.1.0.0/24", SubPool: "10.1.0.0/24", Unusable: []string{"10.1.0.0", "10.1.0.255"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.reserveEnds {
+		t.Fatal("Pool of older state no longer reserves its ends")
+	}
+}
+
+// Assignments survive restarts, including from the compacted journal.
+func TestAssignmentsSurviveRestarts(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+	if err := driver.RestoreIPAM(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := driver.RequestPool(&ipam.RequestPoolRequest{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := driver.RequestAddress(&ipam.RequestAddressRequest{
+		PoolID:  pool.PoolID,
+		Options: map[string]string{netlabel.MacAddress: testMAC(1).String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, _, err := net.ParseCIDR(address.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first restart replays the journal, and compacts it into the
+	// snapshot the second restores.
+	driver = restartTestDriver(t, driver)
+	expected, found := driver.ipam[pool.PoolID].assignments[ip.String()]
+	if !found || expected.mac != testMAC(1).String() {
+		t.Fatalf("Journal replay restored assignment %+v", expected)
+	}
+	driver = restartTestDriver(t, driver)
+	restored := driver.ipam[pool.PoolID]
+	if assignment := restored.assignments[ip.String()]; assignment.mac != expected.mac || !assignment.at.Equal(expected.at) {
+		t.Fatalf("Compacted journal restored assignment %+v, expected %+v", assignment, expected)
+	}
+	if !restored.reserveEnds {
+		t.Fatal("Compacted journal restored the pool without its ends reserved")
+	}
+}
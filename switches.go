@@ -0,0 +1,353 @@
+// switches runs the predefined switches from the configuration file, along
+// with their cables and uplinks, restarting any process which exits.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+
+	"github.com/wrouesnel/docker-vde-plugin/fsutil"
+)
+
+// Process name used as metric label for cables
+const processCable string = "dpipe"
+
+// Error type used as metric label for supervised processes failing to start
+const errorSupervisedStart string = "supervised_start"
+
+// Delay before restarting a supervised process which exited
+const supervisedRestartDelay time.Duration = time.Second
+
+// Time to wait for a switch to create its management socket
+const managementSocketWait time.Duration = time.Second * 5
+
+// Longest time the commands creating or removing an uplink may take
+const uplinkCommandTimeout time.Duration = time.Second * 10
+
+// supervisedProcess keeps a process running until it is stopped.
+type supervisedProcess struct {
+	command string
+	args    []string
+	// Process label for metrics
+	label string
+	// Called after each (re)start
+	onStart func()
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func superviseProcess(label string, onStart func(), command string, args ...string) *supervisedProcess {
+	this := &supervisedProcess{
+		command: command,
+		args:    args,
+		label:   label,
+		onStart: onStart,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	go this.run()
+	return this
+}
+
+func (this *supervisedProcess) run() {
+	defer close(this.doneCh)
+	log := log.With("cmd", this.command).With("args", this.args)
+
+	// A process preserved by a previous instance of the plugin is adopted
+	// rather than started a second time.
+	if pid := findProcess(this.command, this.args...); pid != 0 {
+		log.With("PID", pid).Infoln("Adopted running supervised process")
+		cmd, exitCh := adoptProcess(pid, func() {})
+		if this.wait(cmd, nil, exitCh) {
+			return
+		}
+		log.Warnln("Supervised process exited, restarting it")
+	}
+
+	for {
+		cmd, stdin, _, err := startChildProcess(this.command, this.args...)
+		if err != nil {
+			log.Errorln("Error starting supervised process:", err)
+			metricErrors.Inc(errorSupervisedStart)
+		} else {
+			exitCh := make(chan error, 1)
+			go func() {
+				exitCh <- cmd.Wait()
+			}()
+			if this.wait(cmd, stdin, exitCh) {
+				return
+			}
+			log.Warnln("Supervised process exited, restarting it")
+		}
+
+		select {
+		case <-this.stopCh:
+			return
+		case <-time.After(supervisedRestartDelay):
+			metricProcessRestarts.Inc(this.label)
+		}
+	}
+}
+
+// Wait for a started or adopted process to exit or be stopped. stdin is nil
+// for adopted processes. Returns true if it was stopped.
+func (this *supervisedProcess) wait(cmd *exec.Cmd, stdin io.WriteCloser, exitCh <-chan error) bool {
+	metricProcessStarts.Inc(this.label)
+	if this.onStart != nil {
+		this.onStart()
+	}
+
+	select {
+	case <-exitCh:
+		metricProcessExits.Inc(this.label, "false")
+		return false
+	case <-this.stopCh:
+		// vde tools exit on EOF, but not all of them clean up.
+		if stdin != nil {
+			stdin.Close()
+		}
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exitCh:
+		case <-time.After(VdeSwitchStopTimeout):
+			cmd.Process.Kill()
+			<-exitCh
+		}
+		metricProcessExits.Inc(this.label, "true")
+		return true
+	}
+}
+
+// Stop the process and wait for it to exit.
+func (this *supervisedProcess) Stop() {
+	close(this.stopCh)
+	<-this.doneCh
+}
+
+// A running predefined switch
+type configuredSwitch struct {
+	config  *SwitchConfig
+	switchp *supervisedProcess
+	cables  []*supervisedProcess
+	// Plugs of uplinks by tap device
+	uplinks map[string]*supervisedProcess
+}
+
+// SwitchManager runs the switches declared in the configuration file.
+type SwitchManager struct {
+	switches map[string]*configuredSwitch
+	mtx      sync.RWMutex
+}
+
+func NewSwitchManager() *SwitchManager {
+	return &SwitchManager{
+		switches: make(map[string]*configuredSwitch),
+	}
+}
+
+// Lookup returns the socket directory and management socket of a predefined
+// switch.
+func (this *SwitchManager) Lookup(name string) (string, string, bool) {
+	if this == nil {
+		return "", "", false
+	}
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+
+	sw, found := this.switches[name]
+	if !found {
+		return "", "", false
+	}
+	return sw.config.SocketDir, sw.config.ManagementSocket, true
+}
+
+// Apply starts switches added to the configuration, stops removed ones and
+// restarts changed ones. Switches whose socket directory inUse reports as
+// used by a docker network are not stopped.
+func (this *SwitchManager) Apply(config *Config, inUse func(sockDir string) bool) {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for name, sw := range this.switches {
+		newConfig, found := config.Switches[name]
+		if found && reflect.DeepEqual(newConfig, sw.config) {
+			continue
+		}
+		if inUse(sw.config.SocketDir) {
+			log.With("Switch", name).Errorln("Not stopping switch in use by a docker network")
+			continue
+		}
+		log.With("Switch", name).Infoln("Stopping switch")
+		sw.stop()
+		delete(this.switches, name)
+	}
+
+	// Start switches before cables so cables between them can connect.
+	started := []*configuredSwitch{}
+	for name, swConfig := range config.Switches {
+		if _, found := this.switches[name]; found {
+			continue
+		}
+		log.With("Switch", name).With("SocketDir", swConfig.SocketDir).Infoln("Starting switch")
+		sw := startConfiguredSwitch(name, swConfig)
+		this.switches[name] = sw
+		started = append(started, sw)
+	}
+	for _, sw := range started {
+		sw.startCables()
+	}
+}
+
+// StopAll stops every predefined switch.
+func (this *SwitchManager) StopAll() {
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	for name, sw := range this.switches {
+		log.With("Switch", name).Infoln("Stopping switch")
+		sw.stop()
+		delete(this.switches, name)
+	}
+}
+
+func startConfiguredSwitch(name string, config *SwitchConfig) *configuredSwitch {
+	log := log.With("Switch", name)
+	this := &configuredSwitch{
+		config:  config,
+		uplinks: make(map[string]*supervisedProcess),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.SocketDir), os.FileMode(0755)); err != nil {
+		log.Errorln("Could not create socket directory parent:", err)
+	}
+
+	this.switchp = superviseProcess(processSwitch, func() {
+		if err := configureSwitch(config); err != nil {
+			log.Errorln("Error configuring switch:", err)
+		}
+	}, "vde_switch", config.switchArgs()...)
+
+	for _, uplink := range config.Uplinks {
+		log := log.With("TapDevice", uplink.Tap)
+		args := []string{"--sock", config.SocketDir, uplink.Tap}
+		// The tap device of a preserved uplink is still in use by its plug.
+		if findProcess("vde_plug2tap", args...) == 0 {
+			if err := createUplink(uplink); err != nil {
+				log.Errorln("Error creating uplink tap device:", err)
+				continue
+			}
+		}
+		this.uplinks[uplink.Tap] = superviseProcess(processPlug, nil, "vde_plug2tap", args...)
+	}
+	return this
+}
+
+// Connect cables. The far end is supervised too, so a cable reconnects when
+// either switch is restarted.
+func (this *configuredSwitch) startCables() {
+	for _, cable := range this.config.Cables {
+		args := append(plugArgs(this.config.SocketDir, cable.Port), "=")
+		args = append(args, plugArgs(cable.To, cable.ToPort)...)
+		this.cables = append(this.cables, superviseProcess(processCable, nil, "dpipe", args...))
+	}
+}
+
+func (this *configuredSwitch) stop() {
+	for _, cable := range this.cables {
+		cable.Stop()
+	}
+	for tap, uplink := range this.uplinks {
+		uplink.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), uplinkCommandTimeout)
+		if err := fsutil.CheckExec(ctx, "ip", "link", "delete", "dev", tap); err != nil {
+			log.Errorln("Error removing uplink tap device:", err)
+		}
+		cancel()
+	}
+	this.switchp.Stop()
+}
+
+// vde_plug command line to connect to a switch, optionally on a given port.
+func plugArgs(sockDir string, port int) []string {
+	args := []string{"vde_plug"}
+	if port != 0 {
+		args = append(args, "--port", strconv.Itoa(port))
+	}
+	return append(args, sockDir)
+}
+
+// Create the tap device of an uplink. A partly configured tap device is
+// removed again.
+func createUplink(uplink UplinkConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), uplinkCommandTimeout)
+	defer cancel()
+
+	undo := newUndoStack(log.With("TapDevice", uplink.Tap), uplinkCommandTimeout)
+	defer undo.Rollback()
+
+	if err := fsutil.CheckExec(ctx, "ip", "tuntap", "add", "dev", uplink.Tap, "mode", "tap"); err != nil {
+		return err
+	}
+	// Deleting the tap device also removes the addresses added to it.
+	undo.Push("delete uplink tap device", func(ctx context.Context) error {
+		return fsutil.CheckExec(ctx, "ip", "link", "delete", "dev", uplink.Tap)
+	})
+	for _, address := range uplink.Addresses {
+		if err := fsutil.CheckExec(ctx, "ip", "address", "add", address, "dev", uplink.Tap); err != nil {
+			return err
+		}
+	}
+	if err := fsutil.CheckExec(ctx, "ip", "link", "set", "dev", uplink.Tap, "up"); err != nil {
+		return err
+	}
+	undo.Commit()
+	return nil
+}
+
+// Apply the VLAN configuration to a freshly started switch.
+func configureSwitch(config *SwitchConfig) error {
+	if len(config.VLANs) == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(managementSocketWait)
+	for !fsutil.PathIsSocket(config.ManagementSocket) {
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("Management socket %s did not appear", config.ManagementSocket))
+		}
+		time.Sleep(VdeSwitchGracePeriod)
+	}
+
+	mgmt, err := DialVDEManagement(config.ManagementSocket)
+	if err != nil {
+		return err
+	}
+	defer mgmt.Close()
+
+	// Ports only exist once something connects, so create the ones VLANs are
+	// assigned to. They may already exist.
+	for _, vlan := range config.VLANs {
+		for _, port := range vlan.ports() {
+			mgmt.Command(fmt.Sprintf("port/create %d", port))
+		}
+	}
+	for _, command := range config.vlanCommands() {
+		if _, err := mgmt.Command(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
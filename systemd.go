@@ -0,0 +1,134 @@
+// systemd integration: socket activation, readiness and watchdog
+// notifications. All of it is a no-op when not running under systemd.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-systemd/activation"
+	"github.com/wrouesnel/go.log"
+	"github.com/wrouesnel/multihttp"
+)
+
+// Notification states sent to systemd
+const (
+	sdNotifyReady    string = "READY=1"
+	sdNotifyStopping string = "STOPPING=1"
+	sdNotifyWatchdog string = "WATCHDOG=1"
+)
+
+// ActivatedListeners holds the listeners systemd passed to the process by
+// socket activation, keyed by their address.
+type ActivatedListeners map[string]net.Listener
+
+// NewActivatedListeners collects the socket activated listeners, if any.
+func NewActivatedListeners() ActivatedListeners {
+	this := make(ActivatedListeners)
+	listeners, _ := activation.Listeners(true)
+	for _, l := range listeners {
+		if l == nil {
+			continue
+		}
+		log.With("Address", l.Addr().String()).Infoln("Received socket activated listener")
+		this[l.Addr().String()] = l
+	}
+	return this
+}
+
+// Take removes and returns the activated listener for a listen URL (e.g.
+// unix:///run/docker/plugins/vde.sock), or nil if systemd didn't pass one.
+func (this ActivatedListeners) Take(address string) net.Listener {
+	_, addr, err := multihttp.ParseAddress(address)
+	if err != nil {
+		return nil
+	}
+	l, found := this[addr]
+	if !found {
+		return nil
+	}
+	delete(this, addr)
+	return l
+}
+
+// Listen serves handler on the given listen URLs, using activated listeners
+// where available. Listeners created by this function are returned
+// separately, since only those should have their sockets removed on exit.
+func (this ActivatedListeners) Listen(addresses []string, handler http.Handler) ([]net.Listener, []net.Listener, error) {
+	activated := []net.Listener{}
+	unbound := []string{}
+	for _, address := range addresses {
+		if l := this.Take(address); l != nil {
+			go http.Serve(l, handler)
+			activated = append(activated, l)
+		} else {
+			unbound = append(unbound, address)
+		}
+	}
+
+	listeners, err := multihttp.Listen(unbound, handler)
+	return activated, listeners, err
+}
+
+// CloseUnused closes activated listeners which no listen address claimed.
+func (this ActivatedListeners) CloseUnused() {
+	for addr, l := range this {
+		log.With("Address", addr).Warnln("Closing socket activated listener with no matching listen address")
+		l.Close()
+		delete(this, addr)
+	}
+}
+
+// sdNotify sends a state notification to systemd. Does nothing if the
+// process was not started with a notification socket.
+func sdNotify(state string) error {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval the systemd watchdog expects to be
+// notified at, or 0 if the watchdog is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startWatchdog notifies the systemd watchdog at half its timeout. check is
+// called before each notification and should block if the plugin is wedged.
+func startWatchdog(check func()) {
+	timeout := sdWatchdogInterval()
+	if timeout == 0 {
+		return
+	}
+
+	log.Infoln("Notifying systemd watchdog every", timeout/2)
+	go func() {
+		for _ = range time.Tick(timeout / 2) {
+			check()
+			if err := sdNotify(sdNotifyWatchdog); err != nil {
+				log.Warnln("Failed to notify systemd watchdog:", err)
+			}
+		}
+	}()
+}
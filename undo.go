@@ -0,0 +1,72 @@
+// undo rolls back the host changes made by a multi-step driver operation
+// when a later step fails, so a failed request leaves nothing behind.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/wrouesnel/go.log"
+)
+
+// A step undoing a single host change.
+type undoStep struct {
+	desc string
+	fn   func(ctx context.Context) error
+}
+
+// undoStack records how to undo each step of an operation as it succeeds.
+// Unless the operation commits, Rollback undoes the steps in reverse order.
+// Typical use:
+//
+//	undo := newUndoStack(log, timeout)
+//	defer undo.Rollback()
+//	... make a change, then undo.Push("what to undo", func...) ...
+//	undo.Commit()
+type undoStack struct {
+	log     log.Logger
+	timeout time.Duration
+	steps   []undoStep
+}
+
+// newUndoStack returns an empty stack. Rolling back is given its own timeout,
+// since the operation's context may be what failed it.
+func newUndoStack(log log.Logger, timeout time.Duration) *undoStack {
+	return &undoStack{
+		log:     log,
+		timeout: timeout,
+	}
+}
+
+// Push records how to undo the step which just succeeded.
+func (this *undoStack) Push(desc string, fn func(ctx context.Context) error) {
+	this.steps = append(this.steps, undoStep{desc, fn})
+}
+
+// Commit keeps every change made, making Rollback a no-op.
+func (this *undoStack) Commit() {
+	this.steps = nil
+}
+
+// Rollback undoes every recorded step, latest first. Failing steps are logged
+// and the rest are still undone.
+func (this *undoStack) Rollback() {
+	if len(this.steps) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+
+	this.log.With("Steps", len(this.steps)).Warnln("Operation failed, rolling back")
+	for i := len(this.steps) - 1; i >= 0; i-- {
+		step := this.steps[i]
+		if err := step.fn(ctx); err != nil {
+			this.log.With("Step", step.desc).Errorln("Error rolling back:", err)
+			continue
+		}
+		this.log.With("Step", step.desc).Infoln("Rolled back")
+	}
+	this.steps = nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/docker/go-plugins-helpers/network"
+	"github.com/wrouesnel/go.log"
+)
+
+func TestUndoStackRollsBackInReverseOrder(t *testing.T) {
+	undone := []string{}
+	undo := newUndoStack(log.Base(), time.Second)
+	for _, step := range []string{"first", "second", "third"} {
+		step := step
+		undo.Push(step, func(ctx context.Context) error {
+			undone = append(undone, step)
+			if step == "second" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+	undo.Rollback()
+
+	// A failing step does not stop the steps before it being undone.
+	if expected := []string{"third", "second", "first"}; !reflect.DeepEqual(undone, expected) {
+		t.Fatalf("Undone %v, expected %v", undone, expected)
+	}
+	undo.Rollback()
+	if len(undone) != 3 {
+		t.Fatal("Steps were undone twice")
+	}
+}
+
+func TestUndoStackCommit(t *testing.T) {
+	undo := newUndoStack(log.Base(), time.Second)
+	undo.Push("step", func(ctx context.Context) error {
+		t.Fatal("Committed step was undone")
+		return nil
+	})
+	undo.Commit()
+	undo.Rollback()
+}
+
+// Host commands of a successful Join, with a pattern failing each one.
+var joinSteps = []struct {
+	command string
+	fail    string
+}{
+	{"ip tuntap add dev %s mode tap", "tuntap add"},
+	{"ip link set dev %s address 02:42:0a:01:00:02", "address 02:42"},
+	{"ip link set dev %s up", " up"},
+	{"ip address add 10.1.0.2/16 dev %s", "address add 10."},
+	{"ip address add fd00::2/64 dev %s", "address add fd00"},
+	{"vde_plug2tap --sock", ""},
+}
+
+func TestJoinRollback(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	req := createNetworkRequest("network", 1)
+	req.IPv6Data = []*network.IPAMData{{
+		AddressSpace: IPAMDefaultAddressSpaceLocal,
+		Pool:         "fd00::/64",
+		Gateway:      "fd00::1/64",
+	}}
+	if err := driver.CreateNetwork(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.CreateEndpoint(&network.CreateEndpointRequest{
+		NetworkID:  "network",
+		EndpointID: "endpoint",
+		Interface: &network.EndpointInterface{
+			Address:     "10.1.0.2/16",
+			AddressIPv6: "fd00::2/64",
+			MacAddress:  "02:42:0a:01:00:02",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	join := &network.JoinRequest{NetworkID: "network", EndpointID: "endpoint", SandboxKey: "/var/run/docker/netns/test"}
+
+	for failing, step := range joinSteps {
+		commands := recordCommands(t, step.fail)
+		// A plug which can't be started fails the join.
+		restore := func() {}
+		if step.fail == "" {
+			restore = breakCommand(t, "vde_plug2tap")
+		}
+		_, err := driver.Join(join)
+		restore()
+		run := commands()
+		if err == nil {
+			t.Fatalf("Join succeeded with step %d failing", failing)
+		}
+
+		// Every step up to the failing one ran, then the tap device was
+		// deleted if it had been created.
+		tap := strings.Fields(run[0])[4]
+		expected := []string{}
+		for _, s := range joinSteps[:failing+1] {
+			if strings.Contains(s.command, "%s") {
+				expected = append(expected, fmt.Sprintf(s.command, tap))
+			}
+		}
+		if failing > 0 {
+			expected = append(expected, "ip link delete dev "+tap)
+		}
+		if !commandsMatch(run, expected) {
+			t.Errorf("Step %d failing ran:\n%s\nexpected:\n%s", failing, strings.Join(run, "\n"), strings.Join(expected, "\n"))
+		}
+
+		_, endpoint, unlock, err := driver.lockEndpoint("network", "endpoint")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint.tapDevName != "" || endpoint.tapPlugCmd != nil {
+			t.Errorf("Step %d failing left tap device %q behind", failing, endpoint.tapDevName)
+		}
+		unlock()
+		if _, found := driver.names.Interfaces["endpoint"]; found {
+			t.Errorf("Step %d failing left the tap device name allocated", failing)
+		}
+	}
+
+	// Nothing is left behind which stops the join succeeding.
+	if _, err := driver.Join(join); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateNetworkRollback(t *testing.T) {
+	driver, cleanup := newTestDriver(t)
+	defer cleanup()
+
+	// Socket directories in a directory which doesn't exist yet, which is
+	// created for the switch.
+	parent := filepath.Join(driver.socketRoot, "deep", "path")
+	req := createNetworkRequest("network", 1)
+	req.Options = map[string]interface{}{
+		dockerGenericOptions: map[string]interface{}{
+			NetworkOptionSwitchSocket: filepath.Join(parent, "switch"),
+			NetworkOptionsAllowCreate: "true",
+		},
+	}
+
+	commands := recordCommands(t, "vde_switch")
+	if err := driver.CreateNetwork(req); err == nil {
+		t.Fatal("CreateNetwork succeeded with vde_switch failing")
+	}
+	if run := commands(); !commandsMatch(run, []string{"vde_switch --sock " + filepath.Join(parent, "switch")}) {
+		t.Errorf("Unexpected commands run: %v", run)
+	}
+	if _, err := os.Stat(filepath.Join(driver.socketRoot, "deep")); !os.IsNotExist(err) {
+		t.Error("Created socket directory parents were not removed")
+	}
+	if len(driver.ListNetworks()) != 0 {
+		t.Error("Failed network was not removed")
+	}
+
+	// Without a socket directory, the allocated name is released too.
+	req.Options = nil
+	commands = recordCommands(t, "vde_switch")
+	if err := driver.CreateNetwork(req); err == nil {
+		t.Fatal("CreateNetwork succeeded with vde_switch failing")
+	}
+	commands()
+	if len(driver.names.Networks) != 0 {
+		t.Error("Socket directory name was not released")
+	}
+	entries, err := ioutil.ReadDir(driver.socketRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			t.Errorf("Socket directory %s was left behind", entry.Name())
+		}
+	}
+
+	// Bad address data fails after the pools before it were linked, which
+	// are unlinked again.
+	pool, err := driver.RequestPool(&ipam.RequestPoolRequest{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestGateway(t, driver, pool.PoolID, "10.1.0.1")
+	req.IPv6Data = []*network.IPAMData{{AddressSpace: IPAMDefaultAddressSpaceLocal, Pool: "fd00::/64", Gateway: "bad"}}
+	if err := driver.CreateNetwork(req); err == nil {
+		t.Fatal("CreateNetwork succeeded with a bad gateway")
+	}
+	if linked := driver.ipam[pool.PoolID].network; linked != "" {
+		t.Errorf("Pool is still linked to network %s", linked)
+	}
+
+	req.IPv6Data = nil
+	if err := driver.CreateNetwork(req); err != nil {
+		t.Fatal(err)
+	}
+	if linked := driver.ipam[pool.PoolID].network; linked != "network" {
+		t.Errorf("Pool is linked to network %q", linked)
+	}
+}
+
+func TestCreateUplinkRollback(t *testing.T) {
+	uplink := UplinkConfig{Tap: "vdetestup0", Addresses: []string{"10.9.0.1/24"}}
+	steps := []struct {
+		command string
+		fail    string
+	}{
+		{"ip tuntap add dev vdetestup0 mode tap", "tuntap add"},
+		{"ip address add 10.9.0.1/24 dev vdetestup0", "address add"},
+		{"ip link set dev vdetestup0 up", " up"},
+	}
+	for failing, step := range steps {
+		commands := recordCommands(t, step.fail)
+		err := createUplink(uplink)
+		run := commands()
+		if err == nil {
+			t.Fatalf("createUplink succeeded with step %d failing", failing)
+		}
+
+		expected := []string{}
+		for _, s := range steps[:failing+1] {
+			expected = append(expected, s.command)
+		}
+		if failing > 0 {
+			expected = append(expected, "ip link delete dev vdetestup0")
+		}
+		if !commandsMatch(run, expected) {
+			t.Errorf("Step %d failing ran:\n%s\nexpected:\n%s", failing, strings.Join(run, "\n"), strings.Join(expected, "\n"))
+		}
+	}
+}
+
+// Check commands run match the expected ones, which may be prefixes of them.
+func commandsMatch(run []string, expected []string) bool {
+	if len(run) != len(expected) {
+		return false
+	}
+	for i := range run {
+		if !strings.HasPrefix(run[i], expected[i]) {
+			return false
+		}
+	}
+	return true
+}
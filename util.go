@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"net"
+	"os/exec"
+	"strings"
 )
 
 // Copied from include/linux/etherdevice.h
@@ -14,3 +19,38 @@ func randMACAddress() net.HardwareAddr {
 	macAddr[0] |= 0x02 // set local assignment bit (IEEE802)
 	return net.HardwareAddr(macAddr)
 }
+
+// Find the name of the interface with the given MAC address in the output of
+// "ip -o link show". Returns an empty string if not found.
+func findLinkByMAC(output string, macAddr net.HardwareAddr) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for i, field := range fields[:len(fields)-1] {
+			if field != "link/ether" {
+				continue
+			}
+			hwAddr, err := net.ParseMAC(fields[i+1])
+			if err != nil || !bytes.Equal(hwAddr, macAddr) {
+				continue
+			}
+			// Strip the trailing colon and any "@ifX" peer suffix
+			ifName := strings.TrimSuffix(fields[1], ":")
+			if idx := strings.Index(ifName, "@"); idx != -1 {
+				ifName = ifName[:idx]
+			}
+			return ifName
+		}
+	}
+	return ""
+}
+
+// Check a host command needed by an optional feature is installed.
+func requireCommand(command string, feature string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return errors.New(fmt.Sprintf("%s needs %s, which is not installed: %v", feature, command, err))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// Prompt vde_switch prints on the management socket when ready for input
+	vdeManagementPrompt string = "vde$ "
+	// Header of the data section of a management command response
+	vdeManagementDataHeader string = "0000 DATA END WITH '.'"
+	// Result code of a successful management command
+	vdeManagementSuccess string = "1000"
+	// Timeout for a single management command
+	vdeManagementTimeout time.Duration = time.Second * 5
+)
+
+// VDEManagementConn is a connection to the management socket of a vde_switch.
+type VDEManagementConn struct {
+	conn net.Conn
+}
+
+// DialVDEManagement connects to a vde_switch management socket and waits for
+// the initial prompt.
+func DialVDEManagement(mgmtSock string) (*VDEManagementConn, error) {
+	conn, err := net.DialTimeout("unix", mgmtSock, vdeManagementTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &VDEManagementConn{conn: conn}
+	if _, err := this.readUntilPrompt(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *VDEManagementConn) Close() error {
+	return this.conn.Close()
+}
+
+// Read everything up to and excluding the next prompt.
+func (this *VDEManagementConn) readUntilPrompt() (string, error) {
+	this.conn.SetReadDeadline(time.Now().Add(vdeManagementTimeout))
+	buf := new(bytes.Buffer)
+	chunk := make([]byte, 4096)
+	for !bytes.HasSuffix(buf.Bytes(), []byte(vdeManagementPrompt)) {
+		n, err := this.conn.Read(chunk)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(chunk[:n])
+	}
+	return strings.TrimSuffix(buf.String(), vdeManagementPrompt), nil
+}
+
+// Command runs a management command and returns the lines of its data
+// section, if any. Commands which do not report success return an error with
+// the switch's result message.
+func (this *VDEManagementConn) Command(command string) ([]string, error) {
+	this.conn.SetWriteDeadline(time.Now().Add(vdeManagementTimeout))
+	if _, err := this.conn.Write([]byte(command + "\n")); err != nil {
+		return nil, err
+	}
+
+	output, err := this.readUntilPrompt()
+	if err != nil {
+		return nil, err
+	}
+
+	data := []string{}
+	inData := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == vdeManagementDataHeader:
+			inData = true
+		case inData && line == ".":
+			inData = false
+		case inData:
+			data = append(data, line)
+		case len(line) > 5 && line[4] == ' ':
+			// Result line, e.g. "1000 Success"
+			if line[:4] != vdeManagementSuccess {
+				return data, errors.New(fmt.Sprintf("vde_switch command %q failed: %s", command, line[5:]))
+			}
+			return data, nil
+		}
+	}
+	return data, errors.New(fmt.Sprintf("vde_switch command %q returned no result", command))
+}